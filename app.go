@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/kandoo/beehive/raft"
 	"github.com/kandoo/beehive/state"
 )
 
@@ -27,6 +29,20 @@ type App interface {
 	// msgType is an instnace of MsgType, we use it as the type. Otherwise, we use
 	// the qualified name of msgType's reflection type.
 	HandleFunc(msgType interface{}, m MapFunc, r RcvFunc) error
+	// HandleWithPriority is similar to Handle, but also sets the priority of
+	// msgType in the queues of the hive and of the app's bees. The priority of
+	// message data that implements Prioritized takes precedence.
+	HandleWithPriority(msgType interface{}, h Handler, p Priority) error
+	// HandleTopic handles the messages of a specific message type that are
+	// published on a topic matching the topic pattern (e.g., "sensors.*.temp").
+	// It can be called multiple times to subscribe the handler to more patterns.
+	// Similar to Handle, an app has one handler per message type, and it is an
+	// error to handle a message type both with and without topic patterns.
+	HandleTopic(pattern string, msgType interface{}, h Handler) error
+	// HandleTopicFunc is similar to HandleTopic, but uses the map and receive
+	// functions.
+	HandleTopicFunc(pattern string, msgType interface{}, m MapFunc,
+		r RcvFunc) error
 
 	// Regsiters the app's detached handler.
 	Detached(h DetachedHandler)
@@ -50,6 +66,11 @@ type App interface {
 	// parameters.
 	HandleHTTPFunc(path string,
 		handler func(http.ResponseWriter, *http.Request)) *mux.Route
+
+	// DeadLetters returns the dead-letter queue of this application. Messages
+	// whose Rcv returns an error or panics are stored in this queue. Unlike other
+	// methods of App, DeadLetters is thread-safe.
+	DeadLetters() DeadLetters
 }
 
 // AppOption represents an option for applications.
@@ -97,6 +118,36 @@ func AppWithPlacement(p PlacementMethod) AppOption {
 	}
 }
 
+// AppWithDiskState is an application option that stores the state of the
+// application's bees on disk, under the hive's state path, instead of memory.
+// This is useful for applications whose state does not fit in memory. It has
+// no effect on in-memory hives.
+func AppWithDiskState() AppOption {
+	return func(a *app) {
+		a.flags |= appFlagDiskState
+	}
+}
+
+// AppWithIndex is an application option that defines a secondary index on
+// dictionary dict of the application's bees. The indexed values of each key
+// are extracted using f, and the index is queried using
+// ctx.Dict(dict).Index(name). Indexes are stored in the bees' state, and are
+// maintained as keys are modified in transactions.
+func AppWithIndex(dict, name string, f state.IndexFn) AppOption {
+	return func(a *app) {
+		a.indexes = append(a.indexes, appIndex{dict: dict, name: name, f: f})
+	}
+}
+
+// AppWithSnapshotPolicy is an application option that sets when the raft
+// nodes of persistent bees snapshot their state and compact their logs. By
+// default, bees snapshot every 1024 entries.
+func AppWithSnapshotPolicy(p raft.SnapshotPolicy) AppOption {
+	return func(a *app) {
+		a.snapPolicy = p
+	}
+}
+
 // MapFunc is a map function that maps a specific message to the set of keys
 // in state dictionaries. This method is assumed not to be thread-safe and is
 // called sequentially. If the return value is an empty set the message is
@@ -181,17 +232,33 @@ const (
 	appFlagSticky appFlag = 1 << iota
 	appFlagPersistent
 	appFlagTransactional
+	appFlagDiskState
 )
 
 type app struct {
-	name       string
-	hive       *hive
-	qee        *qee
-	handlers   map[string]Handler
-	flags      appFlag
-	replFactor int
-	placement  PlacementMethod
-	router     *mux.Router
+	name        string
+	hive        *hive
+	qee         *qee
+	handlers    map[string]Handler
+	topics      map[string][]string // topic patterns of the handlers.
+	flags       appFlag
+	replFactor  int
+	placement   PlacementMethod
+	router      *mux.Router
+	dlq         *deadLetters
+	retry       *RetryPolicy
+	dedupWindow int
+	changes     *changeFeed
+	indexes     []appIndex
+	prios       map[string]Priority // priorities of message types.
+	snapPolicy  raft.SnapshotPolicy
+}
+
+// appIndex is a secondary index defined using AppWithIndex.
+type appIndex struct {
+	dict string
+	name string
+	f    state.IndexFn
 }
 
 func (a *app) String() string {
@@ -213,15 +280,55 @@ func (a *app) Handle(msg interface{}, h Handler) error {
 
 	t := MsgType(msg)
 	a.hive.RegisterMsg(msg)
-	return a.registerHandler(t, h)
+	return a.registerHandler(t, h, "")
 }
 
-func (a *app) registerHandler(t string, h Handler) error {
+func (a *app) HandleWithPriority(msg interface{}, h Handler,
+	p Priority) error {
+
+	err := a.Handle(msg, h)
+	a.prios[MsgType(msg)] = p
+	return err
+}
+
+// msgPriority returns the priority of m in the queues of the app.
+func (a *app) msgPriority(m *msg) Priority {
+	if p, ok := a.prios[m.Type()]; ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// registerHandler registers h for message type t. If pattern is not empty, h
+// only receives the messages published on the topics matching pattern. A
+// handler registered with topic patterns cannot be replaced by a handler
+// without topic patterns, and vice versa, since that would silently change
+// the messages the app receives.
+func (a *app) registerHandler(t string, h Handler, pattern string) error {
 	_, ok := a.handlers[t]
+	topics := a.topics[t]
+	if ok && (pattern == "") != (len(topics) == 0) {
+		return fmt.Errorf("message type %v is already handled with topics %v", t,
+			topics)
+	}
+	if pattern != "" {
+		for _, p := range topics {
+			if p == pattern {
+				return fmt.Errorf("message type %v is already handled on topic %v",
+					t, pattern)
+			}
+		}
+		topics = append(topics, pattern)
+		if a.topics == nil {
+			a.topics = make(map[string][]string)
+		}
+		a.topics[t] = topics
+	}
+
 	a.handlers[t] = h
-	a.hive.registerHandler(t, a.qee, h)
+	a.hive.registerHandler(t, a.qee, h, topics)
 
-	if ok {
+	if ok && pattern == "" {
 		return errors.New("A handler for this message type already exists.")
 	}
 	return nil
@@ -240,6 +347,10 @@ func (a *app) Dict(name string) state.Dict {
 	return a.qee.Dict(name)
 }
 
+func (a *app) DeadLetters() DeadLetters {
+	return a.dlq
+}
+
 func (a *app) Name() string {
 	return a.name
 }
@@ -267,16 +378,28 @@ func (a *app) appHTTPPrefix() string {
 func (a *app) initQee() {
 	// TODO(soheil): Maybe stop the previous qee if any?
 	a.qee = &qee{
-		dataCh: newMsgChannel(a.hive.config.DataChBufSize),
+		dataCh: newBoundedMsgChannel(a.hive.config.DataChBufSize,
+			a.hive.config.HiveQueueSize, a.hive.config.QueuePolicy),
 		ctrlCh: make(chan cmdAndChannel, a.hive.config.CmdChBufSize),
 		hive:   a.hive,
 		app:    a,
 		bees:   make(map[uint64]*bee),
 	}
+	a.qee.dataCh.prio = a.msgPriority
 }
 
-func (a *app) newState() state.State {
-	return state.NewInMem()
+func (a *app) newState(b *bee) (state.State, error) {
+	if a.diskState() && !a.hive.config.InMemory {
+		s, err := state.NewOnDisk(path.Join(b.statePath(), "state"))
+		if err != nil {
+			return nil, err
+		}
+		s.SetCodec(stateCodec(a.hive.codec))
+		return s, nil
+	}
+	s := state.NewInMem()
+	s.SetCodec(stateCodec(a.hive.codec))
+	return s, nil
 }
 
 func (a *app) persistent() bool {
@@ -287,6 +410,10 @@ func (a *app) transactional() bool {
 	return a.flags&appFlagTransactional != 0
 }
 
+func (a *app) diskState() bool {
+	return a.flags&appFlagDiskState != 0
+}
+
 func (a *app) sticky() bool {
 	return a.flags&appFlagSticky != 0
 }
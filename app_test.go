@@ -3,6 +3,8 @@ package beehive
 import (
 	"fmt"
 	"net/http"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -39,6 +41,127 @@ func TestPersistentApp(t *testing.T) {
 	h.Stop()
 }
 
+func registerDiskStateApp(h Hive, ch chan int) App {
+	app := h.NewApp("diskstate", Persistent(1), AppWithDiskState())
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		var n int
+		ctx.Dict("D").GetGob("0", &n)
+		n++
+		ch <- n
+		return ctx.Dict("D").PutGob("0", n)
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+	return app
+}
+
+func TestAppWithDiskState(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_diskstate"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+
+	ch := make(chan int, 1)
+	h := NewHiveWithConfig(cfg)
+	registerDiskStateApp(h, ch)
+	go h.Start()
+	waitTilStareted(h)
+
+	for i := 1; i <= 3; i++ {
+		h.Emit(AppTestMsg(0))
+		if n := <-ch; n != i {
+			t.Errorf("invalid counter: actual=%d want=%d", n, i)
+		}
+	}
+	h.Stop()
+
+	time.Sleep(1 * time.Second)
+	h = NewHiveWithConfig(cfg)
+	registerDiskStateApp(h, ch)
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(0))
+	select {
+	case n := <-ch:
+		if n != 4 {
+			t.Errorf("invalid counter after restart: actual=%d want=4", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message is received after restart")
+	}
+}
+
+type indexTestPut string
+type indexTestGet string
+
+func registerIndexApp(h Hive, ch chan []string) {
+	byCity := func(k string, v []byte) []string {
+		return []string{string(v)}
+	}
+	app := h.NewApp("index", Persistent(1), AppWithIndex("users", "city",
+		byCity))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"users", "0"}}
+	}
+	app.HandleFunc(indexTestPut(""), mf, func(msg Msg, ctx RcvContext) error {
+		// Messages are formatted as user=city.
+		kv := strings.Split(string(msg.Data().(indexTestPut)), "=")
+		return ctx.Dict("users").Put(kv[0], []byte(kv[1]))
+	})
+	app.HandleFunc(indexTestGet(""), mf, func(msg Msg, ctx RcvContext) error {
+		keys, err := ctx.Dict("users").Index("city").Get(
+			string(msg.Data().(indexTestGet)))
+		if err != nil {
+			return err
+		}
+		ch <- keys
+		return nil
+	})
+}
+
+func TestAppWithIndex(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_index"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+
+	ch := make(chan []string, 1)
+	h := NewHiveWithConfig(cfg)
+	registerIndexApp(h, ch)
+	go h.Start()
+	waitTilStareted(h)
+
+	for _, u := range []string{"u1=paris", "u2=rome", "u3=paris", "u1=rome"} {
+		h.Emit(indexTestPut(u))
+	}
+	h.Emit(indexTestGet("rome"))
+	if keys := <-ch; !reflect.DeepEqual(keys, []string{"u1", "u2"}) {
+		t.Errorf("invalid keys: %v", keys)
+	}
+	h.Stop()
+
+	time.Sleep(1 * time.Second)
+	h = NewHiveWithConfig(cfg)
+	registerIndexApp(h, ch)
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(indexTestGet("paris"))
+	select {
+	case keys := <-ch:
+		if !reflect.DeepEqual(keys, []string{"u3"}) {
+			t.Errorf("invalid keys after restart: %v", keys)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message is received after restart")
+	}
+}
+
 func registerPersistentApp(h Hive, ch chan uint64) App {
 	app := h.NewApp("persistent", Persistent(3))
 	mf := func(msg Msg, ctx MapContext) MappedCells {
@@ -96,6 +219,56 @@ func TestReplicatedApp(t *testing.T) {
 	h3.Stop()
 }
 
+type appCodecTestReply uint64
+
+func TestReplicatedAppWithCodec(t *testing.T) {
+	ch := make(chan uint64)
+	newHive := func(statePath string, peers ...string) Hive {
+		cfg := DefaultCfg
+		cfg.StatePath = statePath
+		cfg.Addr = newHiveAddrForTest()
+		cfg.PeerAddrs = peers
+		cfg.Codec = JSONCodec.Name()
+		removeState(cfg)
+		h := NewHiveWithConfig(cfg)
+		app := h.NewApp("codec", Persistent(3))
+		mf := func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}
+		// The reply is emitted in the transaction, and is encoded using the codec
+		// of the hive when the transaction is replicated.
+		app.HandleFunc(AppTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+			ctx.Emit(appCodecTestReply(ctx.ID()))
+			return ctx.Dict("D").Put("0", []byte{})
+		})
+		app.HandleFunc(appCodecTestReply(0), mf,
+			func(msg Msg, ctx RcvContext) error {
+				ch <- uint64(msg.Data().(appCodecTestReply))
+				return nil
+			})
+		go h.Start()
+		waitTilStareted(h)
+		return h
+	}
+
+	h1 := newHive("/tmp/bhtest1")
+	defer h1.Stop()
+	h2 := newHive("/tmp/bhtest2", h1.(*hive).config.Addr)
+	defer h2.Stop()
+	h3 := newHive("/tmp/bhtest3", h1.(*hive).config.Addr)
+	defer h3.Stop()
+
+	for i := 0; i < 2; i++ {
+		h1.Emit(AppTestMsg(0))
+		select {
+		case <-ch:
+		case <-time.After(10 * time.Second):
+			t.Fatal("no reply is received")
+		}
+	}
+	time.Sleep(h1.(*hive).config.RaftElectTimeout())
+}
+
 func TestReplicatedAppFailure(t *testing.T) {
 	ch := make(chan uint64)
 
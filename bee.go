@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
 	"path"
 	"runtime/debug"
 	"sync"
@@ -14,6 +15,7 @@ import (
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	bhgob "github.com/kandoo/beehive/gob"
 	"github.com/kandoo/beehive/raft"
 	"github.com/kandoo/beehive/state"
 )
@@ -55,6 +57,14 @@ type bee struct {
 	stateL2  *state.Transactional
 	msgBufL1 []*msg
 	msgBufL2 []*msg
+	// The number of buffered messages at each savepoint of the current tx.
+	savepoints map[state.Savepoint]int
+
+	rcvMsg     *msg              // the message being handled in Rcv.
+	rcvHeaders map[string]string // headers set in Rcv.
+
+	schedTimer *time.Timer // fires when the earliest scheduled message is due.
+	schedAt    time.Time
 
 	local interface{}
 }
@@ -109,13 +119,19 @@ func (b *bee) startNode() error {
 	if c.IsNil() {
 		return fmt.Errorf("%v is in no colony", b)
 	}
+	// The log of an in-memory node is lost when it stops, and restarting it
+	// with an empty log would corrupt the colony.
+	if b.hive.config.InMemory && b.raftNode() != nil {
+		return fmt.Errorf("%v cannot restart its in-memory raft node", b)
+	}
 	peers := make([]etcdraft.Peer, 0, 1)
 	if c.Leader == b.ID() {
 		peers = append(peers, raft.NodeInfo{ID: c.Leader}.Peer())
 	}
 	b.ticker = time.NewTicker(b.hive.config.RaftTick)
 	node := raft.NewNode(b.String(), b.beeID, peers, b.sendRaft, b,
-		b.statePath(), b, 1024, b.ticker.C, b.hive.config.RaftElectTicks,
+		b.hive.config.raftDataDir(b.statePath()), b, b.app.snapPolicy,
+		b.hive.config.RaftLearnerLag, b.ticker.C, b.hive.config.RaftElectTicks,
 		b.hive.config.RaftHBTicks)
 	b.setRaftNode(node)
 	// This will act like a barrier.
@@ -235,7 +251,8 @@ func (b *bee) addFollower(bid uint64, hid uint64) error {
 		return err
 	}
 
-	if err := b.raftNode().AddNode(context.TODO(), bid, ""); err != nil {
+	// The follower votes once it has caught up with the colony.
+	if err := b.raftNode().AddLearner(context.TODO(), bid, ""); err != nil {
 		return err
 	}
 
@@ -254,6 +271,42 @@ func (b *bee) addFollower(bid uint64, hid uint64) error {
 
 func (b *bee) setState(s state.State) {
 	b.stateL1 = state.NewTransactional(s)
+	for _, i := range b.app.indexes {
+		b.stateL1.AddIndex(i.dict, i.name, i.f)
+	}
+}
+
+// initState creates the state of the bee based on its application's options.
+func (b *bee) initState() error {
+	s, err := b.app.newState(b)
+	if err != nil {
+		return fmt.Errorf("%v cannot create its state: %v", b, err)
+	}
+	// Persistent bees are snapshotted by raft, and their snapshots are
+	// replicated to followers. Use incremental snapshots to avoid serializing
+	// and shipping the whole state on every snapshot. On-disk states are not
+	// wrapped: they snapshot from their own log, and an incremental base would
+	// keep a copy of the whole state in memory.
+	if _, disk := s.(*state.OnDisk); b.app.persistent() && !disk {
+		inc := state.NewIncremental(s)
+		inc.Codec = stateCodec(b.hive.codec)
+		s = inc
+	}
+	b.setState(s)
+	return nil
+}
+
+// closeState closes the state of the bee if it is backed by a resource (e.g.,
+// a file).
+func (b *bee) closeState() {
+	if b.stateL1 == nil {
+		return
+	}
+	if c, ok := b.stateL1.State.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			glog.Errorf("%v cannot close its state: %v", b, err)
+		}
+	}
 }
 
 func (b *bee) startDetached(h DetachedHandler) {
@@ -316,10 +369,30 @@ func (b *bee) recoverFromError(mh msgAndHandler, err interface{},
 		return
 	}
 
+	if p := b.app.retry; p != nil && p.canRetry(mh.retries+1) {
+		mh.retries++
+		d := p.backoff(mh.retries)
+		glog.V(2).Infof("%v retries %v in %v (retry %d)", b, mh.msg, d, mh.retries)
+		b.snooze(mh, d)
+		return
+	}
+
 	glog.Errorf("Error in %s: %v", b.app.Name(), err)
+	m := *mh.msg
+	dl := DeadLetter{
+		App:     b.app.Name(),
+		Bee:     b.ID(),
+		Handler: fmt.Sprintf("%T", mh.handler),
+		Msg:     &m,
+		Err:     fmt.Sprint(err),
+		Time:    time.Now(),
+	}
 	if stack {
-		glog.Errorf("%s", debug.Stack())
+		dl.Stack = string(debug.Stack())
+		glog.Errorf("%s", dl.Stack)
 	}
+	id := b.app.dlq.add(dl)
+	glog.V(2).Infof("%v stores %v as dead letter %v", b, mh.msg, id)
 }
 
 var (
@@ -327,11 +400,14 @@ var (
 )
 
 func (b *bee) callRcv(mh msgAndHandler) (err error) {
+	b.rcvMsg = mh.msg
 	defer func() {
+		b.rcvMsg = nil
+		b.rcvHeaders = nil
 		if r := recover(); r != nil {
 			b.recoverFromError(mh, r, true)
+			err = errRcv
 		}
-		err = errRcv
 	}()
 
 	if err := mh.handler.Rcv(mh.msg, b); err != nil {
@@ -364,8 +440,20 @@ func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
 		}
 
 		mh := mhs[i]
+		if b.isDuplicate(mh.msg) {
+			glog.V(2).Infof("%v drops duplicate message %v", b, mh.msg)
+			if usetx {
+				b.AbortTx()
+			}
+			continue
+		}
+
 		glog.V(2).Infof("%v handles message %v", b, mh.msg)
-		b.callRcv(mh)
+		if err := b.callRcv(mh); err == nil {
+			if err = b.markProcessed(mh.msg); err != nil {
+				glog.Errorf("%v cannot mark %v as processed: %v", b, mh.msg, err)
+			}
+		}
 
 		if usetx {
 			var err error
@@ -405,7 +493,9 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	switch cmd := cc.cmd.Data.(type) {
 	case cmdStop:
 		b.status = beeStatusStopped
+		b.disarmScheduler()
 		b.stopNode()
+		b.closeState()
 		glog.V(2).Infof("%v stopped", b)
 
 	case cmdStart:
@@ -416,7 +506,12 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 		_, err = b.raftNode().Process(context.TODO(), noOp{})
 
 	case cmdRestoreState:
-		err = b.stateL1.Restore(cmd.State)
+		if err = b.stateL1.Restore(cmd.State); err == nil {
+			b.armScheduler(time.Now())
+		}
+
+	case cmdFireScheduled:
+		b.fireScheduled()
 
 	case cmdCampaign:
 		err = b.raftNode().Campaign(context.TODO())
@@ -424,6 +519,18 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	case cmdHandoff:
 		err = b.handoff(cmd.To)
 
+	case cmdTransferLeadership:
+		err = b.transferLeadership(cmd.To)
+
+	case cmdSnapshot:
+		err = b.snapshot()
+
+	case cmdExportState:
+		data, err = b.exportState(cmd.Dicts)
+
+	case cmdImportState:
+		data, err = b.importState(cmd.Data)
+
 	case cmdJoinColony:
 		if !cmd.Colony.Contains(b.ID()) {
 			err = fmt.Errorf("%v is not in this colony %v", b, cmd.Colony)
@@ -478,6 +585,9 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 
 func (b *bee) becomeLeader() {
 	b.handleMsg, b.handleCmd = b.leaderHandlers()
+	// The scheduled messages are inspected once the bee has caught up with
+	// its colony.
+	b.armScheduler(time.Now())
 }
 
 func (b *bee) leaderHandlers() (func(mhs []msgAndHandler),
@@ -566,7 +676,10 @@ func (b *bee) detachedHandlers(h DetachedHandler) (func(mhs []msgAndHandler),
 
 	mfn := func(mhs []msgAndHandler) {
 		for i := range mhs {
+			b.rcvMsg = mhs[i].msg
 			h.Rcv(mhs[i].msg, b)
+			b.rcvMsg = nil
+			b.rcvHeaders = nil
 		}
 	}
 	return mfn, b.handleCmdLocal
@@ -574,7 +687,9 @@ func (b *bee) detachedHandlers(h DetachedHandler) (func(mhs []msgAndHandler),
 
 func (b *bee) enqueMsg(mh msgAndHandler) {
 	glog.V(3).Infof("%v enqueues message %v", b, mh.msg)
-	b.dataCh.in() <- mh
+	if err := b.dataCh.send(mh); err != nil {
+		glog.Errorf("%v drops message %v: %v", b, mh.msg, err)
+	}
 }
 
 func (b *bee) enqueCmd(cc cmdAndChannel) {
@@ -653,7 +768,22 @@ func (b *bee) Hive() Hive {
 
 func (b *bee) Dict(n string) state.Dict {
 	dicts, _ := b.currentState()
-	return dicts.Dict(n)
+	return beeDict{Dict: dicts.Dict(n), b: b}
+}
+
+// beeDict wraps the dictionaries of a bee to arm its scheduler for the keys
+// with TTL.
+type beeDict struct {
+	state.Dict
+	b *bee
+}
+
+func (d beeDict) PutWithTTL(k string, v []byte, ttl time.Duration) error {
+	if err := d.Dict.PutWithTTL(k, v, ttl); err != nil {
+		return err
+	}
+	d.b.armScheduler(time.Now().Add(ttl))
+	return nil
 }
 
 func (b *bee) App() string {
@@ -662,11 +792,41 @@ func (b *bee) App() string {
 
 // Emits a message. Note that m should be your data not an instance of Msg.
 func (b *bee) Emit(msgData interface{}) {
-	b.bufferOrEmit(newMsgFromData(msgData, b.ID(), 0))
+	b.bufferOrEmit(b.newMsg(msgData, b.ID(), 0))
+}
+
+// newMsg creates a new message that carries the headers of the message being
+// handled. The ID of the message is assigned here, so that it is buffered and
+// replicated along with the message in the current transaction, and the
+// message keeps its ID if it is emitted again after a failover.
+func (b *bee) newMsg(data interface{}, from uint64, to uint64) *msg {
+	m := newMsgFromData(data, from, to)
+	m.MsgID = b.hive.newMsgID()
+	m.MsgHeaders = b.emitHeaders()
+	return m
+}
+
+// emitHeaders returns the headers of the messages emitted while handling the
+// current message. It must be called from the bee's goroutine.
+func (b *bee) emitHeaders() map[string]string {
+	var h map[string]string
+	if b.rcvMsg != nil {
+		h = b.rcvMsg.MsgHeaders
+	}
+	return mergeHeaders(h, b.rcvHeaders)
+}
+
+func (b *bee) SetHeader(key, value string) {
+	if b.rcvHeaders == nil {
+		b.rcvHeaders = make(map[string]string)
+	}
+	b.rcvHeaders[key] = value
 }
 
 func (b *bee) doEmit(msg *msg) {
-	b.hive.enqueMsg(msg)
+	if err := b.hive.enqueMsg(msg); err != nil {
+		glog.Errorf("%v cannot emit %v: %v", b, msg, err)
+	}
 }
 
 func (b *bee) bufferOrEmit(msg *msg) {
@@ -685,12 +845,12 @@ func (b *bee) SendToCell(msgData interface{}, app string, cell CellKey) {
 	if err != nil {
 		glog.Fatalf("cannot find any bee in app %v for cell %v", app, cell)
 	}
-	msg := newMsgFromData(msgData, bi.ID, 0)
+	msg := b.newMsg(msgData, b.ID(), bi.ID)
 	b.bufferOrEmit(msg)
 }
 
 func (b *bee) SendToBee(msgData interface{}, to uint64) {
-	b.bufferOrEmit(newMsgFromData(msgData, b.beeID, to))
+	b.bufferOrEmit(b.newMsg(msgData, b.beeID, to))
 }
 
 // Reply to msg with the provided reply.
@@ -745,15 +905,18 @@ func (b *bee) BeginTx() error {
 }
 
 func (b *bee) commitTxBothLayers() (err error) {
+	var ops []state.Op
 	hasL2 := b.stateL2 != nil
 	if hasL2 {
 		if err = b.stateL2.CommitTx(); err != nil {
 			goto reset
 		}
 	}
+	ops = b.stateL1.TxOps()
 	if err = b.stateL1.CommitTx(); err != nil {
 		goto reset
 	}
+	b.emitChanges(ops, b.emitHeaders())
 	for i := range b.msgBufL1 {
 		b.doEmit(b.msgBufL1[i])
 	}
@@ -777,7 +940,9 @@ func (b *bee) commitTxL1() (err error) {
 		b.commitTxL2()
 	}
 
+	ops := b.stateL1.TxOps()
 	if err = b.stateL1.CommitTx(); err == nil {
+		b.emitChanges(ops, b.emitHeaders())
 		for i := range b.msgBufL1 {
 			b.doEmit(b.msgBufL1[i])
 		}
@@ -799,6 +964,7 @@ func (b *bee) commitTxL2() (err error) {
 
 func (b *bee) resetTx(dicts *state.Transactional, msgs *[]*msg) {
 	dicts.Reset()
+	b.savepoints = nil
 	for i := range *msgs {
 		(*msgs)[i] = nil
 	}
@@ -827,14 +993,18 @@ func (b *bee) replicate() error {
 
 	b.maybeRecruitFollowers()
 
-	tx := tx{
+	req, err := newCommitTx(tx{
 		Tx:   stx,
 		Msgs: b.msgBufL1,
+	}, b.hive.codec)
+	if err != nil {
+		glog.Errorf("%v cannot encode the transaction: %v", b, err)
+		return err
 	}
 	ctx, ccl := context.WithTimeout(context.Background(),
 		b.hive.config.RaftElectTimeout())
 	defer ccl()
-	if _, err := b.raftNode().Process(ctx, commitTx(tx)); err != nil {
+	if _, err := b.raftNode().Process(ctx, req); err != nil {
 		glog.Errorf("%v cannot replicate the transaction: %v", b, err)
 		return err
 	}
@@ -965,29 +1135,39 @@ func (b *bee) handoff(to uint64) error {
 		return fmt.Errorf("%v is not a follower of %v", to, b)
 	}
 
-	if _, err := b.qee.sendCmdToBee(to, cmdSync{}); err != nil {
-		return err
-	}
-	// TODO(soheil): do we really need to stop the node here?
-	b.stopNode()
+	return b.transferLeadership(to)
+}
 
-	ch := make(chan error)
-	go func() {
-		// TODO(soheil): use context with deadline here.
-		_, err := b.qee.sendCmdToBee(to, cmdCampaign{})
-		ch <- err
-	}()
+// transferLeadership hands the leadership of the colony over to follower to,
+// or to any follower if to is Nil.
+func (b *bee) transferLeadership(to uint64) error {
+	if b.detached || !b.app.persistent() {
+		return fmt.Errorf("%v is not replicated", b)
+	}
 
-	time.Sleep(b.hive.config.RaftElectTimeout())
-	if err := b.startNode(); err != nil {
-		glog.Fatalf("%v cannot restart node: %v", b, err)
+	ctx, ccl := context.WithTimeout(context.Background(),
+		300*b.hive.config.RaftTick)
+	defer ccl()
+	if err := b.raftNode().TransferLeadership(ctx, to); err != nil {
+		return err
 	}
 
 	if b.colony().IsFollower(b.ID()) {
 		glog.V(2).Infof("%v successfully handed off leadership to %v", b, to)
 		b.becomeFollower()
 	}
-	return <-ch
+	return nil
+}
+
+func (b *bee) snapshot() error {
+	if b.detached || !b.app.persistent() {
+		return fmt.Errorf("%v is not replicated", b)
+	}
+
+	ctx, ccl := context.WithTimeout(context.Background(),
+		300*b.hive.config.RaftTick)
+	defer ccl()
+	return b.raftNode().Snapshot(ctx)
 }
 
 func (b *bee) currentState() (dicts *state.Transactional, msgs *[]*msg) {
@@ -1025,6 +1205,45 @@ func (b *bee) AbortTx() error {
 	return err
 }
 
+func (b *bee) Savepoint() (state.Savepoint, error) {
+	dicts, msgs := b.currentState()
+	sp, err := dicts.Savepoint()
+	if err != nil {
+		return sp, err
+	}
+
+	if b.savepoints == nil {
+		b.savepoints = make(map[state.Savepoint]int)
+	}
+	b.savepoints[sp] = len(*msgs)
+	return sp, nil
+}
+
+func (b *bee) RollbackTo(sp state.Savepoint) error {
+	dicts, msgs := b.currentState()
+	if err := dicts.RollbackTo(sp); err != nil {
+		return err
+	}
+
+	glog.V(2).Infof("%v rolls back to savepoint", b)
+	n := b.savepoints[sp]
+	for i := n; i < len(*msgs); i++ {
+		(*msgs)[i] = nil
+	}
+	*msgs = (*msgs)[:n]
+	return nil
+}
+
+func (b *bee) ReleaseSavepoint(sp state.Savepoint) error {
+	dicts, _ := b.currentState()
+	if err := dicts.ReleaseSavepoint(sp); err != nil {
+		return err
+	}
+
+	delete(b.savepoints, sp)
+	return nil
+}
+
 func (b *bee) Snooze(d time.Duration) {
 	panic(d)
 }
@@ -1037,6 +1256,32 @@ func (b *bee) Restore(buf []byte) error {
 	return b.stateL1.Restore(buf)
 }
 
+// SnapshotID, DeltaSnapshot and ExpandSnapshot let the raft node of the bee
+// ship its incremental snapshots to followers as deltas.
+func (b *bee) SnapshotID(buf []byte) (uint64, bool) {
+	s, ok := b.stateL1.State.(*state.Incremental)
+	if !ok {
+		return 0, false
+	}
+	return s.SnapshotID(buf)
+}
+
+func (b *bee) DeltaSnapshot(buf []byte, from uint64) ([]byte, bool) {
+	s, ok := b.stateL1.State.(*state.Incremental)
+	if !ok {
+		return nil, false
+	}
+	return s.DeltaSnapshot(buf, from)
+}
+
+func (b *bee) ExpandSnapshot(buf []byte) ([]byte, error) {
+	s, ok := b.stateL1.State.(*state.Incremental)
+	if !ok {
+		return buf, nil
+	}
+	return s.ExpandSnapshot(buf)
+}
+
 func (b *bee) Apply(req interface{}) (interface{}, error) {
 	b.Lock()
 	defer b.Unlock()
@@ -1058,9 +1303,21 @@ func (b *bee) Apply(req interface{}) (interface{}, error) {
 		if err := b.stateL1.Apply(r.Ops); err != nil {
 			return nil, err
 		}
-
+		// Transactions replayed from the log when the node starts are already
+		// emitted, and emitInRaft is set only after the replay.
 		if leader && b.emitInRaft {
-			for _, msg := range r.Msgs {
+			b.emitChanges(r.Ops, nil)
+			msgs, err := r.msgs()
+			if err != nil {
+				glog.Errorf("%v cannot decode the messages of a transaction: %v", b,
+					err)
+			}
+			for _, msg := range msgs {
+				// Transactions can be replayed from older versions of the app.
+				if err := upcastMsg(msg); err != nil {
+					glog.Errorf("%v cannot upcast %v: %v", b, msg, err)
+					continue
+				}
 				msg.MsgFrom = b.beeID
 				glog.V(2).Infof("%v emits %#v", b, msg)
 				b.doEmit(msg)
@@ -1082,6 +1339,13 @@ func (b *bee) ApplyConfChange(cc raftpb.ConfChange,
 	col := b.beeColony
 	switch cc.Type {
 	case raftpb.ConfChangeAddNode:
+		// The raft node rejects duplicate voters, so this is the promotion of a
+		// follower that was added as a learner.
+		if col.Contains(cc.NodeID) {
+			break
+		}
+		col.AddFollower(cc.NodeID)
+	case raft.ConfChangeAddLearnerNode:
 		if col.Contains(cc.NodeID) {
 			return ErrDuplicateBee
 		}
@@ -1106,7 +1370,73 @@ func (b *bee) ApplyConfChange(cc raftpb.ConfChange,
 }
 
 // bee raft commands
-type commitTx tx
+
+// commitTx replicates a transaction of a bee. The messages of the transaction
+// are encoded separately in EncMsgs, so that its operations can be decoded
+// without the types of its messages (e.g., by LoadBeeState).
+type commitTx struct {
+	state.Tx
+	Msgs     []*msg // Messages of the transactions replicated by older versions.
+	EncMsgs  []byte // Messages of the transaction encoded using MsgCodec.
+	MsgCodec string // Name of the codec of EncMsgs. Empty means gob.
+}
+
+// newCommitTx creates the command that replicates t, and encodes the messages
+// of t using codec c.
+func newCommitTx(t tx, c Codec) (commitTx, error) {
+	ct := commitTx{Tx: t.Tx}
+	if len(t.Msgs) == 0 {
+		return ct, nil
+	}
+
+	var err error
+	if c.Name() == GobCodec.Name() {
+		ct.EncMsgs, err = bhgob.Encode(t.Msgs)
+		return ct, err
+	}
+
+	var buf bytes.Buffer
+	enc := newMsgEncoder(c, &buf)
+	for _, m := range t.Msgs {
+		if err = enc.Encode(*m); err != nil {
+			return ct, err
+		}
+	}
+	ct.EncMsgs = buf.Bytes()
+	ct.MsgCodec = c.Name()
+	return ct, nil
+}
+
+// msgs returns the messages of the transaction.
+func (c commitTx) msgs() ([]*msg, error) {
+	if len(c.EncMsgs) == 0 {
+		return c.Msgs, nil
+	}
+
+	var msgs []*msg
+	if c.MsgCodec == "" {
+		if err := bhgob.Decode(&msgs, c.EncMsgs); err != nil {
+			return nil, err
+		}
+		return msgs, nil
+	}
+
+	codec, err := CodecByName(c.MsgCodec)
+	if err != nil {
+		return nil, err
+	}
+	dec := newMsgDecoder(codec, bytes.NewBuffer(c.EncMsgs))
+	for {
+		m := &msg{}
+		if err := dec.Decode(m); err != nil {
+			if err == io.EOF {
+				return msgs, nil
+			}
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+}
 
 func init() {
 	gob.Register(commitTx{})
@@ -1,8 +1,10 @@
 package beehive
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"os"
 	"testing"
 	"time"
 
@@ -35,6 +37,7 @@ func BenchmarkBeePersistence(b *testing.B) {
 				StatePath: "/tmp/bhtest_bench_bee",
 			},
 			collector: &noOpStatCollector{},
+			codec:     GobCodec,
 		},
 		app: &app{
 			name:  "test",
@@ -64,3 +67,112 @@ func BenchmarkBeePersistence(b *testing.B) {
 	bee.stopNode()
 	time.Sleep(1 * time.Second)
 }
+
+type savepointTestMsg string
+type savepointTestReply string
+
+func TestBeeSavepoint(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_savepoint"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan string, 4)
+	app := h.NewApp("savepoint", Transactional())
+	app.HandleFunc(savepointTestMsg(""), mf, func(msg Msg, ctx RcvContext) error {
+		ctx.Dict("D").Put("k1", []byte("v1"))
+		ctx.Emit(savepointTestReply("r1"))
+		sp, err := ctx.Savepoint()
+		if err != nil {
+			t.Errorf("cannot create savepoint: %v", err)
+		}
+		ctx.Dict("D").Put("k2", []byte("v2"))
+		ctx.Emit(savepointTestReply("r2"))
+		if err := ctx.RollbackTo(sp); err != nil {
+			t.Errorf("cannot rollback to savepoint: %v", err)
+		}
+		return nil
+	})
+	app.HandleFunc(savepointTestReply(""), mf,
+		func(msg Msg, ctx RcvContext) error {
+			_, err1 := ctx.Dict("D").Get("k1")
+			_, err2 := ctx.Dict("D").Get("k2")
+			if err1 != nil || err2 == nil {
+				t.Errorf("invalid state after rollback: %v %v", err1, err2)
+			}
+			ch <- string(msg.Data().(savepointTestReply))
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(savepointTestMsg(""))
+	select {
+	case r := <-ch:
+		if r != "r1" {
+			t.Errorf("invalid reply: %v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+	select {
+	case r := <-ch:
+		t.Errorf("rolled back message is emitted: %v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBeeInitState(t *testing.T) {
+	statePath := "/tmp/bhtest_bee_init_state"
+	os.RemoveAll(statePath)
+	defer os.RemoveAll(statePath)
+
+	newBee := func(flags appFlag, c Codec) *bee {
+		h := &hive{config: HiveConfig{StatePath: statePath}, codec: c}
+		b := &bee{
+			beeID: 1,
+			hive:  h,
+			app:   &app{name: "test", flags: flags, hive: h},
+		}
+		if err := b.initState(); err != nil {
+			t.Fatalf("cannot init state: %v", err)
+		}
+		return b
+	}
+
+	b := newBee(appFlagPersistent, GobCodec)
+	if _, ok := b.stateL1.State.(*state.Incremental); !ok {
+		t.Errorf("persistent bee has a %T state", b.stateL1.State)
+	}
+
+	// On-disk states snapshot from their own log and must not keep a base in
+	// memory.
+	b = newBee(appFlagPersistent|appFlagDiskState, GobCodec)
+	defer b.closeState()
+	if _, ok := b.stateL1.State.(*state.OnDisk); !ok {
+		t.Errorf("persistent bee with disk state has a %T state",
+			b.stateL1.State)
+	}
+
+	// Snapshots are encoded using the codec of the hive.
+	b = newBee(appFlagPersistent, JSONCodec)
+	b.stateL1.Dict("d").Put("k", []byte("v"))
+	buf, err := b.Save()
+	if err != nil {
+		t.Fatalf("cannot save the state: %v", err)
+	}
+	if !json.Valid(buf) {
+		t.Errorf("snapshot is not encoded using the codec of the hive: %q", buf)
+	}
+	b = newBee(appFlagPersistent, JSONCodec)
+	if err := b.Restore(buf); err != nil {
+		t.Fatalf("cannot restore the state: %v", err)
+	}
+	if v, err := b.stateL1.Dict("d").Get("k"); err != nil || string(v) != "v" {
+		t.Errorf("invalid value: actual=%s want=v (%v)", v, err)
+	}
+}
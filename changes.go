@@ -0,0 +1,166 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"strings"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// DictChange represents the changes committed to a dictionary by a bee in a
+// single transaction. Ops only contains Put and Del operations: atomic
+// operations (e.g., Increment) are published as puts of their resulting
+// values.
+type DictChange struct {
+	App  string     `json:"app"`
+	Bee  uint64     `json:"bee"`
+	Dict string     `json:"dict"`
+	Ops  []state.Op `json:"ops"`
+}
+
+// ChangeTopic returns the topic on which the changes of dictionary dict in
+// app are published. Use it in App.HandleTopic to receive DictChange
+// messages.
+func ChangeTopic(app, dict string) string {
+	return strings.Join([]string{changeTopicPrefix, app, dict}, topicSep)
+}
+
+const (
+	changeTopicPrefix = "cdc"
+	// changeSubBufSize is the buffer size of change subscriptions. Subscribers
+	// that fall behind by more than this many changes are disconnected.
+	changeSubBufSize = 1024
+)
+
+// AppWithChangeStream is an application option that publishes the changes
+// committed to the given dictionaries of the application, or to all of its
+// dictionaries if no dictionary is given. The changes are emitted as
+// DictChange messages on ChangeTopic(app, dict), and are streamed on the
+// hive's HTTP endpoint "/api/v1/changes/app/dict".
+//
+// Changes are published when transactions are committed. As such, this option
+// is only effective for transactional applications.
+func AppWithChangeStream(dicts ...string) AppOption {
+	return func(a *app) {
+		a.changes = newChangeFeed(dicts)
+	}
+}
+
+// changeFeed dispatches the committed changes of an application to its local
+// subscribers.
+type changeFeed struct {
+	sync.Mutex
+	dicts map[string]bool
+	subs  map[string]map[chan DictChange]struct{}
+}
+
+func newChangeFeed(dicts []string) *changeFeed {
+	f := &changeFeed{
+		subs: make(map[string]map[chan DictChange]struct{}),
+	}
+	if len(dicts) != 0 {
+		f.dicts = make(map[string]bool)
+		for _, d := range dicts {
+			f.dicts[d] = true
+		}
+	}
+	return f
+}
+
+// watches returns whether the changes of dictionary d are published. Internal
+// dictionaries are only published if they are explicitly requested.
+func (f *changeFeed) watches(d string) bool {
+	if f.dicts == nil {
+		return !strings.HasPrefix(d, "__")
+	}
+	return f.dicts[d]
+}
+
+// subscribe returns a channel that receives the changes of dictionary d. The
+// channel is closed when the subscriber falls behind.
+func (f *changeFeed) subscribe(d string) chan DictChange {
+	f.Lock()
+	defer f.Unlock()
+	ch := make(chan DictChange, changeSubBufSize)
+	subs, ok := f.subs[d]
+	if !ok {
+		subs = make(map[chan DictChange]struct{})
+		f.subs[d] = subs
+	}
+	subs[ch] = struct{}{}
+	return ch
+}
+
+func (f *changeFeed) unsubscribe(d string, ch chan DictChange) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.subs[d][ch]; ok {
+		delete(f.subs[d], ch)
+		close(ch)
+	}
+}
+
+func (f *changeFeed) publish(c DictChange) {
+	f.Lock()
+	defer f.Unlock()
+	for ch := range f.subs[c.Dict] {
+		select {
+		case ch <- c:
+		default:
+			glog.Warningf("disconnecting a slow subscriber of %v/%v", c.App, c.Dict)
+			delete(f.subs[c.Dict], ch)
+			close(ch)
+		}
+	}
+}
+
+// emitChanges publishes the committed operations of the bee in messages with
+// the given headers. It is also called from the raft goroutine of replicated
+// bees, and must not depend on the message the bee is handling.
+func (b *bee) emitChanges(ops []state.Op, headers map[string]string) {
+	f := b.app.changes
+	if f == nil || len(ops) == 0 {
+		return
+	}
+
+	var dicts []string
+	byDict := make(map[string][]state.Op)
+	for _, o := range ops {
+		if !f.watches(o.D) {
+			continue
+		}
+		if _, ok := byDict[o.D]; !ok {
+			dicts = append(dicts, o.D)
+		}
+		byDict[o.D] = append(byDict[o.D], changeOp(o))
+	}
+
+	for _, d := range dicts {
+		c := DictChange{
+			App:  b.app.Name(),
+			Bee:  b.ID(),
+			Dict: d,
+			Ops:  byDict[d],
+		}
+		f.publish(c)
+		m := newMsgFromData(c, b.ID(), 0)
+		m.MsgID = b.hive.newMsgID()
+		m.MsgHeaders = headers
+		m.MsgTopic = ChangeTopic(c.App, d)
+		b.doEmit(m)
+	}
+}
+
+// changeOp returns o as a Put or a Del operation.
+func changeOp(o state.Op) state.Op {
+	if o.T == state.Del {
+		return state.Op{T: state.Del, D: o.D, K: o.K}
+	}
+	return state.Op{T: state.Put, D: o.D, K: o.K, V: o.V}
+}
+
+func init() {
+	gob.Register(DictChange{})
+}
@@ -0,0 +1,240 @@
+package beehive
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+type changeTestMsg string
+
+func registerChangeTestApp(h Hive, opts ...AppOption) App {
+	app := h.NewApp("kv", opts...)
+	app.HandleFunc(changeTestMsg(""),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"store", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			k := string(msg.Data().(changeTestMsg))
+			ctx.Dict("store").Put(k, []byte(k))
+			ctx.Dict("other").Put(k, []byte(k))
+			return nil
+		})
+	return app
+}
+
+func checkDictChange(t *testing.T, c DictChange, k string) {
+	if c.App != "kv" || c.Dict != "store" || len(c.Ops) != 1 {
+		t.Fatalf("invalid change: %#v", c)
+	}
+	if o := c.Ops[0]; o.T != state.Put || o.K != k || string(o.V) != k {
+		t.Errorf("invalid op: %#v", o)
+	}
+}
+
+func TestDictChangeMsg(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_changes"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	registerChangeTestApp(h, Transactional(), AppWithChangeStream("store"))
+	ch := make(chan DictChange, 2)
+	h.NewApp("cache").HandleTopicFunc(ChangeTopic("kv", "#"), DictChange{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"C", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(DictChange)
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(changeTestMsg("k1"))
+	select {
+	case c := <-ch:
+		checkDictChange(t, c, "k1")
+	case <-time.After(5 * time.Second):
+		t.Fatal("change is not received")
+	}
+
+	select {
+	case c := <-ch:
+		t.Errorf("changes of an unwatched dictionary are published: %#v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDictChangeAtomicOps(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_changes_atomic"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	app := h.NewApp("kv", Transactional(), AppWithChangeStream("store"))
+	app.HandleFunc(changeTestMsg(""),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"store", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			_, err := ctx.Dict("store").Increment("cnt", 2)
+			return err
+		})
+	ch := make(chan DictChange, 2)
+	h.NewApp("cache").HandleTopicFunc(ChangeTopic("kv", "store"), DictChange{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"C", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(DictChange)
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+
+	for _, want := range []string{"2", "4"} {
+		h.Emit(changeTestMsg("k"))
+		select {
+		case c := <-ch:
+			if len(c.Ops) != 1 {
+				t.Fatalf("invalid change: %#v", c)
+			}
+			if o := c.Ops[0]; o.T != state.Put || o.K != "cnt" ||
+				string(o.V) != want {
+
+				t.Errorf("invalid op: actual=%#v want=put cnt=%v", o, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("change is not received")
+		}
+	}
+}
+
+func TestDictChangeHTTP(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_changes_http"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	registerChangeTestApp(h, Persistent(1), AppWithChangeStream())
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	url := buildURL("http", cfg.Addr, serverV1ChangesPath+"/kv/__dedup__")
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("cannot get changes: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("internal dictionary is streamed: %v", res.StatusCode)
+	}
+
+	url = buildURL("http", cfg.Addr, serverV1ChangesPath+"/kv/store")
+	res, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("cannot get changes: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code: %v", res.StatusCode)
+	}
+
+	h.Emit(changeTestMsg("k1"))
+	h.Emit(changeTestMsg("k2"))
+
+	chch := make(chan DictChange, 16)
+	go func() {
+		r := bufio.NewReader(res.Body)
+		for {
+			l, err := r.ReadBytes('\n')
+			if err != nil {
+				close(chch)
+				return
+			}
+			var c DictChange
+			if err := json.Unmarshal(l, &c); err != nil {
+				t.Errorf("cannot decode change %s: %v", l, err)
+			}
+			chch <- c
+		}
+	}()
+
+	// Messages can be processed in a single transaction, and their changes can
+	// be published together.
+	keys := make(map[string]bool)
+	for len(keys) < 2 {
+		select {
+		case c := <-chch:
+			if c.App != "kv" || c.Dict != "store" {
+				t.Fatalf("invalid change: %#v", c)
+			}
+			for _, o := range c.Ops {
+				if o.T != state.Put || o.K != string(o.V) {
+					t.Errorf("invalid op: %#v", o)
+				}
+				keys[o.K] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("changes are not streamed: %v", keys)
+		}
+	}
+	if !keys["k1"] || !keys["k2"] {
+		t.Errorf("invalid keys: %v", keys)
+	}
+}
+
+func TestDictChangeAfterRestart(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_changes_restart"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+
+	ch := make(chan DictChange, 16)
+	start := func() Hive {
+		h := NewHiveWithConfig(cfg)
+		registerChangeTestApp(h, Persistent(1), AppWithChangeStream("store"))
+		h.NewApp("cache").HandleTopicFunc(ChangeTopic("kv", "store"),
+			DictChange{},
+			func(msg Msg, ctx MapContext) MappedCells {
+				return MappedCells{{"C", "0"}}
+			},
+			func(msg Msg, ctx RcvContext) error {
+				ch <- msg.Data().(DictChange)
+				return nil
+			})
+		go h.Start()
+		waitTilStareted(h)
+		return h
+	}
+
+	h := start()
+	h.Emit(changeTestMsg("k1"))
+	select {
+	case c := <-ch:
+		checkDictChange(t, c, "k1")
+	case <-time.After(5 * time.Second):
+		t.Fatal("change is not received")
+	}
+	h.Stop()
+
+	time.Sleep(1 * time.Second)
+	h = start()
+	defer h.Stop()
+	h.Emit(changeTestMsg("k2"))
+	select {
+	case c := <-ch:
+		checkDictChange(t, c, "k2")
+	case <-time.After(5 * time.Second):
+		t.Fatal("change is not received after restart")
+	}
+}
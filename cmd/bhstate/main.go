@@ -0,0 +1,211 @@
+// bhstate exports the state of beehive applications to JSON lines, and imports
+// JSON lines into the state of bees.
+//
+// Each line is a record of the form {"dict": d, "key": k, "text": v}, where
+// values that are not valid UTF-8 are stored as base64 in "value" instead of
+// "text".
+//
+// To export the persisted state of a bee while its hive is stopped:
+//
+//	bhstate -statepath /tmp/beehive -app kv -bee 1 export > kv.jsonl
+//
+// To export the state of all the bees of an app into a directory:
+//
+//	bhstate -statepath /tmp/beehive -app kv -out kvdump export
+//
+// To import records into the persisted state of a bee while its hive is
+// stopped:
+//
+//	bhstate -statepath /tmp/beehive -app kv -bee 1 import < kv.jsonl
+//
+// The records of a persistent bee are appended to its raft log, and are
+// applied when its hive restarts. Only bees without followers can be imported
+// offline.
+//
+// To export and import the state of a bee on a running hive:
+//
+//	bhstate -addr localhost:7767 -app kv -bee 1 export > kv.jsonl
+//	bhstate -addr localhost:7767 -app kv -bee 1 import < kv.jsonl
+//
+// Imported records are committed in a single transaction of the bee, and are
+// replicated if the app is persistent.
+//
+// When exporting a stopped hive, only the state operations of transactions
+// are decoded. Transactions replicated by older versions of beehive also store
+// their messages with their operations. To export those, build a copy of this
+// command that registers the message types of the app in gob.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	bh "github.com/kandoo/beehive"
+	bhflag "github.com/kandoo/beehive/flag"
+	"github.com/kandoo/beehive/state"
+)
+
+var (
+	addr  = flag.String("addr", "", "address of a running hive")
+	app   = flag.String("app", "", "name of the application")
+	bee   = flag.Uint64("bee", 0, "ID of the bee")
+	out   = flag.String("out", "", "output file, or directory for all bees")
+	in    = flag.String("in", "", "input file (default stdin)")
+	dicts []string
+)
+
+func init() {
+	flag.Var(&bhflag.CSV{S: &dicts}, "dicts",
+		"comma-separated dictionaries to export (default all)")
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] export|import\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *app == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "export":
+		err = export()
+	case "import":
+		err = importState()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bhstate: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func stateURL() string {
+	return fmt.Sprintf("http://%s/api/v1/state/%s/%d", *addr, *app, *bee)
+}
+
+func create(name string) (io.WriteCloser, error) {
+	if name == "" {
+		return os.Stdout, nil
+	}
+	return os.Create(name)
+}
+
+func export() error {
+	if *addr != "" {
+		return exportOnline()
+	}
+
+	if *bee != 0 {
+		return exportBee(*bee, *out)
+	}
+	if *out == "" {
+		return fmt.Errorf("-out is required when exporting all bees")
+	}
+	bees, err := bh.AppBees(bh.DefaultCfg.StatePath, *app)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*out, 0700); err != nil {
+		return err
+	}
+	for _, b := range bees {
+		err := exportBee(b, path.Join(*out, fmt.Sprintf("%016X.jsonl", b)))
+		if err != nil {
+			return fmt.Errorf("cannot export bee %v: %v", b, err)
+		}
+	}
+	return nil
+}
+
+func exportBee(b uint64, name string) error {
+	s, err := bh.LoadBeeState(bh.DefaultCfg.StatePath, *app, b)
+	if err != nil {
+		return err
+	}
+	w, err := create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return state.Export(w, s, dicts...)
+}
+
+func exportOnline() error {
+	if *bee == 0 {
+		return fmt.Errorf("-bee is required when exporting from a hive")
+	}
+	u := stateURL()
+	if len(dicts) != 0 {
+		u += "?dicts=" + url.QueryEscape(strings.Join(dicts, ","))
+	}
+	res, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return httpError(res)
+	}
+
+	w, err := create(*out)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+func importState() error {
+	if *bee == 0 {
+		return fmt.Errorf("-bee is required for import")
+	}
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if *addr == "" {
+		n, err := bh.ImportBeeState(bh.DefaultCfg.StatePath, *app, *bee, r)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("{\"records\":%d}\n", n)
+		return nil
+	}
+
+	res, err := http.Post(stateURL(), "application/x-ndjson", r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return httpError(res)
+	}
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
+
+func httpError(res *http.Response) error {
+	b, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("%v: %s", res.Status, strings.TrimSpace(string(b)))
+}
@@ -13,8 +13,11 @@ type cmdAddFollower struct {
 type cmdAddHive struct{ Info raft.NodeInfo }
 type cmdCampaign struct{}
 type cmdCreateBee struct{}
+type cmdExportState struct{ Dicts []string }
 type cmdFindBee struct{ ID uint64 }
+type cmdFireScheduled struct{}
 type cmdHandoff struct{ To uint64 }
+type cmdImportState struct{ Data []byte }
 type cmdRestoreState struct{ State []byte }
 type cmdJoinColony struct{ Colony Colony }
 type cmdAddMappedCells struct{ Cells MappedCells }
@@ -30,32 +33,47 @@ type cmdReloadBee struct {
 	ID     uint64
 	Colony Colony
 }
+type cmdSnapshot struct{}
 type cmdStart struct{}
 type cmdStartDetached struct{ Handler DetachedHandler }
 type cmdStop struct{}
 type cmdSync struct{}
+type cmdTransferLeadership struct{ To uint64 }
 
 func init() {
-	gob.Register(cmdAddFollower{})
-	gob.Register(cmdAddHive{})
-	gob.Register(cmdAddHive{})
-	gob.Register(cmdAddMappedCells{})
-	gob.Register(cmdCampaign{})
-	gob.Register(cmdCreateBee{})
-	gob.Register(cmdCreateBee{})
-	gob.Register(cmdFindBee{})
-	gob.Register(cmdFindBee{})
-	gob.Register(cmdHandoff{})
-	gob.Register(cmdJoinColony{})
-	gob.Register(cmdLiveHives{})
-	gob.Register(cmdMigrate{})
-	gob.Register(cmdNewHiveID{})
-	gob.Register(cmdPing{})
-	gob.Register(cmdRefreshRole{})
-	gob.Register(cmdReloadBee{})
-	gob.Register(cmdRestoreState{})
+	for _, c := range []interface{}{
+		cmdAddFollower{},
+		cmdAddHive{},
+		cmdAddMappedCells{},
+		cmdCampaign{},
+		cmdCreateBee{},
+		cmdFindBee{},
+		cmdExportState{},
+		cmdFireScheduled{},
+		cmdHandoff{},
+		cmdImportState{},
+		cmdJoinColony{},
+		cmdLiveHives{},
+		cmdMigrate{},
+		cmdNewHiveID{},
+		cmdPing{},
+		cmdRefreshRole{},
+		cmdReloadBee{},
+		cmdRestoreState{},
+		cmdSnapshot{},
+		cmdStart{},
+		cmdStop{},
+		cmdSync{},
+		cmdTransferLeadership{},
+	} {
+		gob.Register(c)
+		registerValueType(c)
+	}
+	// The handler of cmdStartDetached is only encoded by gob, and the command
+	// is never sent to other hives.
 	gob.Register(cmdStartDetached{})
-	gob.Register(cmdStart{})
-	gob.Register(cmdStop{})
-	gob.Register(cmdSync{})
+
+	// Results of commands.
+	registerValueType(uint64(0))
+	registerValueType([]byte(nil))
 }
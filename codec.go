@@ -0,0 +1,835 @@
+package beehive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/code.google.com/p/gogoprotobuf/proto"
+	bhgob "github.com/kandoo/beehive/gob"
+	"github.com/kandoo/beehive/state"
+)
+
+// Codec encodes and decodes the messages exchanged between hives. Codecs
+// are registered by their name, and are chosen per hive (using
+// HiveConfig.Codec) or per message type (using RegisterMsgCodec).
+//
+// The codec of a hive encodes the application messages and the commands that
+// it sends to other hives, the messages of the transactions replicated by its
+// bees, and the snapshots of the state of its bees. Commands, transactions and
+// snapshots are not protocol buffers, and are encoded using gob when the hive
+// uses ProtoCodec. Raft messages are always encoded as protocol buffers.
+type Codec interface {
+	// Name returns the unique name of the codec (e.g., "json").
+	Name() string
+	// ContentType returns the MIME type of the encoded values.
+	ContentType() string
+
+	// Marshal encodes v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes b into v.
+	Unmarshal(b []byte, v interface{}) error
+
+	// NewEncoder returns an encoder that writes a stream of values into w.
+	NewEncoder(w io.Writer) Encoder
+	// NewDecoder returns a decoder that reads a stream of values from r.
+	NewDecoder(r io.Reader) Decoder
+}
+
+// Encoder encodes a stream of values.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder decodes a stream of values.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+var (
+	// GobCodec encodes values using encoding/gob. Types of messages must be
+	// registered in gob.
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes values using encoding/json. A stream of values is
+	// encoded as concatenated JSON objects.
+	JSONCodec Codec = jsonCodec{}
+	// ProtoCodec encodes values using protocol buffers. A stream of values is
+	// encoded as varint-delimited protocol buffers. When used as the codec of a
+	// hive, the data of messages that do not implement proto.Message is encoded
+	// using gob.
+	ProtoCodec Codec = protoCodec{}
+)
+
+// ErrUnknownMsgType is returned when a message of a type that is not
+// registered in the hive is decoded.
+var ErrUnknownMsgType = errors.New("unknown message type")
+
+var codecs = struct {
+	sync.RWMutex
+	byName map[string]Codec
+	byType map[string]Codec // codecs of message data per message type.
+}{
+	byName: make(map[string]Codec),
+	byType: make(map[string]Codec),
+}
+
+// RegisterCodec registers a codec by its name.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byName[c.Name()] = c
+}
+
+// CodecByName returns the codec registered with the given name.
+func CodecByName(name string) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("no such codec %q", name)
+	}
+	return c, nil
+}
+
+// codecByContentType returns the codec of the given content type, and falls
+// back to gob if there is no such codec.
+func codecByContentType(ct string) Codec {
+	if t, _, err := mime.ParseMediaType(ct); err == nil {
+		ct = t
+	}
+
+	codecs.RLock()
+	defer codecs.RUnlock()
+	for _, c := range codecs.byName {
+		if c.ContentType() == ct {
+			return c
+		}
+	}
+	return GobCodec
+}
+
+// RegisterMsgCodec sets the codec used to encode the data of messages of the
+// same type as msgData, regardless of the codec of the hive. The message type
+// is registered as well.
+func RegisterMsgCodec(msgData interface{}, c Codec) {
+	registerMsgType(msgData)
+
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byType[MsgType(msgData)] = c
+}
+
+// msgCodec returns the codec of the data of messages of type t.
+func msgCodec(t string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byType[t]
+	return c, ok
+}
+
+var msgTypes = struct {
+	sync.RWMutex
+	types map[string]reflect.Type
+}{
+	types: make(map[string]reflect.Type),
+}
+
+// registerMsgType registers the type of msgData, so that messages can be
+// decoded by codecs that do not carry Go type information.
+func registerMsgType(msgData interface{}) {
+	msgTypes.Lock()
+	defer msgTypes.Unlock()
+	msgTypes.types[MsgType(msgData)] = reflect.TypeOf(msgData)
+}
+
+// newMsgData returns a pointer to a new value of the given version of message
+// type t, and the value that should be stored in the message after decoding.
+// Version 0 means the latest version.
+func newMsgData(t string, version int) (ptr interface{},
+	val func() interface{}, err error) {
+
+	if version == 0 {
+		version, _ = latestVersion(t)
+	}
+
+	var rt reflect.Type
+	var ok bool
+	if version != 0 {
+		rt, ok = versionedType(t, version)
+	} else {
+		msgTypes.RLock()
+		rt, ok = msgTypes.types[t]
+		msgTypes.RUnlock()
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("%v: %v", ErrUnknownMsgType, t)
+	}
+
+	if rt.Kind() == reflect.Ptr {
+		v := reflect.New(rt.Elem())
+		return v.Interface(), v.Interface, nil
+	}
+	v := reflect.New(rt)
+	return v.Interface(), v.Elem().Interface, nil
+}
+
+// wireMsg is the codec-neutral representation of a message. Data is encoded
+// using the codec named Codec, and when Codec is empty, using the same codec
+// as the wire message.
+type wireMsg struct {
+	ID      MsgID             `json:"id"`
+	Type    string            `json:"type"`
+	Version int               `json:"version,omitempty"`
+	Codec   string            `json:"codec,omitempty"`
+	Data    []byte            `json:"data"`
+	From    uint64            `json:"from,omitempty"`
+	To      uint64            `json:"to,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Topic   string            `json:"topic,omitempty"`
+}
+
+// msgEncoder encodes messages using a codec. Gob encodes messages as is, and
+// other codecs encode messages as wire messages.
+type msgEncoder struct {
+	codec Codec
+	enc   Encoder
+}
+
+func newMsgEncoder(c Codec, w io.Writer) msgEncoder {
+	return msgEncoder{codec: c, enc: c.NewEncoder(w)}
+}
+
+func (e msgEncoder) Encode(m msg) error {
+	if e.codec.Name() == GobCodec.Name() {
+		return e.enc.Encode(m)
+	}
+
+	w := wireMsg{
+		ID:      m.MsgID,
+		Type:    m.Type(),
+		From:    m.MsgFrom,
+		To:      m.MsgTo,
+		Headers: m.MsgHeaders,
+		Topic:   m.MsgTopic,
+	}
+	if v, ok := versionOf(m.MsgData); ok {
+		w.Version = v.version
+	}
+	dc := e.codec
+	if c, ok := msgCodec(w.Type); ok {
+		dc = c
+	} else if _, ok := m.MsgData.(proto.Message); !ok &&
+		dc.Name() == ProtoCodec.Name() {
+		// Data that is not a protocol buffer is encoded using gob.
+		dc = GobCodec
+	}
+	if dc.Name() != e.codec.Name() {
+		w.Codec = dc.Name()
+	}
+	var err error
+	if w.Data, err = dc.Marshal(m.MsgData); err != nil {
+		return err
+	}
+	return e.enc.Encode(&w)
+}
+
+// msgDecoder decodes the messages encoded by msgEncoder.
+type msgDecoder struct {
+	codec Codec
+	dec   Decoder
+}
+
+func newMsgDecoder(c Codec, r io.Reader) msgDecoder {
+	return msgDecoder{codec: c, dec: c.NewDecoder(r)}
+}
+
+func (d msgDecoder) Decode(m *msg) error {
+	if d.codec.Name() == GobCodec.Name() {
+		if err := d.dec.Decode(m); err != nil {
+			return err
+		}
+		return upcastMsg(m)
+	}
+
+	var w wireMsg
+	if err := d.dec.Decode(&w); err != nil {
+		return err
+	}
+	dc := d.codec
+	if w.Codec != "" {
+		var err error
+		if dc, err = CodecByName(w.Codec); err != nil {
+			return err
+		}
+	}
+	ptr, val, err := newMsgData(w.Type, w.Version)
+	if err != nil {
+		return err
+	}
+	if err := dc.Unmarshal(w.Data, ptr); err != nil {
+		return err
+	}
+	*m = msg{
+		MsgID:      w.ID,
+		MsgData:    val(),
+		MsgFrom:    w.From,
+		MsgTo:      w.To,
+		MsgHeaders: w.Headers,
+		MsgTopic:   w.Topic,
+	}
+	return upcastMsg(m)
+}
+
+// valueCodec returns the codec that encodes the commands, the transactions and
+// the snapshots of a hive whose codec is c. They are not protocol buffers, and
+// are encoded using gob when c is ProtoCodec.
+func valueCodec(c Codec) Codec {
+	if c.Name() == ProtoCodec.Name() {
+		return GobCodec
+	}
+	return c
+}
+
+// stateCodec returns the codec of the state snapshots of a hive whose codec is
+// c, or nil if the snapshots are encoded using gob.
+func stateCodec(c Codec) state.Codec {
+	if c = valueCodec(c); c.Name() == GobCodec.Name() {
+		return nil
+	}
+	return c
+}
+
+var valueTypes = struct {
+	sync.RWMutex
+	types map[string]reflect.Type
+}{
+	types: make(map[string]reflect.Type),
+}
+
+// registerValueType registers the type of v, so that the commands and the
+// command results of that type are encoded by codecs other than gob. Values
+// of other types are encoded using gob.
+func registerValueType(v interface{}) {
+	valueTypes.Lock()
+	defer valueTypes.Unlock()
+	valueTypes.types[reflect.TypeOf(v).String()] = reflect.TypeOf(v)
+}
+
+// wireValue is the codec-neutral representation of the data of commands and
+// command results. Data is encoded using the codec of the stream if the type
+// of the value is registered, and using gob otherwise. Gob values are wrapped
+// in gobValue to keep their Go type.
+type wireValue struct {
+	Type  string `json:"type,omitempty"`
+	Codec string `json:"codec,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+type gobValue struct {
+	V interface{}
+}
+
+func newWireValue(c Codec, v interface{}) (wireValue, error) {
+	if v == nil {
+		return wireValue{}, nil
+	}
+
+	t := reflect.TypeOf(v).String()
+	valueTypes.RLock()
+	_, ok := valueTypes.types[t]
+	valueTypes.RUnlock()
+	if ok {
+		if b, err := c.Marshal(v); err == nil {
+			return wireValue{Type: t, Data: b}, nil
+		}
+	}
+
+	b, err := GobCodec.Marshal(&gobValue{V: v})
+	if err != nil {
+		return wireValue{}, err
+	}
+	return wireValue{Codec: GobCodec.Name(), Data: b}, nil
+}
+
+func (w wireValue) value(c Codec) (interface{}, error) {
+	if w.Codec == GobCodec.Name() {
+		var g gobValue
+		if err := GobCodec.Unmarshal(w.Data, &g); err != nil {
+			return nil, err
+		}
+		return g.V, nil
+	}
+	if w.Type == "" {
+		return nil, nil
+	}
+
+	valueTypes.RLock()
+	rt, ok := valueTypes.types[w.Type]
+	valueTypes.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown value type %v", w.Type)
+	}
+	v := reflect.New(rt)
+	if err := c.Unmarshal(w.Data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// wireCmd is the codec-neutral representation of a command.
+type wireCmd struct {
+	To   uint64    `json:"to,omitempty"`
+	App  string    `json:"app,omitempty"`
+	Data wireValue `json:"data"`
+}
+
+// wireCmdResult is the codec-neutral representation of a command result.
+type wireCmdResult struct {
+	Data wireValue `json:"data"`
+	Err  string    `json:"err,omitempty"`
+}
+
+// cmdEncoder encodes commands and their results using a codec. Gob encodes
+// them as is, and other codecs encode them as wire commands and results.
+type cmdEncoder struct {
+	codec Codec
+	enc   Encoder
+}
+
+func newCmdEncoder(c Codec, w io.Writer) cmdEncoder {
+	return cmdEncoder{codec: c, enc: c.NewEncoder(w)}
+}
+
+func (e cmdEncoder) Encode(c cmd) error {
+	if e.codec.Name() == GobCodec.Name() {
+		return e.enc.Encode(c)
+	}
+
+	d, err := newWireValue(e.codec, c.Data)
+	if err != nil {
+		return err
+	}
+	return e.enc.Encode(&wireCmd{To: c.To, App: c.App, Data: d})
+}
+
+func (e cmdEncoder) EncodeResult(r cmdResult) error {
+	if e.codec.Name() == GobCodec.Name() {
+		return e.enc.Encode(r)
+	}
+
+	d, err := newWireValue(e.codec, r.Data)
+	if err != nil {
+		return err
+	}
+	w := wireCmdResult{Data: d}
+	if r.Err != nil {
+		w.Err = r.Err.Error()
+	}
+	return e.enc.Encode(&w)
+}
+
+// cmdDecoder decodes the commands and the results encoded by cmdEncoder.
+type cmdDecoder struct {
+	codec Codec
+	dec   Decoder
+}
+
+func newCmdDecoder(c Codec, r io.Reader) cmdDecoder {
+	return cmdDecoder{codec: c, dec: c.NewDecoder(r)}
+}
+
+func (d cmdDecoder) Decode(c *cmd) error {
+	if d.codec.Name() == GobCodec.Name() {
+		return d.dec.Decode(c)
+	}
+
+	var w wireCmd
+	if err := d.dec.Decode(&w); err != nil {
+		return err
+	}
+	v, err := w.Data.value(d.codec)
+	if err != nil {
+		return err
+	}
+	*c = cmd{To: w.To, App: w.App, Data: v}
+	return nil
+}
+
+func (d cmdDecoder) DecodeResult(r *cmdResult) error {
+	if d.codec.Name() == GobCodec.Name() {
+		return d.dec.Decode(r)
+	}
+
+	var w wireCmdResult
+	if err := d.dec.Decode(&w); err != nil {
+		return err
+	}
+	v, err := w.Data.value(d.codec)
+	if err != nil {
+		return err
+	}
+	*r = cmdResult{Data: v}
+	if w.Err != "" {
+		r.Err = bhgob.Error(w.Err)
+	}
+	return nil
+}
+
+type gobCodec struct{}
+
+func (c gobCodec) Name() string        { return "gob" }
+func (c gobCodec) ContentType() string { return "application/x-gob" }
+
+func (c gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(b)).Decode(v)
+}
+
+func (c gobCodec) NewEncoder(w io.Writer) Encoder { return gob.NewEncoder(w) }
+func (c gobCodec) NewDecoder(r io.Reader) Decoder { return gob.NewDecoder(r) }
+
+type jsonCodec struct{}
+
+func (c jsonCodec) Name() string        { return "json" }
+func (c jsonCodec) ContentType() string { return "application/json" }
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+func (c jsonCodec) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+func (c jsonCodec) NewDecoder(r io.Reader) Decoder { return json.NewDecoder(r) }
+
+// jsonWireMsg is the JSON representation of wireMsg. When data is encoded in
+// JSON, it is embedded in the wire message instead of being a base64 string.
+type jsonWireMsg struct {
+	ID      MsgID             `json:"id"`
+	Type    string            `json:"type"`
+	Version int               `json:"version,omitempty"`
+	Codec   string            `json:"codec,omitempty"`
+	Data    json.RawMessage   `json:"data"`
+	From    uint64            `json:"from,omitempty"`
+	To      uint64            `json:"to,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Topic   string            `json:"topic,omitempty"`
+}
+
+func (w wireMsg) MarshalJSON() ([]byte, error) {
+	jw := jsonWireMsg{
+		ID:      w.ID,
+		Type:    w.Type,
+		Version: w.Version,
+		Codec:   w.Codec,
+		Data:    w.Data,
+		From:    w.From,
+		To:      w.To,
+		Headers: w.Headers,
+		Topic:   w.Topic,
+	}
+	if w.Codec != "" && w.Codec != JSONCodec.Name() {
+		var err error
+		if jw.Data, err = json.Marshal(w.Data); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(jw)
+}
+
+func (w *wireMsg) UnmarshalJSON(b []byte) error {
+	var jw jsonWireMsg
+	if err := json.Unmarshal(b, &jw); err != nil {
+		return err
+	}
+	*w = wireMsg{
+		ID:      jw.ID,
+		Type:    jw.Type,
+		Version: jw.Version,
+		Codec:   jw.Codec,
+		Data:    []byte(jw.Data),
+		From:    jw.From,
+		To:      jw.To,
+		Headers: jw.Headers,
+		Topic:   jw.Topic,
+	}
+	if w.Codec != "" && w.Codec != JSONCodec.Name() {
+		var s string
+		if err := json.Unmarshal(jw.Data, &s); err != nil {
+			return err
+		}
+		var err error
+		if w.Data, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type protoCodec struct{}
+
+func (c protoCodec) Name() string        { return "proto" }
+func (c protoCodec) ContentType() string { return "application/x-protobuf" }
+
+func (c protoCodec) Marshal(v interface{}) ([]byte, error) {
+	if w, ok := v.(*wireMsg); ok {
+		v = newProtoWireMsg(w)
+	}
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protocol buffer", v)
+	}
+	return proto.Marshal(pb)
+}
+
+func (c protoCodec) Unmarshal(b []byte, v interface{}) error {
+	if w, ok := v.(*wireMsg); ok {
+		var pw protoWireMsg
+		if err := proto.Unmarshal(b, &pw); err != nil {
+			return err
+		}
+		*w = pw.wireMsg()
+		return nil
+	}
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a protocol buffer", v)
+	}
+	return proto.Unmarshal(b, pb)
+}
+
+func (c protoCodec) NewEncoder(w io.Writer) Encoder {
+	return &delimitedEncoder{w: w, marshal: c.Marshal}
+}
+
+func (c protoCodec) NewDecoder(r io.Reader) Decoder {
+	return &delimitedDecoder{r: bufio.NewReader(r), unmarshal: c.Unmarshal}
+}
+
+// delimitedEncoder encodes a stream of values, each prefixed by its length
+// as a uvarint.
+type delimitedEncoder struct {
+	w       io.Writer
+	marshal func(v interface{}) ([]byte, error)
+}
+
+func (e *delimitedEncoder) Encode(v interface{}) error {
+	b, err := e.marshal(v)
+	if err != nil {
+		return err
+	}
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(b)))
+	if _, err := e.w.Write(l[:n]); err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
+
+// delimitedDecoder decodes the values encoded by delimitedEncoder.
+type delimitedDecoder struct {
+	r         *bufio.Reader
+	unmarshal func(b []byte, v interface{}) error
+}
+
+func (d *delimitedDecoder) Decode(v interface{}) error {
+	l, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return d.unmarshal(b, v)
+}
+
+// protoWireMsg is the protocol buffer representation of wireMsg:
+//
+//	message WireMsg {
+//	  optional uint64 id_hive = 1;
+//	  optional uint64 id_seq = 2;
+//	  optional string type = 3;
+//	  optional string codec = 4;
+//	  optional bytes data = 5;
+//	  optional uint64 from = 6;
+//	  optional uint64 to = 7;
+//	  repeated Header headers = 8;
+//	  optional int64 version = 9;
+//	  optional string topic = 10;
+//	}
+//
+//	message Header {
+//	  optional string key = 1;
+//	  optional string value = 2;
+//	}
+type protoWireMsg struct {
+	IDHive  *uint64        `protobuf:"varint,1,opt,name=id_hive"`
+	IDSeq   *uint64        `protobuf:"varint,2,opt,name=id_seq"`
+	Type    *string        `protobuf:"bytes,3,opt,name=type"`
+	Codec   *string        `protobuf:"bytes,4,opt,name=codec"`
+	Data    []byte         `protobuf:"bytes,5,opt,name=data"`
+	From    *uint64        `protobuf:"varint,6,opt,name=from"`
+	To      *uint64        `protobuf:"varint,7,opt,name=to"`
+	Headers []*protoHeader `protobuf:"bytes,8,rep,name=headers"`
+	Version *int64         `protobuf:"varint,9,opt,name=version"`
+	Topic   *string        `protobuf:"bytes,10,opt,name=topic"`
+}
+
+func (m *protoWireMsg) Reset()         { *m = protoWireMsg{} }
+func (m *protoWireMsg) String() string { return proto.CompactTextString(m) }
+func (*protoWireMsg) ProtoMessage()    {}
+
+type protoHeader struct {
+	Key   *string `protobuf:"bytes,1,opt,name=key"`
+	Value *string `protobuf:"bytes,2,opt,name=value"`
+}
+
+func (m *protoHeader) Reset()         { *m = protoHeader{} }
+func (m *protoHeader) String() string { return proto.CompactTextString(m) }
+func (*protoHeader) ProtoMessage()    {}
+
+func newProtoWireMsg(w *wireMsg) *protoWireMsg {
+	pw := &protoWireMsg{
+		IDHive: proto.Uint64(w.ID.Hive),
+		IDSeq:  proto.Uint64(w.ID.Seq),
+		Type:   proto.String(w.Type),
+		Data:   w.Data,
+		From:   proto.Uint64(w.From),
+		To:     proto.Uint64(w.To),
+	}
+	if w.Codec != "" {
+		pw.Codec = proto.String(w.Codec)
+	}
+	if w.Version != 0 {
+		pw.Version = proto.Int64(int64(w.Version))
+	}
+	if w.Topic != "" {
+		pw.Topic = proto.String(w.Topic)
+	}
+	for k, v := range w.Headers {
+		pw.Headers = append(pw.Headers, &protoHeader{
+			Key:   proto.String(k),
+			Value: proto.String(v),
+		})
+	}
+	return pw
+}
+
+func (m *protoWireMsg) wireMsg() wireMsg {
+	w := wireMsg{
+		ID:      MsgID{Hive: m.GetIDHive(), Seq: m.GetIDSeq()},
+		Type:    m.GetType(),
+		Version: int(m.GetVersion()),
+		Topic:   m.GetTopic(),
+		Codec:   m.GetCodec(),
+		Data:    m.Data,
+		From:    m.GetFrom(),
+		To:      m.GetTo(),
+	}
+	if len(m.Headers) != 0 {
+		w.Headers = make(map[string]string)
+		for _, h := range m.Headers {
+			w.Headers[h.GetKey()] = h.GetValue()
+		}
+	}
+	return w
+}
+
+func (m *protoWireMsg) GetIDHive() uint64 {
+	if m.IDHive != nil {
+		return *m.IDHive
+	}
+	return 0
+}
+
+func (m *protoWireMsg) GetIDSeq() uint64 {
+	if m.IDSeq != nil {
+		return *m.IDSeq
+	}
+	return 0
+}
+
+func (m *protoWireMsg) GetType() string {
+	if m.Type != nil {
+		return *m.Type
+	}
+	return ""
+}
+
+func (m *protoWireMsg) GetVersion() int64 {
+	if m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *protoWireMsg) GetTopic() string {
+	if m.Topic != nil {
+		return *m.Topic
+	}
+	return ""
+}
+
+func (m *protoWireMsg) GetCodec() string {
+	if m.Codec != nil {
+		return *m.Codec
+	}
+	return ""
+}
+
+func (m *protoWireMsg) GetFrom() uint64 {
+	if m.From != nil {
+		return *m.From
+	}
+	return 0
+}
+
+func (m *protoWireMsg) GetTo() uint64 {
+	if m.To != nil {
+		return *m.To
+	}
+	return 0
+}
+
+func (m *protoHeader) GetKey() string {
+	if m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *protoHeader) GetValue() string {
+	if m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
+func init() {
+	RegisterCodec(GobCodec)
+	RegisterCodec(JSONCodec)
+	RegisterCodec(ProtoCodec)
+}
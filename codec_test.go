@@ -0,0 +1,191 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/code.google.com/p/gogoprotobuf/proto"
+	bhgob "github.com/kandoo/beehive/gob"
+)
+
+type codecTestMsg struct {
+	Text string
+	N    int
+}
+
+type protoTestMsg struct {
+	Text *string `protobuf:"bytes,1,opt,name=text"`
+}
+
+func (m *protoTestMsg) Reset()         { *m = protoTestMsg{} }
+func (m *protoTestMsg) String() string { return proto.CompactTextString(m) }
+func (*protoTestMsg) ProtoMessage()    {}
+
+func TestCodecs(t *testing.T) {
+	registerMsgType(codecTestMsg{})
+	RegisterMsgCodec(&protoTestMsg{}, ProtoCodec)
+
+	msgs := []msg{
+		{
+			MsgID:      MsgID{Hive: 1, Seq: 2},
+			MsgData:    codecTestMsg{Text: "test", N: 1},
+			MsgFrom:    3,
+			MsgHeaders: map[string]string{"trace": "t1"},
+			MsgTopic:   "test.topic",
+		},
+		{
+			MsgData: &protoTestMsg{Text: proto.String("proto")},
+			MsgTo:   4,
+		},
+	}
+	for _, c := range []Codec{JSONCodec, ProtoCodec} {
+		var buf bytes.Buffer
+		enc := newMsgEncoder(c, &buf)
+		dec := newMsgDecoder(c, &buf)
+		for _, m := range msgs {
+			if err := enc.Encode(m); err != nil {
+				t.Fatalf("%v cannot encode %v: %v", c.Name(), m, err)
+			}
+			var d msg
+			if err := dec.Decode(&d); err != nil {
+				t.Fatalf("%v cannot decode %v: %v", c.Name(), m, err)
+			}
+			if !reflect.DeepEqual(d, m) {
+				t.Errorf("invalid %v decoded message: actual=%#v want=%#v", c.Name(),
+					d, m)
+			}
+		}
+	}
+}
+
+func TestCodecUnknownMsgType(t *testing.T) {
+	b := []byte(`{"type":"beehive.noSuchMsg","data":{}}`)
+	var m msg
+	err := newMsgDecoder(JSONCodec, bytes.NewBuffer(b)).Decode(&m)
+	if err == nil {
+		t.Error("message of an unknown type is decoded")
+	}
+}
+
+func TestCodecHTTPJSON(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_codec"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	ch := make(chan codecTestMsg, 1)
+	app := h.NewApp("codec")
+	app.HandleFunc(codecTestMsg{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- msg.Data().(codecTestMsg)
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	url := buildURL("http", cfg.Addr, serverV1MsgPath)
+	body := fmt.Sprintf(`{"type":%q,"data":{"Text":"json","N":2}}`,
+		MsgType(codecTestMsg{}))
+	res, err := http.Post(url, JSONCodec.ContentType(),
+		bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("cannot post message: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code: %v", res.StatusCode)
+	}
+
+	select {
+	case m := <-ch:
+		if m.Text != "json" || m.N != 2 {
+			t.Errorf("invalid message: %#v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received")
+	}
+}
+
+func TestCmdCodecs(t *testing.T) {
+	cmds := []cmd{
+		{To: 1, App: "app", Data: cmdMigrate{Bee: 1, To: 2}},
+		{Data: cmdNewHiveID{Addr: "addr"}},
+		// Types that are not registered are encoded using gob.
+		{Data: newBeeID{}},
+		{},
+	}
+	results := []cmdResult{
+		{Data: Colony{Leader: 1, Followers: []uint64{2}}},
+		{Data: uint64(3)},
+		{Err: bhgob.Error("error")},
+		{},
+	}
+	for _, c := range []Codec{GobCodec, JSONCodec} {
+		var buf bytes.Buffer
+		enc := newCmdEncoder(c, &buf)
+		dec := newCmdDecoder(c, &buf)
+		for _, cc := range cmds {
+			if err := enc.Encode(cc); err != nil {
+				t.Fatalf("%v cannot encode %v: %v", c.Name(), cc, err)
+			}
+			var d cmd
+			if err := dec.Decode(&d); err != nil {
+				t.Fatalf("%v cannot decode %v: %v", c.Name(), cc, err)
+			}
+			if !reflect.DeepEqual(d, cc) {
+				t.Errorf("invalid %v decoded command: actual=%#v want=%#v", c.Name(),
+					d, cc)
+			}
+		}
+		for _, r := range results {
+			if err := enc.EncodeResult(r); err != nil {
+				t.Fatalf("%v cannot encode %v: %v", c.Name(), r, err)
+			}
+			var d cmdResult
+			if err := dec.DecodeResult(&d); err != nil {
+				t.Fatalf("%v cannot decode %v: %v", c.Name(), r, err)
+			}
+			if !reflect.DeepEqual(d, r) {
+				t.Errorf("invalid %v decoded result: actual=%#v want=%#v", c.Name(),
+					d, r)
+			}
+		}
+	}
+}
+
+func TestCommitTxCodec(t *testing.T) {
+	registerMsgType(codecTestMsg{})
+	gob.Register(codecTestMsg{})
+
+	msgs := []*msg{
+		{MsgID: MsgID{Hive: 1, Seq: 2}, MsgData: codecTestMsg{Text: "a", N: 1}},
+		{MsgData: codecTestMsg{Text: "b", N: 2}, MsgFrom: 3},
+	}
+	for _, c := range []Codec{GobCodec, JSONCodec, ProtoCodec} {
+		ct, err := newCommitTx(tx{Msgs: msgs}, c)
+		if err != nil {
+			t.Fatalf("%v cannot encode the transaction: %v", c.Name(), err)
+		}
+		if c == GobCodec && ct.MsgCodec != "" {
+			t.Errorf("gob transactions have a codec: %v", ct.MsgCodec)
+		}
+		d, err := ct.msgs()
+		if err != nil {
+			t.Fatalf("%v cannot decode the messages: %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(d, msgs) {
+			t.Errorf("invalid %v decoded messages: actual=%#v want=%#v", c.Name(),
+				d, msgs)
+		}
+	}
+}
@@ -131,4 +131,5 @@ func ColonyFromBytes(b []byte) (Colony, error) {
 
 func init() {
 	gob.Register(Colony{})
+	registerValueType(Colony{})
 }
@@ -40,9 +40,33 @@ type RcvContext interface {
 	SendToCell(msgData interface{}, app string, cell CellKey)
 	// SendToBee sends a message to the given bee.
 	SendToBee(msgData interface{}, to uint64)
+	// Publish emits a message on the given topic. See App.HandleTopic.
+	Publish(topic string, msgData interface{})
+	// EmitAfter emits a message after at least duration d. The message is
+	// stored in the state of the bee, and is part of the current transaction.
+	// For persistent applications, scheduled messages survive bee migrations
+	// and failovers.
+	EmitAfter(d time.Duration, msgData interface{})
+	// SendToCellAt sends a message to the bee of the given app that owns the
+	// given cell at time t. Similar to EmitAfter, the message is durably stored
+	// in the state of the bee.
+	SendToCellAt(t time.Time, msgData interface{}, app string, cell CellKey)
+
+	// SetTimer registers (or replaces) a persistent timer, named name, that
+	// sends a message containing msgData to the bee of this app that owns cell
+	// according to the cron expression spec (e.g., "*/5 * * * *", "@hourly" or
+	// "@every 30s"). Timers are stored in the state of the bee, and are
+	// restored after migrations and failovers.
+	SetTimer(name string, spec string, msgData interface{}, cell CellKey) error
+	// DelTimer removes the timer registered with the given name.
+	DelTimer(name string) error
 	// ReplyTo replies to a message: Sends a message from the current bee to the
 	// bee that emitted msg.
 	ReplyTo(msg Msg, replyData interface{}) error
+	// SetHeader sets a header on all messages emitted in the rest of this Rcv
+	// call. Headers of the received message are copied to emitted messages by
+	// default.
+	SetHeader(key, value string)
 
 	// StartDetached spawns a detached handler.
 	StartDetached(h DetachedHandler) uint64
@@ -53,7 +77,8 @@ type RcvContext interface {
 	LockCells(keys []CellKey) error
 
 	// Snooze exits the Rcv function, and schedules the current message to be
-	// enqued again after at least duration d.
+	// enqued again after at least duration d. Snoozes are not counted as retries
+	// by the retry policy of the application.
 	Snooze(d time.Duration)
 
 	// BeeLocal returns the bee-local storage. It is an ephemeral memory that is
@@ -76,4 +101,15 @@ type RcvContext interface {
 	CommitTx() error
 	// Aborts the transaction.
 	AbortTx() error
+	// Savepoint marks the current point of the open transaction. It can be used
+	// to undo a part of the transaction, such as the side effects of a composed
+	// handler, without aborting the whole transaction.
+	Savepoint() (state.Savepoint, error)
+	// RollbackTo discards the state operations and the messages of the
+	// transaction after the savepoint. The savepoint remains valid, while the
+	// savepoints created after it are released.
+	RollbackTo(sp state.Savepoint) error
+	// ReleaseSavepoint releases the savepoint and the savepoints created after
+	// it. The operations of the transaction are kept.
+	ReleaseSavepoint(sp state.Savepoint) error
 }
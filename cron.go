@@ -0,0 +1,180 @@
+package beehive
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule returns the next activation time of a timer.
+type cronSchedule interface {
+	// next returns the first activation time after t, or a zero time if there
+	// is no such time.
+	next(t time.Time) time.Time
+}
+
+// parseCron parses a cron expression. Supported expressions are:
+//
+//   - Standard cron expressions with five fields: minute, hour, day of month,
+//     month and day of week. Each field can be "*", a number, a range (e.g.,
+//     "1-5"), a list (e.g., "1,3,5") and can have a step (e.g., "*/15").
+//   - Descriptors: @yearly (or @annually), @monthly, @weekly, @daily (or
+//     @midnight), and @hourly.
+//   - Fixed intervals: "@every <duration>", where duration is parsed by
+//     time.ParseDuration (e.g., "@every 30s").
+func parseCron(spec string) (cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron interval %q: %v", spec, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid cron interval %q", spec)
+		}
+		return everySchedule(d), nil
+	}
+
+	if strings.HasPrefix(spec, "@") {
+		d, ok := cronDescriptors[spec]
+		if !ok {
+			return nil, fmt.Errorf("invalid cron descriptor %q", spec)
+		}
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFieldBounds) {
+		return nil, fmt.Errorf("cron expression %q must have %d fields", spec,
+			len(cronFieldBounds))
+	}
+
+	var s cronSpec
+	bits := []*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFieldBounds[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", spec, err)
+		}
+		*bits[i] = b
+	}
+	// Sunday can be either 0 or 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.anyDom = fields[2] == "*"
+	s.anyDow = fields[4] == "*"
+	return s, nil
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronFieldBounds are the minimum and maximum values of the fields in a cron
+// expression.
+var cronFieldBounds = [][2]int{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week
+}
+
+func parseCronField(f string, bounds [2]int) (uint64, error) {
+	var bits uint64
+	for _, r := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(r, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(r[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", r)
+			}
+			r = r[:i]
+		}
+
+		lo, hi := bounds[0], bounds[1]
+		if r != "*" {
+			var err error
+			rng := strings.SplitN(r, "-", 2)
+			if lo, err = strconv.Atoi(rng[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", rng[0])
+			}
+			hi = lo
+			if len(rng) == 2 {
+				if hi, err = strconv.Atoi(rng[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", rng[1])
+				}
+			} else if step != 1 {
+				hi = bounds[1]
+			}
+		}
+
+		if lo < bounds[0] || hi > bounds[1] || lo > hi {
+			return 0, fmt.Errorf("%q is out of range [%d, %d]", r, bounds[0],
+				bounds[1])
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// everySchedule activates a timer in fixed intervals.
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSpec is a parsed cron expression. Each field is a bitset of the values
+// that match.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// cronMaxYears bounds the search for the next activation time of
+// expressions that never match (e.g., "0 0 30 2 *").
+const cronMaxYears = 5
+
+func (s cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + cronMaxYears
+	for t.Year() <= limit {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchDay returns whether the day of t matches the spec. Similar to the
+// standard cron, if both the day of month and the day of week are restricted,
+// the day matches if either of them matches.
+func (s cronSpec) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDom || s.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
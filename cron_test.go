@@ -0,0 +1,97 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	now := time.Date(2015, time.March, 14, 9, 26, 53, 0, time.UTC)
+	cases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2015, time.March, 14, 9, 27, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, time.March, 14, 9, 30, 0, 0, time.UTC)},
+		{"0 12 * * *", time.Date(2015, time.March, 14, 12, 0, 0, 0, time.UTC)},
+		{"5,10 8-9 * * *", time.Date(2015, time.March, 15, 8, 5, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2015, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1", time.Date(2015, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2015, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 1", time.Date(2015, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2015, time.March, 14, 10, 0, 0, 0, time.UTC)},
+		{"@every 30s", now.Add(30 * time.Second)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		s, err := parseCron(c.spec)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", c.spec, err)
+			continue
+		}
+		if n := s.next(now); !n.Equal(c.next) {
+			t.Errorf("invalid next time for %q: actual=%v want=%v", c.spec, n,
+				c.next)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *",
+		"5-1 * * * *", "a * * * *", "@weekday", "@every", "@every -1s",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("invalid cron expression %q is parsed", spec)
+		}
+	}
+}
+
+type cronTestMsg struct{}
+
+func runTimerTest(t *testing.T, statePath string, options ...AppOption) {
+	cfg := DefaultCfg
+	cfg.StatePath = statePath
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	ch := make(chan CellKey)
+	app := h.NewApp("timer", options...)
+	app.HandleFunc(MyMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			return ctx.SetTimer("remind", "@every 100ms", cronTestMsg{},
+				CellKey{"D", "1"})
+		})
+	app.HandleFunc(cronTestMsg{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "1"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- CellKey{"D", "1"}
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(MyMsg(1))
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timer is fired only %d times", i)
+		}
+	}
+}
+
+func TestSetTimer(t *testing.T) {
+	runTimerTest(t, "/tmp/bhtest_timer")
+}
+
+func TestSetTimerWithDedup(t *testing.T) {
+	runTimerTest(t, "/tmp/bhtest_timer_dedup", AppWithDedup(16))
+}
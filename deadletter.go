@@ -0,0 +1,132 @@
+package beehive
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoSuchDeadLetter is returned when a dead letter cannot be found.
+var ErrNoSuchDeadLetter = errors.New("no such dead letter")
+
+// DeadLetter is a message whose Rcv returned an error or panicked.
+type DeadLetter struct {
+	ID      uint64    `json:"id"`
+	App     string    `json:"app"`
+	Bee     uint64    `json:"bee"`
+	Handler string    `json:"handler"`
+	Msg     Msg       `json:"msg"`
+	Err     string    `json:"err"`
+	Stack   string    `json:"stack,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func (d DeadLetter) String() string {
+	return fmt.Sprintf("dead letter %v of %v (bee=%v, handler=%v): %v", d.ID,
+		d.App, d.Bee, d.Handler, d.Err)
+}
+
+// DeadLetters stores the messages of an application that could not be
+// processed by their handlers.
+type DeadLetters interface {
+	// List returns all the dead letters, oldest first.
+	List() []DeadLetter
+	// Replay removes the dead letter with the given ID and enqueues its message
+	// on the application again.
+	Replay(id uint64) error
+	// Purge removes the dead letter with the given ID.
+	Purge(id uint64) error
+	// PurgeAll removes all the dead letters.
+	PurgeAll()
+}
+
+// deadLetters is a bounded, in-memory dead-letter queue. When the queue is
+// full, the oldest dead letter is dropped.
+type deadLetters struct {
+	sync.Mutex
+
+	app     *app
+	maxSize int
+	nextID  uint64
+	letters []DeadLetter
+}
+
+func newDeadLetters(a *app, maxSize int) *deadLetters {
+	return &deadLetters{
+		app:     a,
+		maxSize: maxSize,
+	}
+}
+
+func (q *deadLetters) add(d DeadLetter) uint64 {
+	q.Lock()
+	defer q.Unlock()
+
+	q.nextID++
+	d.ID = q.nextID
+	if q.maxSize > 0 && len(q.letters) >= q.maxSize {
+		q.letters[0] = DeadLetter{}
+		q.letters = q.letters[1:]
+	}
+	q.letters = append(q.letters, d)
+	return d.ID
+}
+
+func (q *deadLetters) List() []DeadLetter {
+	q.Lock()
+	defer q.Unlock()
+
+	l := make([]DeadLetter, len(q.letters))
+	copy(l, q.letters)
+	return l
+}
+
+func (q *deadLetters) remove(id uint64) (DeadLetter, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for i := range q.letters {
+		if q.letters[i].ID == id {
+			d := q.letters[i]
+			q.letters = append(q.letters[:i], q.letters[i+1:]...)
+			return d, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+func (q *deadLetters) Replay(id uint64) error {
+	d, ok := q.remove(id)
+	if !ok {
+		return ErrNoSuchDeadLetter
+	}
+
+	m, ok := d.Msg.(*msg)
+	if !ok {
+		m = &msg{
+			MsgID:      d.Msg.ID(),
+			MsgData:    d.Msg.Data(),
+			MsgFrom:    d.Msg.From(),
+			MsgTo:      d.Msg.To(),
+			MsgHeaders: d.Msg.Headers(),
+			MsgTopic:   d.Msg.Topic(),
+		}
+	}
+	q.app.qee.enqueMsg(msgAndHandler{msg: m, handler: q.app.handler(m.Type())})
+	return nil
+}
+
+func (q *deadLetters) Purge(id uint64) error {
+	if _, ok := q.remove(id); !ok {
+		return ErrNoSuchDeadLetter
+	}
+	return nil
+}
+
+func (q *deadLetters) PurgeAll() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.letters = nil
+}
@@ -0,0 +1,80 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadLettersBounded(t *testing.T) {
+	dlq := newDeadLetters(nil, 2)
+	for i := 0; i < 3; i++ {
+		dlq.add(DeadLetter{Msg: &msg{MsgData: i}})
+	}
+
+	l := dlq.List()
+	if len(l) != 2 {
+		t.Fatalf("invalid number of dead letters: actual=%v want=2", len(l))
+	}
+	if l[0].ID != 2 || l[1].ID != 3 {
+		t.Errorf("oldest dead letter is not dropped: %v", l)
+	}
+}
+
+func TestDeadLettersPurge(t *testing.T) {
+	dlq := newDeadLetters(nil, 0)
+	id1 := dlq.add(DeadLetter{})
+	id2 := dlq.add(DeadLetter{})
+
+	if err := dlq.Purge(id1); err != nil {
+		t.Errorf("cannot purge dead letter %v: %v", id1, err)
+	}
+	if err := dlq.Purge(id1); err != ErrNoSuchDeadLetter {
+		t.Errorf("purged a dead letter twice: %v", err)
+	}
+	if l := dlq.List(); len(l) != 1 || l[0].ID != id2 {
+		t.Errorf("invalid dead letters after purge: %v", l)
+	}
+
+	dlq.PurgeAll()
+	if l := dlq.List(); len(l) != 0 {
+		t.Errorf("dead letters are not purged: %v", l)
+	}
+}
+
+type deadLetterTestHandler struct{}
+
+func (h *deadLetterTestHandler) Rcv(m Msg, ctx RcvContext) error {
+	panic("poison message")
+}
+
+func (h *deadLetterTestHandler) Map(m Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func TestDeadLetterOnPanic(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_deadletter"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	app := h.NewApp("deadletter")
+	app.Handle(MyMsg(0), &deadLetterTestHandler{})
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(MyMsg(1))
+	for i := 0; i < 100; i++ {
+		if l := app.DeadLetters().List(); len(l) != 0 {
+			if l[0].Msg.Data() != MyMsg(1) {
+				t.Errorf("invalid dead letter: %v", l[0])
+			}
+			if l[0].Stack == "" {
+				t.Error("no stack trace for a panic")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("no dead letter is stored for the failed message")
+}
@@ -0,0 +1,77 @@
+package beehive
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/kandoo/beehive/state"
+)
+
+// dedupDict is the dictionary that stores the IDs of recently processed
+// messages in a bee.
+const (
+	dedupDict    = "__dedup__"
+	dedupNextKey = "next"
+)
+
+// AppWithDedup is an application option that drops duplicate messages in
+// bees. Each bee keeps the IDs of the last window messages it has processed in
+// its state. For persistent applications, these IDs are replicated along with
+// the transactions of the bee, which results in effectively-once processing
+// even after failovers.
+func AppWithDedup(window int) AppOption {
+	return func(a *app) {
+		a.dedupWindow = window
+	}
+}
+
+func dedupSlotKey(slot uint64) string {
+	return fmt.Sprintf("s/%d", slot)
+}
+
+// isDuplicate returns whether m is already processed by the bee.
+func (b *bee) isDuplicate(m *msg) bool {
+	if b.app.dedupWindow <= 0 || m.MsgID.IsNil() {
+		return false
+	}
+
+	_, err := b.Dict(dedupDict).Get(m.MsgID.String())
+	return err == nil
+}
+
+// markProcessed records the ID of m in the dedup window of the bee. If the
+// window is full, the oldest ID is evicted.
+func (b *bee) markProcessed(m *msg) error {
+	if b.app.dedupWindow <= 0 || m.MsgID.IsNil() {
+		return nil
+	}
+
+	return addToDedupWindow(b.Dict(dedupDict), m.MsgID,
+		uint64(b.app.dedupWindow))
+}
+
+func addToDedupWindow(d state.Dict, id MsgID, window uint64) error {
+	var next uint64
+	if v, err := d.Get(dedupNextKey); err == nil {
+		next = binary.BigEndian.Uint64(v)
+	}
+
+	slot := dedupSlotKey(next % window)
+	if old, err := d.Get(slot); err == nil {
+		if err := d.Del(string(old)); err != nil {
+			return err
+		}
+	}
+
+	k := id.String()
+	if err := d.Put(slot, []byte(k)); err != nil {
+		return err
+	}
+	if err := d.Put(k, []byte{}); err != nil {
+		return err
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, next+1)
+	return d.Put(dedupNextKey, v)
+}
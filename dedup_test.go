@@ -0,0 +1,90 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/gen"
+	"github.com/kandoo/beehive/state"
+)
+
+func TestDedupWindowEviction(t *testing.T) {
+	d := state.NewInMem().Dict(dedupDict)
+	ids := []MsgID{{1, 1}, {1, 2}, {1, 3}}
+	for _, id := range ids {
+		if err := addToDedupWindow(d, id, 2); err != nil {
+			t.Fatalf("cannot add %v to the window: %v", id, err)
+		}
+	}
+
+	if _, err := d.Get(ids[0].String()); err == nil {
+		t.Errorf("%v is not evicted from the window", ids[0])
+	}
+	for _, id := range ids[1:] {
+		if _, err := d.Get(id.String()); err != nil {
+			t.Errorf("%v is not in the window", id)
+		}
+	}
+}
+
+type dedupTestHandler struct {
+	ch chan Msg
+}
+
+func (h *dedupTestHandler) Rcv(m Msg, ctx RcvContext) error {
+	h.ch <- m
+	return nil
+}
+
+func (h *dedupTestHandler) Map(m Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func TestAppWithDedup(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_dedup"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	app := h.NewApp("dedup", Transactional(), AppWithDedup(16))
+	rcvh := &dedupTestHandler{ch: make(chan Msg, 3)}
+	app.Handle(MyMsg(0), rcvh)
+	go h.Start()
+	defer h.Stop()
+
+	id := MsgID{Hive: 1, Seq: 1}
+	h.(*hive).enqueMsg(&msg{MsgID: id, MsgData: MyMsg(1)})
+	h.(*hive).enqueMsg(&msg{MsgID: id, MsgData: MyMsg(1)})
+	h.Emit(MyMsg(2))
+
+	for _, want := range []MyMsg{1, 2} {
+		select {
+		case m := <-rcvh.ch:
+			if m.Data() != want {
+				t.Errorf("invalid message: actual=%v want=%v", m.Data(), want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %v is not received", want)
+		}
+	}
+}
+
+func TestBeeMsgIDInTx(t *testing.T) {
+	b := bee{
+		beeID:   1,
+		hive:    &hive{id: 1, msgIDs: gen.NewSeqIDGen(1)},
+		app:     &app{name: "test", flags: appFlagTransactional},
+		stateL1: state.NewTransactional(state.NewInMem()),
+	}
+	if err := b.BeginTx(); err != nil {
+		t.Fatalf("cannot begin tx: %v", err)
+	}
+	b.Emit(MyMsg(1))
+	if len(b.msgBufL1) != 1 {
+		t.Fatalf("message is not buffered in the tx: %v", b.msgBufL1)
+	}
+	if b.msgBufL1[0].MsgID.IsNil() {
+		t.Errorf("buffered message has no ID")
+	}
+}
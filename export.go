@@ -0,0 +1,188 @@
+package beehive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/raft"
+	"github.com/kandoo/beehive/state"
+)
+
+// AppBees returns the IDs of the bees of app that have a state under statePath
+// in ascending order.
+func AppBees(statePath, app string) ([]uint64, error) {
+	fis, err := ioutil.ReadDir(path.Join(statePath, app))
+	if err != nil {
+		return nil, err
+	}
+	var bees []uint64
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(fi.Name(), 16, 64)
+		if err != nil {
+			continue
+		}
+		bees = append(bees, id)
+	}
+	return bees, nil
+}
+
+// LoadBeeState loads the state of bee of app persisted under statePath into
+// memory. The state of a persistent bee is restored from its latest raft
+// snapshot, and the transactions committed after the snapshot are applied to
+// it. The hive of the bee must be stopped.
+//
+// Only the state operations of transactions are decoded. However, the
+// transactions replicated by older versions of beehive store their messages
+// along with their operations, and the types of those messages must be
+// registered in gob to load them. Snapshots are decoded using JSON or gob,
+// which covers the hives using any of the codecs shipped with beehive.
+func LoadBeeState(statePath, app string, bee uint64) (state.State, error) {
+	dir := path.Join(statePath, app, fmt.Sprintf("%016X", bee))
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	// The codec of snapshots falls back to gob when JSON cannot decode them.
+	inm := state.NewInMem()
+	inm.SetCodec(JSONCodec)
+	s := state.NewIncremental(inm)
+	s.Codec = JSONCodec
+	if _, err := os.Stat(path.Join(dir, "wal")); os.IsNotExist(err) {
+		// Non-persistent bees only have a state if they are stored on disk.
+		sdir := path.Join(dir, "state")
+		if _, err := os.Stat(sdir); err != nil {
+			return nil, fmt.Errorf("bee %v has no persisted state: %v", bee, err)
+		}
+		d, err := state.NewOnDisk(sdir)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		b, err := d.Save()
+		if err != nil {
+			return nil, err
+		}
+		return s, s.Restore(b)
+	}
+
+	if err := raft.LoadStore(dir, offlineStore{state.NewTransactional(s)}); err !=
+		nil {
+
+		return nil, err
+	}
+	return s, nil
+}
+
+// ImportBeeState reads JSON lines of records from r, and imports them into the
+// state of bee of app persisted under statePath. It returns the number of
+// imported records. The hive of the bee must be stopped.
+//
+// For a persistent bee, the records are appended to its raft log as a
+// committed transaction, which is applied when its hive restarts. Since the
+// transaction is not replicated, only the bees that have no follower can be
+// imported offline. Use the HTTP API of a running hive for replicated bees.
+// Imported records do not update the secondary indexes of the app.
+func ImportBeeState(statePath, app string, bee uint64, r io.Reader) (int,
+	error) {
+
+	dir := path.Join(statePath, app, fmt.Sprintf("%016X", bee))
+	if _, err := os.Stat(dir); err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(path.Join(dir, "wal")); os.IsNotExist(err) {
+		sdir := path.Join(dir, "state")
+		if _, err := os.Stat(sdir); err != nil {
+			return 0, fmt.Errorf("bee %v has no persisted state: %v", bee, err)
+		}
+		d, err := state.NewOnDisk(sdir)
+		if err != nil {
+			return 0, err
+		}
+		defer d.Close()
+		return state.Import(r, d)
+	}
+
+	s := state.NewTransactional(state.NewInMem())
+	s.BeginTx()
+	n, err := state.Import(r, s)
+	if err != nil {
+		return 0, err
+	}
+	req := commitTx{Tx: state.Tx{Ops: s.TxOps()}}
+	if err := raft.AppendRequest(dir, req); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// offlineStore applies the committed transactions of a bee to its state
+// without running the bee.
+type offlineStore struct {
+	s *state.Transactional
+}
+
+func (s offlineStore) Save() ([]byte, error) {
+	return s.s.Save()
+}
+
+func (s offlineStore) Restore(b []byte) error {
+	return s.s.Restore(b)
+}
+
+func (s offlineStore) Apply(req interface{}) (interface{}, error) {
+	switch r := req.(type) {
+	case commitTx:
+		return nil, s.s.Apply(r.Ops)
+	case noOp:
+		return nil, nil
+	}
+	return nil, ErrUnsupportedRequest
+}
+
+func (s offlineStore) ApplyConfChange(cc raftpb.ConfChange,
+	n raft.NodeInfo) error {
+
+	return nil
+}
+
+// exportState returns the given dictionaries of the bee as JSON lines.
+func (b *bee) exportState(dicts []string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := state.Export(&buf, b.stateL1, dicts...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// importState puts the records in data in the state of the bee, in a
+// transaction, and returns the number of imported records.
+func (b *bee) importState(data []byte) (int, error) {
+	if !b.isLeader() {
+		return 0, fmt.Errorf("%v is not the leader", b)
+	}
+	if err := b.BeginTx(); err != nil {
+		return 0, err
+	}
+	n, err := state.Import(bytes.NewReader(data), b.stateL1)
+	if err != nil {
+		b.AbortTx()
+		return 0, err
+	}
+	if err := b.CommitTx(); err != nil && err != state.ErrNoTx {
+		return 0, err
+	}
+	// Imported keys may have TTLs.
+	b.armScheduler(time.Now())
+	return n, nil
+}
@@ -0,0 +1,124 @@
+package beehive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type exportTestPut string
+type exportTestGet string
+
+func registerExportApp(h Hive, ch chan uint64, vch chan string) {
+	app := h.NewApp("export", Persistent(1))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	app.HandleFunc(exportTestPut(""), mf, func(msg Msg, ctx RcvContext) error {
+		k := string(msg.Data().(exportTestPut))
+		ctx.Dict("D").Put(k, []byte(k))
+		ch <- ctx.ID()
+		return nil
+	})
+	app.HandleFunc(exportTestGet(""), mf, func(msg Msg, ctx RcvContext) error {
+		v, _ := ctx.Dict("D").Get(string(msg.Data().(exportTestGet)))
+		vch <- string(v)
+		return nil
+	})
+}
+
+func TestBeeStateExportImport(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_export"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+
+	ch := make(chan uint64, 1)
+	vch := make(chan string, 1)
+	h := NewHiveWithConfig(cfg)
+	registerExportApp(h, ch, vch)
+	go h.Start()
+	waitTilStareted(h)
+
+	h.Emit(exportTestPut("k1"))
+	bee := <-ch
+	h.Emit(exportTestPut("k2"))
+	<-ch
+
+	url := buildURL("http", cfg.Addr, serverV1StatePath+"/export/"+
+		strconv.FormatUint(bee, 10))
+	res, err := http.Get(url + "?dicts=D")
+	if err != nil {
+		t.Fatalf("cannot export state: %v", err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	want := `{"dict":"D","key":"k1","text":"k1"}
+{"dict":"D","key":"k2","text":"k2"}
+`
+	if string(b) != want {
+		t.Errorf("invalid export:\n%s\nwant:\n%s", b, want)
+	}
+
+	res, err = http.Post(url, "application/x-ndjson",
+		strings.NewReader(`{"dict":"D","key":"k3","text":"v3"}`))
+	if err != nil {
+		t.Fatalf("cannot import state: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code: %v", res.StatusCode)
+	}
+	h.Emit(exportTestGet("k3"))
+	if v := <-vch; v != "v3" {
+		t.Errorf("invalid imported value: %v", v)
+	}
+	h.Stop()
+	time.Sleep(1 * time.Second)
+
+	bees, err := AppBees(cfg.StatePath, "export")
+	if err != nil || len(bees) != 1 || bees[0] != bee {
+		t.Fatalf("invalid bees: %v (%v)", bees, err)
+	}
+	s, err := LoadBeeState(cfg.StatePath, "export", bee)
+	if err != nil {
+		t.Fatalf("cannot load the state of %v: %v", bee, err)
+	}
+	for k, v := range map[string]string{"k1": "k1", "k2": "k2", "k3": "v3"} {
+		if sv, err := s.Dict("D").Get(k); err != nil || !bytes.Equal(sv,
+			[]byte(v)) {
+
+			t.Errorf("invalid value for %v: %s (%v)", k, sv, err)
+		}
+	}
+
+	n, err := ImportBeeState(cfg.StatePath, "export", bee,
+		strings.NewReader(`{"dict":"D","key":"k4","text":"v4"}`))
+	if err != nil || n != 1 {
+		t.Fatalf("cannot import offline: n=%v err=%v", n, err)
+	}
+	if s, err = LoadBeeState(cfg.StatePath, "export", bee); err != nil {
+		t.Fatalf("cannot load the state of %v: %v", bee, err)
+	}
+	if v, _ := s.Dict("D").Get("k4"); string(v) != "v4" {
+		t.Errorf("invalid offline imported value: %s", v)
+	}
+
+	h = NewHiveWithConfig(cfg)
+	registerExportApp(h, ch, vch)
+	go h.Start()
+	defer h.Stop()
+	h.Emit(exportTestGet("k4"))
+	select {
+	case v := <-vch:
+		if v != "v4" {
+			t.Errorf("invalid offline imported value after restart: %v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bee is not restarted")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 	bhflag "github.com/kandoo/beehive/flag"
+	"github.com/kandoo/beehive/gen"
 	"github.com/kandoo/beehive/raft"
 )
 
@@ -41,6 +42,23 @@ type Hive interface {
 
 	// Emits a message containing msgData from this hive.
 	Emit(msgData interface{})
+	// TryEmit is similar to Emit, but returns ErrQueueFull if the hive's queue
+	// is full and the queue policy is OverflowReject.
+	TryEmit(msgData interface{}) error
+	// EmitWithHeaders emits a message containing msgData with the given
+	// headers from this hive.
+	EmitWithHeaders(msgData interface{}, headers map[string]string)
+	// EmitAfter emits a message containing msgData after at least duration d.
+	// The message is durably stored in the replicated state of the hive's
+	// scheduler app until it is due. Returns ErrNoScheduler if the hive has no
+	// scheduler app, i.e., if HiveConfig.SchedReplFactor is 0.
+	EmitAfter(d time.Duration, msgData interface{}) error
+	// EmitAt emits a message containing msgData at time t.
+	EmitAt(t time.Time, msgData interface{}) error
+	// Publish emits a message containing msgData on the given topic. The
+	// message is delivered to the handlers subscribed to a matching topic
+	// pattern, and to the handlers registered for its type without any topic.
+	Publish(topic string, msgData interface{}) error
 	// Sends a message to a specific bee that owns a specific dictionary key.
 	SendToCellKey(msgData interface{}, to string, dk CellKey)
 	// Sends a message to a sepcific bee.
@@ -60,8 +78,9 @@ type HiveConfig struct {
 	PeerAddrs []string // peer addresses.
 	RegAddrs  []string // reigstery service addresses.
 	StatePath string   // where to store state data.
+	InMemory  bool     // whether to keep raft logs, meta data and state in memory.
 
-	DataChBufSize int // buffer size of the data channels.
+	DataChBufSize int // initial buffer size of the data channels.
 	CmdChBufSize  int // buffer size of the control channels.
 	BatchSize     int // number of messages to batch.
 
@@ -72,11 +91,40 @@ type HiveConfig struct {
 	RaftTick       time.Duration // the raft tick interval.
 	RaftHBTicks    int           // number of raft ticks that fires a heartbeat.
 	RaftElectTicks int           // number of raft ticks that fires election.
+	RaftLearnerLag uint64        // max entries a learner lags before promotion.
+
+	// The registry snapshots its state when any of the thresholds is reached.
+	// A zero threshold is disabled. RaftSnapPolicy, if set, overrides the
+	// thresholds.
+	RaftSnapEntries  uint64              // entries between snapshots.
+	RaftSnapBytes    uint64              // WAL bytes between snapshots.
+	RaftSnapInterval time.Duration       // time between snapshots.
+	RaftSnapPolicy   raft.SnapshotPolicy // custom snapshot policy.
 
 	MaxConnPerHost int           // max parallel data connections to a host.
 	ConnTimeout    time.Duration // timeout for connections between hives.
 	BatcherPerHost int           // number of parallel batchers per host.
 	BatcherTimeout time.Duration // timeout used in the batchers.
+
+	DeadLetterSize int // max number of dead letters stored per app.
+
+	HiveQueueSize int            // max pending messages per hive and app (0=inf).
+	BeeQueueSize  int            // max pending messages per bee (0=inf).
+	QueuePolicy   OverflowPolicy // what to do when a queue is full.
+	// Note that OverflowBlock can deadlock when the hive's queue and the queues
+	// of its bees are full at the same time. See OverflowBlock.
+
+	// SchedReplFactor is the replication factor of the messages scheduled by
+	// the hive. If it is 0, the hive does not install its scheduler app and
+	// cannot schedule messages using EmitAfter and EmitAt. All hives in a
+	// cluster should use the same value.
+	SchedReplFactor int
+
+	// Codec is the name of the codec used to encode the application messages
+	// and the commands sent to other hives, as well as the transactions and
+	// the state snapshots of bees. Raft messages are always encoded as protocol
+	// buffers. All hives in a cluster should use the same codec.
+	Codec string
 }
 
 // RaftElectTimeout returns the raft election timeout as
@@ -85,26 +133,74 @@ func (c HiveConfig) RaftElectTimeout() time.Duration {
 	return time.Duration(c.RaftElectTicks) * c.RaftTick
 }
 
+// raftDataDir returns where a raft node stores its log and snapshots, given
+// the state path of its owner. It is empty if the hive is in memory.
+func (c HiveConfig) raftDataDir(statePath string) string {
+	if c.InMemory {
+		return ""
+	}
+	return statePath
+}
+
+// codec returns the codec named by Codec, or gob if Codec is empty.
+func (c HiveConfig) codec() (Codec, error) {
+	if c.Codec == "" {
+		return GobCodec, nil
+	}
+	return CodecByName(c.Codec)
+}
+
+// raftSnapPolicy returns the snapshot policy of the registry.
+func (c HiveConfig) raftSnapPolicy() raft.SnapshotPolicy {
+	if c.RaftSnapPolicy != nil {
+		return c.RaftSnapPolicy
+	}
+
+	var policies []raft.SnapshotPolicy
+	if c.RaftSnapEntries != 0 {
+		policies = append(policies, raft.SnapshotEntries(c.RaftSnapEntries))
+	}
+	if c.RaftSnapBytes != 0 {
+		policies = append(policies, raft.SnapshotBytes(c.RaftSnapBytes))
+	}
+	if c.RaftSnapInterval != 0 {
+		policies = append(policies, raft.SnapshotInterval(c.RaftSnapInterval))
+	}
+	return raft.SnapshotAny(policies...)
+}
+
 // NewHiveWithConfig creates a new hive based on the given configuration.
 func NewHiveWithConfig(cfg HiveConfig) Hive {
 	if !flag.Parsed() {
 		flag.Parse()
 	}
 
-	os.MkdirAll(cfg.StatePath, 0700)
+	if !cfg.InMemory {
+		os.MkdirAll(cfg.StatePath, 0700)
+	}
 	m := meta(cfg)
 	h := &hive{
 		id:     m.Hive.ID,
 		meta:   m,
 		status: hiveStopped,
 		config: cfg,
-		dataCh: newMsgChannel(cfg.DataChBufSize),
+		dataCh: newBoundedMsgChannel(cfg.DataChBufSize, cfg.HiveQueueSize,
+			cfg.QueuePolicy),
 		ctrlCh: make(chan cmdAndChannel),
 		apps:   make(map[string]*app, 0),
 		qees:   make(map[string][]qeeAndHandler),
 		ticker: time.NewTicker(cfg.RaftTick),
 		client: newHTTPClient(cfg.ConnTimeout),
+		// Start from the current time to avoid reusing IDs after restarts.
+		msgIDs: gen.NewSeqIDGen(uint64(time.Now().UnixNano())),
+	}
+	h.dataCh.prio = h.msgPriority
+
+	c, err := cfg.codec()
+	if err != nil {
+		glog.Fatalf("invalid codec: %v", err)
 	}
+	h.codec = c
 
 	h.streamer = newLoadBalancer(h, cfg.BatcherPerHost)
 	h.registry = newRegistry(h.String())
@@ -116,6 +212,9 @@ func NewHiveWithConfig(cfg HiveConfig) Hive {
 	} else {
 		h.collector = &noOpStatCollector{}
 	}
+	if cfg.SchedReplFactor > 0 {
+		newAppScheduler(h)
+	}
 	return h
 }
 
@@ -140,7 +239,7 @@ func init() {
 	flag.Var(&bhflag.CSV{S: &DefaultCfg.RegAddrs}, "raddrs",
 		"address of etcd machines. Separate entries with a comma ','")
 	flag.IntVar(&DefaultCfg.DataChBufSize, "chsize", 1024,
-		"buffer size of data channels")
+		"initial buffer size of data channels")
 	flag.IntVar(&DefaultCfg.CmdChBufSize, "cmdchsize", 128,
 		"buffer size of command channels")
 	flag.IntVar(&DefaultCfg.BatchSize, "batch", 1024,
@@ -151,6 +250,9 @@ func init() {
 		"when the local stat collector should notify the optimizer (in msg/s).")
 	flag.StringVar(&DefaultCfg.StatePath, "statepath", "/tmp/beehive",
 		"where to store persistent state data")
+	flag.BoolVar(&DefaultCfg.InMemory, "inmem", false,
+		"whether to keep raft logs, meta data and state in memory instead of "+
+			"statepath")
 	flag.DurationVar(&DefaultCfg.RegLockTimeout, "reglocktimeout",
 		10*time.Millisecond, "timeout to retry locking an entry in the registry")
 	flag.DurationVar(&DefaultCfg.RaftTick, "rafttick", 100*time.Millisecond,
@@ -159,6 +261,14 @@ func init() {
 		"number of raft ticks to start an election (ie, election timeout)")
 	flag.IntVar(&DefaultCfg.RaftHBTicks, "rafthbticks", 1,
 		"number of raft ticks to fire a heartbeat (ie, heartbeat timeout)")
+	flag.Uint64Var(&DefaultCfg.RaftLearnerLag, "raftlearnerlag", 100,
+		"number of entries a new member can lag behind the leader to vote")
+	flag.Uint64Var(&DefaultCfg.RaftSnapEntries, "raftsnapentries", 1024,
+		"number of registry entries between snapshots (0 to disable)")
+	flag.Uint64Var(&DefaultCfg.RaftSnapBytes, "raftsnapbytes", 0,
+		"number of registry WAL bytes between snapshots (0 to disable)")
+	flag.DurationVar(&DefaultCfg.RaftSnapInterval, "raftsnapinterval", 0,
+		"time between registry snapshots (0 to disable)")
 	flag.IntVar(&DefaultCfg.MaxConnPerHost, "maxconn", 32,
 		"maximum number of parallel data connectons to a remote host")
 	flag.DurationVar(&DefaultCfg.ConnTimeout, "conntimeout", 60*time.Second,
@@ -167,11 +277,24 @@ func init() {
 		"number of parallel batchers per host")
 	flag.DurationVar(&DefaultCfg.BatcherTimeout, "batchertimeout",
 		1*time.Millisecond, "timeout used for batching")
+	flag.IntVar(&DefaultCfg.DeadLetterSize, "deadletters", 1024,
+		"maximum number of dead letters stored per application")
+	flag.IntVar(&DefaultCfg.HiveQueueSize, "hiveqsize", 0,
+		"maximum number of pending messages in the hive (0 for unbounded)")
+	flag.IntVar(&DefaultCfg.BeeQueueSize, "beeqsize", 0,
+		"maximum number of pending messages per bee (0 for unbounded)")
+	flag.Var(&DefaultCfg.QueuePolicy, "qpolicy",
+		"what to do when a queue is full: block, dropoldest, dropnewest or reject")
+	flag.IntVar(&DefaultCfg.SchedReplFactor, "schedreplfactor", 0,
+		"replication factor of the messages scheduled by the hive (0 to disable)")
+	flag.StringVar(&DefaultCfg.Codec, "codec", GobCodec.Name(),
+		"codec of messages, commands and snapshots: gob, json or proto")
 }
 
 type qeeAndHandler struct {
-	q *qee
-	h Handler
+	q      *qee
+	h      Handler
+	topics []string // topic patterns of the handler, if any.
 }
 
 // hiveStatus represents the status of a hive.
@@ -196,6 +319,7 @@ type hive struct {
 	dataCh *msgChannel
 	ctrlCh chan cmdAndChannel
 	sigCh  chan os.Signal
+	msgIDs gen.IDGenerator
 
 	apps map[string]*app
 	qees map[string][]qeeAndHandler
@@ -208,6 +332,7 @@ type hive struct {
 	ticker   *time.Ticker
 	client   *http.Client
 	streamer streamer
+	codec    Codec
 
 	replStrategy replicationStrategy
 	collector    collector
@@ -226,16 +351,48 @@ func (h *hive) Config() HiveConfig {
 }
 
 func (h *hive) RegisterMsg(msg interface{}) {
-	gob.Register(msg)
+	// Versioned messages are already registered in gob.
+	if _, ok := versionOf(msg); !ok {
+		gob.Register(msg)
+	}
+	registerMsgType(msg)
 }
 
 func (h *hive) app(name string) (*app, bool) {
+	h.Lock()
+	defer h.Unlock()
+
 	a, ok := h.apps[name]
 	return a, ok
 }
 
+// appList returns the apps of the hive. Unlike h.apps, it is safe to use from
+// any goroutine.
+func (h *hive) appList() []*app {
+	h.Lock()
+	defer h.Unlock()
+
+	apps := make([]*app, 0, len(h.apps))
+	for _, a := range h.apps {
+		apps = append(apps, a)
+	}
+	return apps
+}
+
+// hiveAddr returns the address of the hive from the local registry, and
+// catches up with the registry only if the hive is not found. Unlike
+// beeByCells, hits are not linearizable: hiveAddr is used by the raft
+// transport, which cannot wait for the reads that depend on it. A hit is
+// stale only if the hive has been removed or has rejoined with a new address,
+// and the connections to the old address fail.
 func (h *hive) hiveAddr(id uint64) (string, error) {
 	i, err := h.registry.hive(id)
+	if err == ErrNoSuchHive {
+		// The hive may have joined after our last update of the registry.
+		if serr := h.syncRegistry(); serr == nil {
+			i, err = h.registry.hive(id)
+		}
+	}
 	return i.Addr, err
 }
 
@@ -299,6 +456,20 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 		err := h.raftBarrier()
 		cc.ch <- cmdResult{Err: err}
 
+	case cmdTransferLeadership:
+		ctx, ccl := context.WithTimeout(context.Background(),
+			300*h.config.RaftTick)
+		err := h.node.TransferLeadership(ctx, d.To)
+		ccl()
+		cc.ch <- cmdResult{Err: err}
+
+	case cmdSnapshot:
+		ctx, ccl := context.WithTimeout(context.Background(),
+			300*h.config.RaftTick)
+		err := h.node.Snapshot(ctx)
+		ccl()
+		cc.ch <- cmdResult{Err: err}
+
 	case cmdNewHiveID:
 		r, err := h.node.Process(context.TODO(), newHiveID{d.Addr})
 		cc.ch <- cmdResult{
@@ -307,7 +478,7 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 		}
 
 	case cmdAddHive:
-		err := h.node.AddNode(context.TODO(), d.Info.ID, d.Info.Addr)
+		err := h.node.AddLearner(context.TODO(), d.Info.ID, d.Info.Addr)
 		cc.ch <- cmdResult{
 			Err: err,
 		}
@@ -334,25 +505,45 @@ func (h *hive) stepRaft(ctx context.Context, msg raftpb.Message) error {
 	return h.node.Step(ctx, msg)
 }
 
+// syncRegistry waits until the local registry reflects all the changes
+// committed to the registry before the call, without going through the raft
+// log. Concurrent calls share the same round of probes on the leader.
+func (h *hive) syncRegistry() error {
+	ctx, ccl := context.WithTimeout(context.Background(),
+		h.config.RaftElectTimeout())
+	defer ccl()
+	return h.node.LinearizableRead(ctx)
+}
+
 func (h *hive) raftBarrier() error {
 	ctx, _ := context.WithTimeout(context.Background(), 300*h.config.RaftTick)
-	_, err := h.node.Process(ctx, noOp{})
-	return err
+	if _, err := h.node.Process(ctx, noOp{}); err != nil {
+		return err
+	}
+	// A new hive joins as a learner, and votes once it has caught up.
+	return h.node.WaitVoter(ctx, h.id)
 }
 
 func (h *hive) registerApp(a *app) {
+	h.Lock()
+	defer h.Unlock()
+
 	h.apps[a.Name()] = a
 }
 
-func (h *hive) registerHandler(t string, q *qee, l Handler) {
+// registerHandler registers the handler of q for message type t. The handler
+// receives all the messages of type t if topics is empty, and otherwise only
+// the messages published on the topics matching the patterns in topics.
+func (h *hive) registerHandler(t string, q *qee, l Handler, topics []string) {
 	for i, qh := range h.qees[t] {
 		if qh.q == q {
 			h.qees[t][i].h = l
+			h.qees[t][i].topics = topics
 			return
 		}
 	}
 
-	h.qees[t] = append(h.qees[t], qeeAndHandler{q, l})
+	h.qees[t] = append(h.qees[t], qeeAndHandler{q: q, h: l, topics: topics})
 }
 
 func (h *hive) bee(id uint64) (BeeInfo, error) {
@@ -377,13 +568,16 @@ func (h *hive) handleMsg(m *msg) {
 		a.qee.enqueMsg(msgAndHandler{msg: m, handler: a.handler(m.Type())})
 	default:
 		for _, qh := range h.qees[m.Type()] {
-			qh.q.enqueMsg(msgAndHandler{m, qh.h})
+			if !qh.matches(m.MsgTopic) {
+				continue
+			}
+			qh.q.enqueMsg(msgAndHandler{msg: m, handler: qh.h})
 		}
 	}
 }
 
 func (h *hive) startQees() {
-	for _, a := range h.apps {
+	for _, a := range h.appList() {
 		go a.qee.start()
 	}
 }
@@ -396,7 +590,9 @@ func (h *hive) startRaftNode() {
 		peers = append(peers, raft.NodeInfo(h.info()).Peer())
 	}
 	h.node = raft.NewNode(h.String(), h.id, peers, h.sendRaft, h,
-		h.config.StatePath, h.registry, 1024, h.ticker.C, h.config.RaftElectTicks,
+		h.config.raftDataDir(h.config.StatePath), h.registry,
+		h.config.raftSnapPolicy(),
+		h.config.RaftLearnerLag, h.ticker.C, h.config.RaftElectTicks,
 		h.config.RaftHBTicks)
 }
 
@@ -507,7 +703,9 @@ func (h *hive) NewApp(name string, options ...AppOption) App {
 		name:     name,
 		hive:     h,
 		handlers: make(map[string]Handler),
+		prios:    make(map[string]Priority),
 	}
+	a.dlq = newDeadLetters(a, h.config.DeadLetterSize)
 	a.initQee()
 	h.registerApp(a)
 
@@ -523,11 +721,53 @@ func (h *hive) NewApp(name string, options ...AppOption) App {
 }
 
 func (h *hive) Emit(msgData interface{}) {
-	h.enqueMsg(&msg{MsgData: msgData})
+	if err := h.TryEmit(msgData); err != nil {
+		glog.Errorf("%v cannot emit %v: %v", h, msgData, err)
+	}
+}
+
+func (h *hive) TryEmit(msgData interface{}) error {
+	return h.enqueMsg(&msg{MsgData: msgData})
 }
 
-func (h *hive) enqueMsg(msg *msg) {
-	h.dataCh.in() <- msgAndHandler{msg: msg}
+func (h *hive) EmitWithHeaders(msgData interface{},
+	headers map[string]string) {
+
+	err := h.enqueMsg(&msg{
+		MsgData:    msgData,
+		MsgHeaders: mergeHeaders(nil, headers),
+	})
+	if err != nil {
+		glog.Errorf("%v cannot emit %v: %v", h, msgData, err)
+	}
+}
+
+// msgPriority returns the priority of m in the queue of the hive, which is the
+// highest priority of m in the apps handling it.
+func (h *hive) msgPriority(m *msg) Priority {
+	qhs := h.qees[m.Type()]
+	if len(qhs) == 0 {
+		return PriorityNormal
+	}
+	p := PriorityLow
+	for _, qh := range qhs {
+		if ap := qh.q.app.msgPriority(m); ap > p {
+			p = ap
+		}
+	}
+	return p
+}
+
+// newMsgID returns a new unique message ID.
+func (h *hive) newMsgID() MsgID {
+	return MsgID{Hive: h.id, Seq: h.msgIDs.GenID()}
+}
+
+func (h *hive) enqueMsg(msg *msg) error {
+	if msg.MsgID.IsNil() {
+		msg.MsgID = h.newMsgID()
+	}
+	return h.dataCh.send(msgAndHandler{msg: msg})
 }
 
 func (h *hive) SendToCellKey(msgData interface{}, to string, k CellKey) {
@@ -546,8 +786,9 @@ func (h *hive) ReplyTo(thatMsg Msg, replyData interface{}) error {
 		return errors.New("cannot reply to this message")
 	}
 
-	h.enqueMsg(newMsgFromData(replyData, 0, m.From()))
-	return nil
+	r := newMsgFromData(replyData, 0, m.From())
+	r.MsgHeaders = mergeHeaders(m.MsgHeaders, nil)
+	return h.enqueMsg(r)
 }
 
 func (h *hive) registerSignals() {
@@ -580,13 +821,11 @@ func (h *hive) listen() error {
 }
 
 func (h *hive) newProxyToHive(to uint64) (*proxy, error) {
-	// TODO(soheil): maybe we should use the cache here.
 	return h.newProxyToHiveWithRetry(to, 0, 1)
 }
 
 func (h *hive) newProxyToHiveWithRetry(to uint64, backoffStep time.Duration,
 	maxRetries uint32) (*proxy, error) {
-	// TODO(soheil): maybe we should use the cache here.
 	a, err := h.hiveAddr(to)
 	if err != nil {
 		return nil, err
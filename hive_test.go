@@ -3,10 +3,15 @@ package beehive
 import (
 	"encoding/binary"
 	"fmt"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/kandoo/beehive/raft"
 )
 
 const (
@@ -61,7 +66,7 @@ func (h *testHiveHandler) Rcv(m Msg, c RcvContext) error {
 	return nil
 }
 
-func runHiveTest(cfg HiveConfig, t *testing.T) {
+func runHiveTest(cfg HiveConfig, t *testing.T, options ...AppOption) {
 	runtime.GOMAXPROCS(4)
 	defer runtime.GOMAXPROCS(1)
 
@@ -72,7 +77,7 @@ func runHiveTest(cfg HiveConfig, t *testing.T) {
 	}()
 
 	hive := NewHiveWithConfig(cfg)
-	app := hive.NewApp("TestHiveApp")
+	app := hive.NewApp("TestHiveApp", options...)
 	app.Handle(MyMsg(0), &testHiveHandler{})
 
 	go hive.Start()
@@ -108,6 +113,18 @@ func TestHiveRestart(t *testing.T) {
 	runHiveTest(cfg, t)
 }
 
+func TestHiveInMemory(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest"
+	cfg.Addr = newHiveAddrForTest()
+	cfg.InMemory = true
+	removeState(cfg)
+	runHiveTest(cfg, t, AppWithDiskState())
+	if _, err := os.Stat(cfg.StatePath); !os.IsNotExist(err) {
+		t.Errorf("in-memory hive has created %v", cfg.StatePath)
+	}
+}
+
 func TestHiveCluster(t *testing.T) {
 	cfg1 := DefaultCfg
 	cfg1.StatePath = "/tmp/bhtest1"
@@ -141,6 +158,118 @@ func TestHiveCluster(t *testing.T) {
 	h1.Stop()
 }
 
+func TestHiveSyncRegistry(t *testing.T) {
+	cfg1 := DefaultCfg
+	cfg1.StatePath = "/tmp/bhtest1"
+	cfg1.Addr = newHiveAddrForTest()
+	removeState(cfg1)
+	h1 := NewHiveWithConfig(cfg1)
+	go h1.Start()
+	waitTilStareted(h1)
+	defer h1.Stop()
+
+	cfg2 := DefaultCfg
+	cfg2.StatePath = "/tmp/bhtest2"
+	cfg2.Addr = newHiveAddrForTest()
+	cfg2.PeerAddrs = []string{cfg1.Addr}
+	removeState(cfg2)
+	h2 := NewHiveWithConfig(cfg2)
+	go h2.Start()
+	waitTilStareted(h2)
+	defer h2.Stop()
+
+	for _, h := range []*hive{h1.(*hive), h2.(*hive)} {
+		var err error
+		for i := 0; i < 10; i++ {
+			if err = h.syncRegistry(); err == nil {
+				break
+			}
+			time.Sleep(cfg1.RaftElectTimeout())
+		}
+		if err != nil {
+			t.Fatalf("%v cannot sync its registry: %v", h, err)
+		}
+		if n := len(h.registry.hives()); n != 2 {
+			t.Errorf("invalid number of hives in %v: actual=%v want=2", h, n)
+		}
+		if a, err := h.hiveAddr(h2.ID()); err != nil || a != cfg2.Addr {
+			t.Errorf("invalid address of %v: actual=%v want=%v (%v)", h2.ID(), a,
+				cfg2.Addr, err)
+		}
+	}
+}
+
+func TestHiveTransferLeadership(t *testing.T) {
+	var hives []Hive
+	for i := 1; i <= 3; i++ {
+		cfg := DefaultCfg
+		cfg.StatePath = fmt.Sprintf("/tmp/bhtest%v", i)
+		cfg.Addr = newHiveAddrForTest()
+		if i != 1 {
+			cfg.PeerAddrs = []string{hives[0].(*hive).config.Addr}
+		}
+		removeState(cfg)
+		h := NewHiveWithConfig(cfg)
+		go h.Start()
+		waitTilStareted(h)
+		defer h.Stop()
+		hives = append(hives, h)
+	}
+
+	h1 := hives[0].(*hive)
+	to := hives[2].ID()
+	if _, err := h1.processCmd(cmdTransferLeadership{To: to}); err != nil {
+		t.Fatalf("cannot transfer leadership: %v", err)
+	}
+	for _, h := range hives {
+		if err := h.(*hive).syncRegistry(); err != nil {
+			t.Errorf("%v cannot sync its registry: %v", h, err)
+		}
+	}
+	if _, err := h1.processCmd(cmdTransferLeadership{To: to}); err !=
+		raft.ErrNotLeader {
+
+		t.Errorf("invalid error: actual=%v want=%v", err, raft.ErrNotLeader)
+	}
+}
+
+func TestHiveSnapshot(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest1"
+	cfg.Addr = newHiveAddrForTest()
+	var checks int32
+	cfg.RaftSnapPolicy = func(s raft.SnapshotStatus) bool {
+		atomic.AddInt32(&checks, 1)
+		return false
+	}
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+	go h.Start()
+	waitTilStareted(h)
+	defer h.Stop()
+
+	snaps := func() int {
+		files, err := filepath.Glob(filepath.Join(cfg.StatePath, "snap", "*.snap"))
+		if err != nil {
+			t.Fatalf("cannot list snapshots: %v", err)
+		}
+		return len(files)
+	}
+	if n := snaps(); n != 0 {
+		t.Fatalf("the registry is snapshotted against its policy: %v snapshots",
+			n)
+	}
+	if _, err := h.(*hive).processCmd(cmdSnapshot{}); err != nil {
+		t.Fatalf("cannot snapshot the registry: %v", err)
+	}
+	if n := snaps(); n != 1 {
+		t.Errorf("invalid number of snapshots: actual=%v want=1", n)
+	}
+	if atomic.LoadInt32(&checks) == 0 {
+		t.Errorf("the snapshot policy of the registry is not used")
+	}
+}
+
 func TestHiveFailure(t *testing.T) {
 	cfg1 := DefaultCfg
 	cfg1.StatePath = "/tmp/bhtest1"
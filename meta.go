@@ -43,7 +43,7 @@ func peersInfo(addrs []string) map[uint64]HiveInfo {
 	return infos
 }
 
-func hiveIDFromPeers(addr string, paddrs []string) uint64 {
+func hiveIDFromPeers(addr string, paddrs []string, c Codec) uint64 {
 	if len(paddrs) == 0 {
 		return 1
 	}
@@ -54,12 +54,12 @@ func hiveIDFromPeers(addr string, paddrs []string) uint64 {
 		glog.Infof("requesting hive ID from %v", a)
 		go func(a string) {
 			p := newProxyWithRetry(client, a, 100*time.Millisecond, 5)
-			id, err := sendCmd(p, cmd{Data: cmdNewHiveID{Addr: addr}})
+			id, err := sendCmd(p, c, cmd{Data: cmdNewHiveID{Addr: addr}})
 			if err != nil {
 				glog.Error(err)
 				return
 			}
-			_, err = sendCmd(p, cmd{
+			_, err = sendCmd(p, c, cmd{
 				Data: cmdAddHive{
 					Info: raft.NodeInfo{
 						ID:   id.(uint64),
@@ -86,7 +86,31 @@ func hiveIDFromPeers(addr string, paddrs []string) uint64 {
 	return 1
 }
 
+// newMeta creates the meta data of a new hive.
+func newMeta(cfg HiveConfig) hiveMeta {
+	m := hiveMeta{}
+	m.Peers = peersInfo(cfg.PeerAddrs)
+	m.Hive.Addr = cfg.Addr
+	if len(cfg.PeerAddrs) == 0 {
+		// The initial ID is 1. There is no raft node up yet to allocate an ID. So
+		// we must do this when the hive starts.
+		m.Hive.ID = 1
+		return m
+	}
+
+	c, err := cfg.codec()
+	if err != nil {
+		glog.Fatalf("invalid codec: %v", err)
+	}
+	m.Hive.ID = hiveIDFromPeers(cfg.Addr, cfg.PeerAddrs, valueCodec(c))
+	return m
+}
+
 func meta(cfg HiveConfig) hiveMeta {
+	if cfg.InMemory {
+		return newMeta(cfg)
+	}
+
 	m := hiveMeta{}
 
 	var dec *gob.Decoder
@@ -95,16 +119,7 @@ func meta(cfg HiveConfig) hiveMeta {
 	if err != nil {
 		// TODO(soheil): We should also update our peer addresses when we have an
 		// existing meta.
-		m.Peers = peersInfo(cfg.PeerAddrs)
-		m.Hive.Addr = cfg.Addr
-		if len(cfg.PeerAddrs) == 0 {
-			// The initial ID is 1. There is no raft node up yet to allocate an ID. So
-			// we must do this when the hive starts.
-			m.Hive.ID = 1
-			goto save
-		}
-
-		m.Hive.ID = hiveIDFromPeers(cfg.Addr, cfg.PeerAddrs)
+		m = newMeta(cfg)
 		goto save
 	}
 
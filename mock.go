@@ -10,6 +10,10 @@ import (
 // MockMsg is a mock for Msg.
 type MockMsg msg
 
+func (m MockMsg) ID() MsgID {
+	return m.MsgID
+}
+
 func (m MockMsg) To() uint64 {
 	return m.MsgTo
 }
@@ -26,6 +30,14 @@ func (m MockMsg) Type() string {
 	return MsgType(m.MsgData)
 }
 
+func (m MockMsg) Headers() map[string]string {
+	return m.MsgHeaders
+}
+
+func (m MockMsg) Topic() string {
+	return m.MsgTopic
+}
+
 func (m MockMsg) IsBroadCast() bool {
 	return m.MsgTo == Nil
 }
@@ -79,6 +91,23 @@ func (m MockRcvContext) SendToCell(msgData interface{}, app string,
 	cell CellKey) {
 }
 
+func (m *MockRcvContext) Publish(topic string, msgData interface{}) {
+	msg := MockMsg{
+		MsgData:  msgData,
+		MsgFrom:  m.ID(),
+		MsgTopic: topic,
+	}
+	m.CtxMsgs = append(m.CtxMsgs, msg)
+}
+
+func (m *MockRcvContext) EmitAfter(d time.Duration, msgData interface{}) {
+	m.Emit(msgData)
+}
+
+func (m MockRcvContext) SendToCellAt(t time.Time, msgData interface{},
+	app string, cell CellKey) {
+}
+
 func (m *MockRcvContext) SendToBee(msgData interface{}, to uint64) {
 	msg := MockMsg{
 		MsgData: msgData,
@@ -96,6 +125,18 @@ func (m *MockRcvContext) ReplyTo(msg Msg, replyData interface{}) error {
 	return nil
 }
 
+func (m MockRcvContext) SetHeader(key, value string) {}
+
+func (m MockRcvContext) SetTimer(name string, spec string,
+	msgData interface{}, cell CellKey) error {
+
+	return nil
+}
+
+func (m MockRcvContext) DelTimer(name string) error {
+	return nil
+}
+
 func (m MockRcvContext) StartDetached(h DetachedHandler) uint64 {
 	return 0
 }
@@ -128,3 +169,15 @@ func (m MockRcvContext) CommitTx() error {
 func (m MockRcvContext) AbortTx() error {
 	return nil
 }
+
+func (m MockRcvContext) Savepoint() (state.Savepoint, error) {
+	return state.Savepoint{}, nil
+}
+
+func (m MockRcvContext) RollbackTo(sp state.Savepoint) error {
+	return nil
+}
+
+func (m MockRcvContext) ReleaseSavepoint(sp state.Savepoint) error {
+	return nil
+}
@@ -2,14 +2,21 @@ package beehive
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"reflect"
-	"runtime"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 )
 
 // Message is a generic interface for messages emitted in the system. Messages
 // are defined for each type.
 type Msg interface {
+	// ID returns the unique ID of this message. The ID is assigned when the
+	// message is first enqueued in a hive, and does not change when the message
+	// is relayed or resent.
+	ID() MsgID
 	// Type of the data in this message.
 	Type() string
 	// Data stored in the message.
@@ -18,6 +25,12 @@ type Msg interface {
 	From() uint64
 	// To returns the ID of the receiver of this message.
 	To() uint64
+	// Headers returns the headers of this message. Headers are automatically
+	// copied to all messages emitted while handling this message. The returned
+	// map must not be modified.
+	Headers() map[string]string
+	// Topic returns the topic this message is published on, if any.
+	Topic() string
 
 	// NoReply returns whether we can reply to the message.
 	NoReply() bool
@@ -27,15 +40,55 @@ type Msg interface {
 	IsUnicast() bool
 }
 
+// MsgID is the unique identifier of a message. Hive is the ID of the hive
+// that first enqueued the message, and Seq is a sequence number unique in that
+// hive.
+type MsgID struct {
+	Hive uint64
+	Seq  uint64
+}
+
+// IsNil returns whether the ID is not assigned.
+func (id MsgID) IsNil() bool {
+	return id.Hive == Nil && id.Seq == 0
+}
+
+func (id MsgID) String() string {
+	return fmt.Sprintf("%016X%016X", id.Hive, id.Seq)
+}
+
+// Priority is the priority of a message. Messages with higher priorities are
+// delivered before messages with lower priorities in hives and bees.
+type Priority int
+
+// Valid values for Priority.
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = iota
+)
+
+// Prioritized is a message data with an explicit priority. Message data that
+// does not implement Prioritized has the priority of its type registered using
+// App.HandleWithPriority, or PriorityNormal.
+type Prioritized interface {
+	Priority() Priority
+}
+
 // Typed is a message data with an explicit type.
 type Typed interface {
 	Type() string
 }
 
 type msg struct {
-	MsgData interface{}
-	MsgFrom uint64
-	MsgTo   uint64
+	MsgID      MsgID
+	MsgData    interface{}
+	MsgFrom    uint64
+	MsgTo      uint64
+	MsgHeaders map[string]string
+	MsgTopic   string
 }
 
 func (m msg) NoReply() bool {
@@ -50,6 +103,22 @@ func (m msg) IsUnicast() bool {
 	return m.MsgTo != 0
 }
 
+func (m msg) ID() MsgID {
+	return m.MsgID
+}
+
+// clampPriority returns the valid priority closest to p.
+func clampPriority(p Priority) Priority {
+	switch {
+	case p < PriorityLow:
+		return PriorityLow
+	case p > PriorityHigh:
+		return PriorityHigh
+	default:
+		return p
+	}
+}
+
 func (m msg) Type() string {
 	return MsgType(m.MsgData)
 }
@@ -66,6 +135,14 @@ func (m msg) From() uint64 {
 	return m.MsgFrom
 }
 
+func (m msg) Headers() map[string]string {
+	return m.MsgHeaders
+}
+
+func (m msg) Topic() string {
+	return m.MsgTopic
+}
+
 func (m msg) String() string {
 	return fmt.Sprintf("%v -> %v\t%v(%#v)", m.From(), m.To(), m.Type(), m.Data())
 }
@@ -75,6 +152,9 @@ func MsgType(d interface{}) string {
 	if t, ok := d.(Typed); ok {
 		return t.Type()
 	}
+	if v, ok := versionOf(d); ok {
+		return v.name
+	}
 	return reflect.TypeOf(d).String()
 }
 
@@ -86,9 +166,27 @@ func newMsgFromData(data interface{}, from uint64, to uint64) *msg {
 	}
 }
 
+// mergeHeaders returns a new map containing headers in h1 and h2. Headers in
+// h2 take precedence over h1.
+func mergeHeaders(h1, h2 map[string]string) map[string]string {
+	if len(h1) == 0 && len(h2) == 0 {
+		return nil
+	}
+
+	h := make(map[string]string, len(h1)+len(h2))
+	for k, v := range h1 {
+		h[k] = v
+	}
+	for k, v := range h2 {
+		h[k] = v
+	}
+	return h
+}
+
 type msgAndHandler struct {
 	msg     *msg
 	handler Handler
+	retries int // number of times the message is retried in this bee.
 }
 
 type Emitter interface {
@@ -99,108 +197,195 @@ func init() {
 	gob.Register(msg{})
 }
 
+// msgChannelMaxSkips is the number of times a message can be preempted by
+// higher priority messages before it is delivered. This prevents starvation of
+// low priority messages.
+const msgChannelMaxSkips = 16
+
+// ErrQueueFull is returned when a message is rejected because the queue is
+// full.
+var ErrQueueFull = errors.New("queue is full")
+
+// OverflowPolicy represents what a bounded queue does when it is full.
+type OverflowPolicy int
+
+// Valid values for OverflowPolicy.
+const (
+	// OverflowBlock blocks the emitter until there is room in the queue. Since
+	// bees emit messages to the hive's queue and the hive enqueues messages in
+	// the queues of apps and bees, blocking queues can deadlock when they are
+	// full at the same time. Use it with queues that are large enough for the
+	// bursts of the application, or with non-blocking policies.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest message with the lowest priority.
+	OverflowDropOldest
+	// OverflowDropNewest drops the new message.
+	OverflowDropNewest
+	// OverflowReject rejects the new message and returns ErrQueueFull to the
+	// emitter, if possible.
+	OverflowReject
+)
+
+var overflowPolicyNames = []string{"block", "dropoldest", "dropnewest",
+	"reject"}
+
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(overflowPolicyNames) {
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+	return overflowPolicyNames[p]
+}
+
+// Set sets the policy from its name. It implements flag.Value.
+func (p *OverflowPolicy) Set(v string) error {
+	for i, n := range overflowPolicyNames {
+		if n == v {
+			*p = OverflowPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid overflow policy %v", v)
+}
+
+// msgChannel is a channel of messages that delivers messages in the order of
+// their priorities. All messages are kept in one ring per priority, and are
+// handed off to the receiver one at a time. Thus, the next message delivered is
+// always the one with the highest priority, regardless of the number of
+// pending messages with lower priorities.
+//
+// If maxLen is 0, the channel is unbounded. Otherwise, at most maxLen messages
+// are pending in the channel, in addition to the message being handed off, and
+// the overflow policy is applied when a message is sent to a full channel.
 type msgChannel struct {
-	chin  chan msgAndHandler
-	chout chan msgAndHandler
-	buf   []msgAndHandler
-	start int
-	end   int
+	sync.Mutex
+	notFull *sync.Cond    // signaled when a message leaves the rings.
+	notify  chan struct{} // wakes up the pipe when a message is sent.
+	chout   chan msgAndHandler
+	rings   [numPriorities]msgRing
+	skips   [numPriorities]int
+
+	maxLen int
+	policy OverflowPolicy
+	// prio returns the priority of the messages whose data is not Prioritized.
+	// It must be set before sending any message on the channel.
+	prio func(m *msg) Priority
 }
 
 func newMsgChannel(bufSize int) *msgChannel {
+	return newBoundedMsgChannel(bufSize, 0, OverflowBlock)
+}
+
+func newBoundedMsgChannel(bufSize int, maxLen int,
+	policy OverflowPolicy) *msgChannel {
+
+	q := makeMsgChannel(bufSize, maxLen, policy)
+	go q.pipe()
+	return q
+}
+
+// makeMsgChannel creates a message channel without starting its pipe.
+// bufSize is the initial size of the ring of each priority.
+func makeMsgChannel(bufSize int, maxLen int,
+	policy OverflowPolicy) *msgChannel {
+
+	if bufSize < 2 {
+		bufSize = 2
+	}
 	q := &msgChannel{
-		chin:  make(chan msgAndHandler, bufSize),
-		chout: make(chan msgAndHandler, bufSize),
-		buf:   make([]msgAndHandler, bufSize),
+		notify: make(chan struct{}, 1),
+		chout:  make(chan msgAndHandler),
+		maxLen: maxLen,
+		policy: policy,
+	}
+	q.notFull = sync.NewCond(&q.Mutex)
+	for i := range q.rings {
+		q.rings[i].buf = make([]msgAndHandler, bufSize)
 	}
-	go q.pipe()
 	return q
 }
 
 func (q *msgChannel) pipe() {
-	var chout chan msgAndHandler
-	var first msgAndHandler
-	dequed := false
 	for {
-		if dequed {
-			chout = q.chout
-		} else {
-			q.maybeFastPipe()
-			chout = nil
+		q.Lock()
+		first, ok := q.deque()
+		q.Unlock()
+		if !ok {
+			<-q.notify
+			continue
 		}
+		q.notFull.Signal()
+		q.handoff(first)
+	}
+}
+
+// handoff delivers mh to the receiver. If a message with a higher priority is
+// sent in the meantime, mh is put back and that message is delivered instead.
+func (q *msgChannel) handoff(mh msgAndHandler) {
+	for {
 		select {
-		case mh := <-q.chin:
-			q.enque(mh)
-			q.maybeReadMore()
-			if dequed == false {
-				first, dequed = q.deque()
+		case q.chout <- mh:
+			return
+		case <-q.notify:
+			q.Lock()
+			if q.preempts(mh) {
+				q.enqueFront(mh)
+				mh, _ = q.deque()
 			}
-		case chout <- first:
-			q.maybeWriteMore()
-			first, dequed = q.deque()
+			q.Unlock()
 		}
 	}
 }
 
-func (q *msgChannel) maybeFastPipe() {
-	cw := cap(q.chout)
-	cr := cap(q.chin)
-	for {
-		// calling cap and len is expensive. cache the values here and update later
-		// if needed.
-		w := cw - len(q.chout)
-		if w == 0 {
-			if len(q.chin) != cr {
-				// give it another chance.
-				runtime.Gosched()
-				continue
+// send sends mh on the channel while applying the overflow policy of the
+// channel. It returns ErrQueueFull if the channel is full and its overflow
+// policy is OverflowReject.
+func (q *msgChannel) send(mh msgAndHandler) error {
+	q.Lock()
+	if q.full() {
+		switch q.policy {
+		case OverflowBlock:
+			for q.full() {
+				q.notFull.Wait()
 			}
-			return
+		case OverflowReject:
+			q.Unlock()
+			return ErrQueueFull
+		case OverflowDropNewest:
+			q.Unlock()
+			q.drop(mh)
+			return nil
+		case OverflowDropOldest:
+			q.drop(q.dequeOldest())
 		}
+	}
+	q.enque(mh)
+	q.Unlock()
 
-		for i := 0; i < w; i++ {
-			mh := <-q.chin
-			q.chout <- mh
-		}
+	select {
+	case q.notify <- struct{}{}:
+	default:
 	}
+	return nil
 }
 
-func (q *msgChannel) maybeReadMore() {
-	l := len(q.chin)
-	if l < cap(q.chin) {
-		return
-	}
-	for ; l > 0; l-- {
-		select {
-		case mh := <-q.chin:
-			q.enque(mh)
-		default:
-			return
-		}
-	}
+// full returns whether the channel has maxLen pending messages. q must be
+// locked.
+func (q *msgChannel) full() bool {
+	return q.maxLen > 0 && q.len() >= q.maxLen
 }
 
-func (q *msgChannel) maybeWriteMore() {
-	w := cap(q.chout) - len(q.chout)
-	if w == 0 {
-		return
-	}
-	l := q.len()
-	if w < l {
-		l = w
-	}
-	for ; l > 0; l-- {
-		select {
-		case q.chout <- q.buf[q.start]:
-			q.deque()
-		default:
-			return
-		}
-	}
+func (q *msgChannel) drop(mh msgAndHandler) {
+	glog.V(1).Infof("message channel is full and drops %v", mh.msg)
 }
 
-func (q *msgChannel) in() chan<- msgAndHandler {
-	return q.chin
+// dequeOldest dequeues the oldest message with the lowest priority.
+func (q *msgChannel) dequeOldest() msgAndHandler {
+	for p := PriorityLow; p <= PriorityHigh; p++ {
+		if !q.rings[p].empty() {
+			return q.rings[p].deque()
+		}
+	}
+	return msgAndHandler{}
 }
 
 func (q *msgChannel) out() <-chan msgAndHandler {
@@ -211,63 +396,157 @@ func (q *msgChannel) empty() bool {
 	return q.len() == 0
 }
 
-func (q *msgChannel) full() bool {
-	return q.len() == len(q.buf)-1
+// priority returns the priority of mh. The priority of the message data, if
+// it is Prioritized, takes precedence over the priority of the channel.
+func (q *msgChannel) priority(mh msgAndHandler) Priority {
+	if mh.msg == nil {
+		return PriorityNormal
+	}
+	if p, ok := mh.msg.MsgData.(Prioritized); ok {
+		return clampPriority(p.Priority())
+	}
+	if q.prio != nil {
+		return clampPriority(q.prio(mh.msg))
+	}
+	return PriorityNormal
 }
 
 func (q *msgChannel) enque(mh msgAndHandler) {
-	if q.full() {
-		q.maybeExpand()
+	q.rings[q.priority(mh)].enque(mh)
+}
+
+func (q *msgChannel) enqueFront(mh msgAndHandler) {
+	q.rings[q.priority(mh)].enqueFront(mh)
+}
+
+// preempts returns whether there is a message that should be delivered before
+// mh.
+func (q *msgChannel) preempts(mh msgAndHandler) bool {
+	p, ok := q.next()
+	return ok && p > q.priority(mh)
+}
+
+// next returns the priority of the next message to deliver. It returns the
+// highest priority with a pending message, unless a lower priority is starved.
+func (q *msgChannel) next() (Priority, bool) {
+	top := Priority(-1)
+	for p := PriorityHigh; p >= PriorityLow; p-- {
+		if !q.rings[p].empty() {
+			top = p
+			break
+		}
+	}
+	if top < 0 {
+		return 0, false
 	}
 
-	q.buf[q.end] = mh
-	q.end++
-	if q.end >= len(q.buf) {
-		q.end = 0
+	for p := PriorityLow; p < top; p++ {
+		if !q.rings[p].empty() && q.skips[p] >= msgChannelMaxSkips {
+			return p, true
+		}
 	}
+	return top, true
 }
 
 func (q *msgChannel) deque() (msgAndHandler, bool) {
-	if q.empty() {
+	p, ok := q.next()
+	if !ok {
 		return msgAndHandler{}, false
 	}
 
-	mh := q.buf[q.start]
-	q.buf[q.start].msg = nil
-	q.start++
-	if q.start >= len(q.buf) {
-		q.start = 0
+	q.skips[p] = 0
+	for l := PriorityLow; l < p; l++ {
+		if !q.rings[l].empty() {
+			q.skips[l]++
+		}
 	}
-	return mh, true
+	return q.rings[p].deque(), true
 }
 
 func (q *msgChannel) len() int {
-	l := q.end - q.start
-	if l >= 0 {
-		return l
+	l := 0
+	for i := range q.rings {
+		l += q.rings[i].len()
+	}
+	return l
+}
+
+// msgRing is an expanding ring buffer of messages.
+type msgRing struct {
+	buf   []msgAndHandler
+	start int
+	end   int
+}
+
+func (r *msgRing) empty() bool {
+	return r.len() == 0
+}
+
+func (r *msgRing) full() bool {
+	return r.len() == len(r.buf)-1
+}
+
+func (r *msgRing) enque(mh msgAndHandler) {
+	if r.full() {
+		r.maybeExpand()
 	}
-	return len(q.buf) + l
+
+	r.buf[r.end] = mh
+	r.end++
+	if r.end >= len(r.buf) {
+		r.end = 0
+	}
+}
+
+func (r *msgRing) enqueFront(mh msgAndHandler) {
+	if r.full() {
+		r.maybeExpand()
+	}
+
+	r.start--
+	if r.start < 0 {
+		r.start = len(r.buf) - 1
+	}
+	r.buf[r.start] = mh
 }
 
-func (q *msgChannel) free() int {
-	return len(q.buf) - q.len()
+func (r *msgRing) peek() msgAndHandler {
+	return r.buf[r.start]
+}
+
+func (r *msgRing) deque() msgAndHandler {
+	mh := r.buf[r.start]
+	r.buf[r.start].msg = nil
+	r.start++
+	if r.start >= len(r.buf) {
+		r.start = 0
+	}
+	return mh
+}
+
+func (r *msgRing) len() int {
+	l := r.end - r.start
+	if l >= 0 {
+		return l
+	}
+	return len(r.buf) + l
 }
 
-func (q *msgChannel) maybeExpand() {
-	if !q.full() {
+func (r *msgRing) maybeExpand() {
+	if !r.full() {
 		return
 	}
 
-	qlen := q.len()
-	buf := make([]msgAndHandler, len(q.buf)*2)
-	if q.start < q.end {
-		copy(buf, q.buf[q.start:q.end])
+	rlen := r.len()
+	buf := make([]msgAndHandler, len(r.buf)*2)
+	if r.start < r.end {
+		copy(buf, r.buf[r.start:r.end])
 	} else {
-		l := len(q.buf) - q.start
-		copy(buf, q.buf[q.start:])
-		copy(buf[l:], q.buf[:q.end])
+		l := len(r.buf) - r.start
+		copy(buf, r.buf[r.start:])
+		copy(buf[l:], r.buf[:r.end])
 	}
-	q.start = 0
-	q.end = qlen
-	q.buf = buf
+	r.start = 0
+	r.end = rlen
+	r.buf = buf
 }
@@ -1,14 +1,17 @@
 package beehive
 
 import (
+	"encoding/gob"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	bhgob "github.com/kandoo/beehive/gob"
 )
 
 func TestMsgChannelQueue(t *testing.T) {
-	ch := newMsgChannel(7)
-	ch.chout = nil
-	ch.chin = nil
+	ch := makeMsgChannel(7, 0, OverflowBlock)
 	ch.enque(msgAndHandler{msg: &msg{}})
 	if _, ok := ch.deque(); !ok {
 		t.Errorf("cannot deque")
@@ -32,12 +35,174 @@ func TestMsgChannelQueue(t *testing.T) {
 	}
 }
 
+type prioritizedMsg Priority
+
+func (m prioritizedMsg) Priority() Priority {
+	return Priority(m)
+}
+
+func TestMsgChannelPriority(t *testing.T) {
+	ch := makeMsgChannel(7, 0, OverflowBlock)
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		ch.enque(msgAndHandler{msg: &msg{MsgData: prioritizedMsg(p)}})
+	}
+
+	for _, p := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		mh, ok := ch.deque()
+		if !ok {
+			t.Fatalf("cannot deque")
+		}
+		if mh.msg.MsgData != prioritizedMsg(p) {
+			t.Errorf("invalid priority: actual=%v want=%v", mh.msg.MsgData, p)
+		}
+	}
+}
+
+func TestMsgChannelStarvation(t *testing.T) {
+	ch := makeMsgChannel(7, 0, OverflowBlock)
+	ch.enque(msgAndHandler{msg: &msg{MsgData: prioritizedMsg(PriorityLow)}})
+	for i := 0; i < 2*msgChannelMaxSkips; i++ {
+		ch.enque(msgAndHandler{msg: &msg{MsgData: prioritizedMsg(PriorityHigh)}})
+	}
+
+	for i := 0; i <= msgChannelMaxSkips; i++ {
+		mh, _ := ch.deque()
+		if mh.msg.MsgData == prioritizedMsg(PriorityLow) {
+			return
+		}
+	}
+	t.Errorf("low priority message is starved")
+}
+
+func TestMsgChannelPriorityBacklog(t *testing.T) {
+	q := newMsgChannel(7)
+	for i := 0; i < 1024; i++ {
+		q.send(msgAndHandler{msg: &msg{MsgData: prioritizedMsg(PriorityNormal)}})
+	}
+	q.send(msgAndHandler{msg: &msg{MsgData: prioritizedMsg(PriorityHigh)}})
+
+	// The pipe may be handing off a message with a lower priority.
+	for i := 0; i < 2; i++ {
+		if mh := <-q.out(); mh.msg.MsgData == prioritizedMsg(PriorityHigh) {
+			return
+		}
+	}
+	t.Errorf("high priority message is queued behind the backlog")
+}
+
+func TestMsgChannelTypePriority(t *testing.T) {
+	q := makeMsgChannel(7, 0, OverflowBlock)
+	q.prio = func(m *msg) Priority {
+		if m.Type() == MsgType("") {
+			return PriorityHigh
+		}
+		return PriorityLow
+	}
+	q.enque(msgAndHandler{msg: &msg{MsgData: 1}})
+	q.enque(msgAndHandler{msg: &msg{MsgData: ""}})
+	q.enque(msgAndHandler{msg: &msg{MsgData: prioritizedMsg(PriorityNormal)}})
+
+	for _, want := range []interface{}{"", prioritizedMsg(PriorityNormal), 1} {
+		mh, ok := q.deque()
+		if !ok {
+			t.Fatalf("cannot deque")
+		}
+		if mh.msg.MsgData != want {
+			t.Errorf("invalid message: actual=%v want=%v", mh.msg.MsgData, want)
+		}
+	}
+}
+
+func TestMsgChannelBlock(t *testing.T) {
+	maxLen := 2
+	q := newBoundedMsgChannel(1, maxLen, OverflowBlock)
+	var sent int32
+	go func() {
+		for i := 0; i < maxLen+2; i++ {
+			q.send(msgAndHandler{msg: &msg{MsgData: i}})
+			atomic.AddInt32(&sent, 1)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	// The pipe holds one message in addition to maxLen.
+	if n := atomic.LoadInt32(&sent); int(n) != maxLen+1 {
+		t.Errorf("invalid number of accepted messages: actual=%v want=%v", n,
+			maxLen+1)
+	}
+	if res := drainMsgChannel(q); len(res) != maxLen+2 {
+		t.Errorf("invalid messages: actual=%v want=%v", res, maxLen+2)
+	}
+}
+
+func drainMsgChannel(q *msgChannel) []int {
+	var res []int
+	for {
+		select {
+		case mh := <-q.out():
+			res = append(res, mh.msg.Data().(int))
+		case <-time.After(100 * time.Millisecond):
+			return res
+		}
+	}
+}
+
+func TestMsgChannelReject(t *testing.T) {
+	maxLen := 2
+	q := newBoundedMsgChannel(1, maxLen, OverflowReject)
+	sent := 0
+	for ; sent < 10; sent++ {
+		if err := q.send(msgAndHandler{msg: &msg{MsgData: sent}}); err != nil {
+			if err != ErrQueueFull {
+				t.Fatalf("invalid error: actual=%v want=%v", err, ErrQueueFull)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The pipe holds one message in addition to maxLen.
+	if sent < maxLen || sent > maxLen+1 {
+		t.Errorf("invalid number of accepted messages: %v", sent)
+	}
+	if res := drainMsgChannel(q); len(res) != sent {
+		t.Errorf("invalid messages: actual=%v want=%v", len(res), sent)
+	}
+	if err := q.send(msgAndHandler{msg: &msg{MsgData: sent}}); err != nil {
+		t.Errorf("message is rejected after draining the channel: %v", err)
+	}
+}
+
+func TestMsgChannelDrop(t *testing.T) {
+	n := 100
+	maxLen := 4
+	for _, p := range []OverflowPolicy{OverflowDropOldest, OverflowDropNewest} {
+		q := newBoundedMsgChannel(1, maxLen, p)
+		for i := 0; i < n; i++ {
+			q.send(msgAndHandler{msg: &msg{MsgData: i}})
+		}
+		res := drainMsgChannel(q)
+		// The pipe holds one message in addition to maxLen.
+		if len(res) == 0 || len(res) > maxLen+1 {
+			t.Fatalf("%v: invalid number of messages: %v", p, res)
+		}
+		switch p {
+		case OverflowDropOldest:
+			if res[len(res)-1] != n-1 {
+				t.Errorf("%v: newest message is dropped: %v", p, res)
+			}
+		case OverflowDropNewest:
+			if res[0] != 0 {
+				t.Errorf("%v: oldest message is dropped: %v", p, res)
+			}
+		}
+	}
+}
+
 func TestMsgChannel(t *testing.T) {
 	sent := 1024 * 10
 	ch := newMsgChannel(sent / 10)
-	in := ch.in()
 	for i := 0; i < sent; i++ {
-		in <- msgAndHandler{msg: &msg{MsgData: i}}
+		ch.send(msgAndHandler{msg: &msg{MsgData: i}})
 	}
 	out := ch.out()
 	for i := 0; i < sent; i++ {
@@ -55,9 +220,8 @@ func TestMsgChannelParallel(t *testing.T) {
 	wg.Add(2)
 
 	go func() {
-		in := ch.in()
 		for i := 0; i < sent; i++ {
-			in <- msgAndHandler{msg: &msg{MsgData: i}}
+			ch.send(msgAndHandler{msg: &msg{MsgData: i}})
 		}
 		wg.Done()
 	}()
@@ -86,9 +250,8 @@ func BenchmarkMsgChannel(b *testing.B) {
 
 	b.StartTimer()
 	go func() {
-		in := ch.in()
 		for i := 0; i < sent; i++ {
-			in <- msgAndHandler{}
+			ch.send(msgAndHandler{})
 		}
 		wg.Done()
 	}()
@@ -103,3 +266,85 @@ func BenchmarkMsgChannel(b *testing.B) {
 
 	wg.Wait()
 }
+
+func TestMsgHeadersGob(t *testing.T) {
+	gob.Register(MyMsg(0))
+	m := msg{
+		MsgData:    MyMsg(1),
+		MsgHeaders: map[string]string{"trace": "t1"},
+	}
+	b, err := bhgob.Encode(m)
+	if err != nil {
+		t.Fatalf("cannot encode message: %v", err)
+	}
+	var d msg
+	if err := bhgob.Decode(&d, b); err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+	if d.Headers()["trace"] != "t1" {
+		t.Errorf("invalid headers: actual=%v want=%v", d.Headers(), m.Headers())
+	}
+}
+
+type headerTestReply string
+
+type headerTestHandler struct {
+	ch chan Msg
+}
+
+func (h *headerTestHandler) Rcv(m Msg, ctx RcvContext) error {
+	switch m.Data().(type) {
+	case MyMsg:
+		ctx.SetHeader("tenant", "t")
+		ctx.Emit(headerTestReply("reply"))
+	case headerTestReply:
+		h.ch <- m
+	}
+	return nil
+}
+
+func (h *headerTestHandler) Map(m Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func TestMsgHeadersPropagation(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_headers"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	app := h.NewApp("headers")
+	rcvh := &headerTestHandler{ch: make(chan Msg)}
+	app.Handle(MyMsg(0), rcvh)
+	app.Handle(headerTestReply(""), rcvh)
+	go h.Start()
+	defer h.Stop()
+
+	h.EmitWithHeaders(MyMsg(1), map[string]string{"trace": "t1"})
+	select {
+	case m := <-rcvh.ch:
+		if m.Headers()["trace"] != "t1" || m.Headers()["tenant"] != "t" {
+			t.Errorf("invalid headers: %v", m.Headers())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply is received")
+	}
+}
+
+func TestHandleWithPriority(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_prio"
+	cfg.Addr = newHiveAddrForTest()
+	cfg.InMemory = true
+	h := NewHiveWithConfig(cfg).(*hive)
+	a := h.NewApp("prio")
+	a.HandleWithPriority(MyMsg(0), &testHiveHandler{}, PriorityHigh)
+
+	if p := h.msgPriority(&msg{MsgData: MyMsg(1)}); p != PriorityHigh {
+		t.Errorf("invalid priority: actual=%v want=%v", p, PriorityHigh)
+	}
+	if p := h.msgPriority(&msg{MsgData: 1}); p != PriorityNormal {
+		t.Errorf("invalid priority: actual=%v want=%v", p, PriorityNormal)
+	}
+}
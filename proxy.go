@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
@@ -67,14 +69,33 @@ func (p *proxy) sendBeeRaftNew(buf io.Reader) error {
 	return err
 }
 
-func (p *proxy) sendCmdNew(buf io.Reader) (*http.Response, error) {
-	return p.do("POST", p.cmdURL, "application/x-raft", buf)
+func (p *proxy) sendCmdNew(buf io.Reader, contentType string) (*http.Response,
+	error) {
+
+	return p.do("POST", p.cmdURL, contentType, buf)
 }
 
-func (p *proxy) sendMsgNew(buf io.Reader) error {
-	res, err := p.do("POST", p.msgURL, "application/x-raft", buf)
-	maybeCloseResponse(res)
-	return err
+// errBackpressure is returned when the remote hive accepts only the first
+// accepted messages, and rejects the rest because its queue is full.
+type errBackpressure struct {
+	accepted int
+}
+
+func (e errBackpressure) Error() string {
+	return fmt.Sprintf("remote queue is full (accepted %d messages)", e.accepted)
+}
+
+func (p *proxy) sendMsgNew(buf io.Reader, contentType string) error {
+	res, err := p.do("POST", p.msgURL, contentType, buf)
+	defer maybeCloseResponse(res)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		n, _ := strconv.Atoi(res.Header.Get(serverAcceptedHeader))
+		return errBackpressure{accepted: n}
+	}
+	return nil
 }
 
 func (p *proxy) do(method, urlStr, bodyType string, body io.Reader) (
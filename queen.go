@@ -102,7 +102,9 @@ func (q *qee) newLocalBee(withInitColony bool) (*bee, error) {
 	}
 
 	b := q.defaultLocalBee(info.ID)
-	b.setState(q.app.newState())
+	if err := b.initState(); err != nil {
+		return nil, err
+	}
 	if withInitColony {
 		c := Colony{Leader: info.ID}
 		info.Colony = c
@@ -143,7 +145,9 @@ func (q *qee) newDetachedBee(h DetachedHandler) (*bee, error) {
 	}
 	info.Detached = true
 	b := q.defaultLocalBee(info.ID)
-	b.setState(q.app.newState())
+	if err := b.initState(); err != nil {
+		return nil, err
+	}
 	b.becomeDetached(h)
 	if _, err := q.hive.node.Process(context.TODO(), addBee(info)); err != nil {
 		return nil, err
@@ -289,7 +293,9 @@ func (q *qee) reloadBee(id uint64, col Colony) (*bee, error) {
 		return nil, err
 	}
 	b := q.defaultLocalBee(id)
-	b.setState(q.app.newState())
+	if err := b.initState(); err != nil {
+		return nil, err
+	}
 	b.setColony(info.Colony)
 	if b.isLeader() {
 		b.becomeLeader()
@@ -479,6 +485,12 @@ func (q *qee) lock(b BeeInfo, cells MappedCells) (BeeInfo, error) {
 }
 
 func (q *qee) beeByCells(cells MappedCells) (*bee, error) {
+	// Our copy of the registry may be stale. Catch up with the registry before
+	// routing the message, creating a new bee, or locking the cells through the
+	// raft log. If there is no leader, we can only use our own copy.
+	if err := q.hive.syncRegistry(); err != nil {
+		glog.V(2).Infof("%v looks up cells in a stale registry: %v", q, err)
+	}
 	info, all, err := q.hive.registry.beeForCells(q.app.Name(), cells)
 	if err != nil {
 		return nil, err
@@ -581,10 +593,13 @@ func (q *qee) isLocalBee(info BeeInfo) bool {
 }
 
 func (q *qee) defaultLocalBee(id uint64) *bee {
+	dataCh := newBoundedMsgChannel(q.hive.config.DataChBufSize,
+		q.hive.config.BeeQueueSize, q.hive.config.QueuePolicy)
+	dataCh.prio = q.app.msgPriority
 	return &bee{
 		qee:       q,
 		beeID:     id,
-		dataCh:    newMsgChannel(q.hive.config.DataChBufSize),
+		dataCh:    dataCh,
 		ctrlCh:    make(chan cmdAndChannel, cap(q.ctrlCh)),
 		hive:      q.hive,
 		app:       q.app,
@@ -594,5 +609,7 @@ func (q *qee) defaultLocalBee(id uint64) *bee {
 }
 
 func (q *qee) enqueMsg(mh msgAndHandler) {
-	q.dataCh.in() <- mh
+	if err := q.dataCh.send(mh); err != nil {
+		glog.Errorf("%v drops message %v: %v", q, mh.msg, err)
+	}
 }
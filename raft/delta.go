@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// msgSnapReject is sent by a peer that cannot expand a delta snapshot. The
+// leader sends the whole snapshot to the peer the next time.
+const msgSnapReject = msgTimeoutNow + 1
+
+// deltaSnapshots replaces the snapshots in msgs with their deltas from the
+// last snapshot sent to their receivers.
+func (n *Node) deltaSnapshots(msgs []raftpb.Message) {
+	ds, ok := n.store.(DeltaStore)
+	if !ok {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Type != raftpb.MsgSnap {
+			continue
+		}
+
+		learners, b, err := decodeSnapshot(m.Snapshot.Data)
+		if err != nil {
+			continue
+		}
+		id, ok := ds.SnapshotID(b)
+		if !ok {
+			delete(n.peerSnaps, m.To)
+			continue
+		}
+		if from, ok := n.peerSnaps[m.To]; ok {
+			if d, ok := ds.DeltaSnapshot(b, from); ok {
+				glog.V(2).Infof("%v sends %d bytes of the %d-byte snapshot to %v", n,
+					len(d), len(b), m.To)
+				m.Snapshot.Data = encodeSnapshot(learners, d)
+			}
+		}
+		n.peerSnaps[m.To] = id
+	}
+}
+
+// expandSnapshot rebuilds the snapshot in m if it is a delta. If the snapshot
+// cannot be expanded, it asks the leader to send the whole snapshot and
+// returns false.
+func (n *Node) expandSnapshot(m *raftpb.Message) bool {
+	ds, ok := n.store.(DeltaStore)
+	if !ok {
+		return true
+	}
+
+	learners, b, err := decodeSnapshot(m.Snapshot.Data)
+	if err == nil {
+		b, err = ds.ExpandSnapshot(b)
+	}
+	if err != nil {
+		glog.Warningf("%v cannot expand the snapshot of %v: %v", n, m.From, err)
+		n.send([]raftpb.Message{{
+			Type: msgSnapReject,
+			To:   m.From,
+			From: n.id,
+			Term: m.Term,
+		}})
+		return false
+	}
+	m.Snapshot.Data = encodeSnapshot(learners, b)
+	return true
+}
+
+// stepSnapReject makes the leader send the whole snapshot to the peer next
+// time.
+func (n *Node) stepSnapReject(m raftpb.Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.peerSnaps, m.From)
+}
@@ -0,0 +1,112 @@
+package raft
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/state"
+)
+
+type testDeltaStore struct {
+	testStore
+	s *state.Incremental
+}
+
+func newTestDeltaStore() *testDeltaStore {
+	return &testDeltaStore{s: state.NewIncremental(state.NewInMem())}
+}
+
+func (d *testDeltaStore) Save() ([]byte, error)  { return d.s.Save() }
+func (d *testDeltaStore) Restore(b []byte) error { return d.s.Restore(b) }
+
+func (d *testDeltaStore) SnapshotID(b []byte) (uint64, bool) {
+	return state.SnapshotID(b)
+}
+
+func (d *testDeltaStore) DeltaSnapshot(b []byte, from uint64) ([]byte, bool) {
+	return state.DeltaSnapshot(b, from)
+}
+
+func (d *testDeltaStore) ExpandSnapshot(b []byte) ([]byte, error) {
+	return d.s.ExpandSnapshot(b)
+}
+
+func TestDeltaSnapshots(t *testing.T) {
+	ls := newTestDeltaStore()
+	leader := &Node{id: 1, store: ls, peerSnaps: make(map[uint64]uint64)}
+	var rejects []raftpb.Message
+	newFollower := func(id uint64) *Node {
+		return &Node{
+			id:    id,
+			store: newTestDeltaStore(),
+			send: func(msgs []raftpb.Message) {
+				rejects = append(rejects, msgs...)
+			},
+		}
+	}
+	f2 := newFollower(2)
+	f3 := newFollower(3)
+
+	snap := func(to uint64) raftpb.Message {
+		b, err := ls.Save()
+		if err != nil {
+			t.Fatalf("cannot save: %v", err)
+		}
+		msgs := []raftpb.Message{{
+			Type:     raftpb.MsgSnap,
+			To:       to,
+			From:     1,
+			Snapshot: raftpb.Snapshot{Data: encodeSnapshot([]uint64{4}, b)},
+		}}
+		leader.deltaSnapshots(msgs)
+		return msgs[0]
+	}
+
+	ls.s.Dict("d").Put("k1", bytes.Repeat([]byte{'v'}, 1024))
+	m := snap(2)
+	full := len(m.Snapshot.Data)
+	if !f2.expandSnapshot(&m) {
+		t.Fatal("follower cannot expand the full snapshot")
+	}
+	if err := f2.restoreSnapshot(m.Snapshot.Data); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+	// The snapshot sent to node 3 is lost.
+	snap(3)
+
+	ls.s.Dict("d").Put("k2", []byte("v2"))
+	m = snap(2)
+	if len(m.Snapshot.Data) >= full/4 {
+		t.Errorf("delta snapshot is not smaller: delta=%d full=%d",
+			len(m.Snapshot.Data), full)
+	}
+	if !f2.expandSnapshot(&m) {
+		t.Fatal("follower cannot expand the delta snapshot")
+	}
+	if err := f2.restoreSnapshot(m.Snapshot.Data); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+	v, _ := f2.store.(*testDeltaStore).s.Dict("d").Get("k2")
+	if !bytes.Equal(v, []byte("v2")) {
+		t.Errorf("invalid value: actual=%s want=v2", v)
+	}
+	if len(f2.learners) != 1 || f2.learners[0] != 4 {
+		t.Errorf("invalid learners: actual=%v want=[4]", f2.learners)
+	}
+
+	m = snap(3)
+	if f3.expandSnapshot(&m) {
+		t.Fatal("follower expands a delta of an unknown snapshot")
+	}
+	if len(rejects) != 1 || rejects[0].Type != msgSnapReject ||
+		rejects[0].To != 1 {
+
+		t.Fatalf("invalid reject messages: %v", rejects)
+	}
+	leader.stepSnapReject(rejects[0])
+	m = snap(3)
+	if !f3.expandSnapshot(&m) {
+		t.Error("follower cannot expand the full snapshot")
+	}
+}
@@ -0,0 +1,269 @@
+package raft
+
+import (
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ConfChangeAddLearnerNode is the type of the conf changes that add learners,
+// as seen by stores. etcd raft has no learners: learners are added using
+// ConfChangeUpdateNode, which does not change the voters of etcd raft, and are
+// tracked and replicated to by Node.
+const ConfChangeAddLearnerNode raftpb.ConfChangeType = 3
+
+// maxLearnerEntries is the maximum number of entries sent to a learner in one
+// message.
+const maxLearnerEntries = 256
+
+// learnerInfo is the context of the conf changes that add learners.
+type learnerInfo NodeInfo
+
+// learnerProgress is the replication progress of a learner on the leader.
+type learnerProgress struct {
+	match uint64
+	next  uint64
+	snap  bool // whether the learner is sent a snapshot.
+	ticks int  // ticks since the last message to the learner.
+}
+
+// AddLearner adds a node that replicates the log of the group but does not
+// vote. The learner is promoted to a voter once it is within the learner lag of
+// the leader, so that a new member does not stall the quorum while it catches
+// up.
+func (n *Node) AddLearner(ctx context.Context, id uint64, addr string) error {
+	cc := raftpb.ConfChange{
+		ID:     0,
+		Type:   raftpb.ConfChangeUpdateNode,
+		NodeID: id,
+	}
+	return n.processConfChange(ctx, cc, learnerInfo{ID: id, Addr: addr})
+}
+
+// updateLearners updates the learners after a conf change of type t for node
+// id is applied.
+func (n *Node) updateLearners(t raftpb.ConfChangeType, id uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch t {
+	case ConfChangeAddLearnerNode:
+		n.learners = append(n.learners, id)
+		return
+	case raftpb.ConfChangeAddNode, raftpb.ConfChangeRemoveNode:
+		for i, l := range n.learners {
+			if l == id {
+				n.learners = append(n.learners[:i], n.learners[i+1:]...)
+				break
+			}
+		}
+		delete(n.learnerPrs, id)
+	}
+}
+
+// tickLearners replicates the log to the learners, on every heartbeat, and
+// promotes the learners that have caught up. Promotions that fail are retried
+// on the next tick.
+func (n *Node) tickLearners() {
+	n.mu.Lock()
+	if n.lead != n.id {
+		n.mu.Unlock()
+		return
+	}
+	var msgs []raftpb.Message
+	for _, id := range n.learners {
+		pr := n.learnerProgress(id)
+		n.maybePromote(id, pr)
+		// Snapshots are resent if the learner does not respond within an
+		// election timeout.
+		pr.ticks++
+		if pr.ticks < n.heartbeat || (pr.snap && pr.ticks < n.election) {
+			continue
+		}
+		if m, ok := n.learnerMsg(id, pr); ok {
+			msgs = append(msgs, m)
+		}
+	}
+	n.mu.Unlock()
+
+	n.sendLearners(msgs)
+}
+
+// learnerProgress returns the progress of the learner. The progress is reset
+// when the leader changes. n.mu must be locked.
+func (n *Node) learnerProgress(id uint64) *learnerProgress {
+	pr, ok := n.learnerPrs[id]
+	if !ok {
+		last, _ := n.raftStorage.LastIndex()
+		pr = &learnerProgress{next: last + 1}
+		n.learnerPrs[id] = pr
+	}
+	return pr
+}
+
+// learnerMsg returns the entries of the log after the progress of the learner,
+// or the snapshot of the leader if those entries are compacted. n.mu must be
+// locked.
+func (n *Node) learnerMsg(id uint64, pr *learnerProgress) (raftpb.Message,
+	bool) {
+
+	pr.ticks = 0
+	m := raftpb.Message{
+		To:   id,
+		From: n.id,
+		Term: n.term,
+	}
+
+	first, _ := n.raftStorage.FirstIndex()
+	last, _ := n.raftStorage.LastIndex()
+	term, err := n.raftStorage.Term(pr.next - 1)
+	if pr.next < first || err != nil {
+		snap, err := n.raftStorage.Snapshot()
+		if err != nil || etcdraft.IsEmptySnap(snap) {
+			glog.Errorf("%v cannot send snapshot to learner %v: %v", n, id, err)
+			return m, false
+		}
+		pr.snap = true
+		m.Type = raftpb.MsgSnap
+		m.Snapshot = snap
+		return m, true
+	}
+
+	pr.snap = false
+	m.Type = raftpb.MsgApp
+	m.LogTerm = term
+	m.Index = pr.next - 1
+	m.Commit = n.commit
+	if pr.next <= last {
+		hi := last + 1
+		if hi > pr.next+maxLearnerEntries {
+			hi = pr.next + maxLearnerEntries
+		}
+		if m.Entries, err = n.raftStorage.Entries(pr.next, hi); err != nil {
+			glog.Errorf("%v cannot send entries to learner %v: %v", n, id, err)
+			return m, false
+		}
+	}
+	return m, true
+}
+
+// sendLearners sends the messages to the learners in the background.
+func (n *Node) sendLearners(msgs []raftpb.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	go func() {
+		n.deltaSnapshots(msgs)
+		n.send(msgs)
+	}()
+}
+
+// stepLearnerResp updates the progress of the learner from its response to
+// the leader, and sends it the next entries. The responses of learners are
+// not stepped into etcd raft, since learners are not its members. It returns
+// whether m is from a learner.
+func (n *Node) stepLearnerResp(m raftpb.Message) bool {
+	n.mu.Lock()
+	if !containsNode(n.learners, m.From) {
+		n.mu.Unlock()
+		return false
+	}
+	if n.lead != n.id || m.Term != n.term {
+		n.mu.Unlock()
+		return true
+	}
+
+	pr := n.learnerProgress(m.From)
+	if m.Reject {
+		if m.Index != pr.next-1 {
+			// A stale rejection.
+			n.mu.Unlock()
+			return true
+		}
+		// Find the last entry that matches the log of the learner. The log of a
+		// new learner is empty, so we go back to the first entry in the log of
+		// the leader, and then to the snapshot.
+		first, _ := n.raftStorage.FirstIndex()
+		switch {
+		case pr.match != 0:
+			pr.next = pr.match + 1
+		case m.Index > first:
+			pr.next = first
+		default:
+			pr.next = m.Index
+		}
+	} else {
+		if m.Index > pr.match {
+			pr.match = m.Index
+		}
+		if m.Index+1 > pr.next {
+			pr.next = m.Index + 1
+		}
+		n.maybePromote(m.From, pr)
+	}
+
+	var msgs []raftpb.Message
+	last, _ := n.raftStorage.LastIndex()
+	if m.Reject || pr.next <= last {
+		if msg, ok := n.learnerMsg(m.From, pr); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	n.mu.Unlock()
+
+	n.sendLearners(msgs)
+	return true
+}
+
+// maybePromote promotes the learner if it has caught up with the leader.
+// Since etcd raft accepts only one pending configuration change, learners are
+// promoted one at a time. n.mu must be locked.
+func (n *Node) maybePromote(id uint64, pr *learnerProgress) {
+	if n.promoting || pr.match == 0 || pr.match+n.learnerLag < n.commit ||
+		n.hasPendingConfChange() {
+		return
+	}
+
+	n.promoting = true
+	go func() {
+		glog.V(2).Infof("%v promotes learner %v", n, id)
+		ctx, ccl := context.WithTimeout(context.Background(), leaderReadTimeout)
+		defer ccl()
+		cc := raftpb.ConfChange{
+			ID:     0,
+			Type:   raftpb.ConfChangeAddNode,
+			NodeID: id,
+		}
+		if err := n.ProcessConfChange(ctx, cc, NodeInfo{ID: id}); err != nil {
+			glog.Errorf("%v cannot promote learner %v: %v", n, id, err)
+		} else {
+			// etcd raft replicates to the new voter only when there is a new
+			// entry. Propose an empty one so that it learns it is promoted.
+			n.node.Propose(ctx, nil)
+		}
+		n.mu.Lock()
+		n.promoting = false
+		n.mu.Unlock()
+	}()
+}
+
+// hasPendingConfChange returns whether there is a configuration change in the
+// log that is not applied yet. etcd raft drops the configuration changes
+// proposed while another one is pending. n.mu must be locked.
+func (n *Node) hasPendingConfChange() bool {
+	last, err := n.raftStorage.LastIndex()
+	if err != nil || last <= n.applied {
+		return false
+	}
+	es, err := n.raftStorage.Entries(n.applied+1, last+1)
+	if err != nil {
+		return true
+	}
+	for _, e := range es {
+		if e.Type == raftpb.EntryConfChange {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package raft
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestLearnerPromotion(t *testing.T) {
+	dir := "/tmp/bhtest_raft_learner"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := startTestCluster(t, dir, 2)
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+	for _, req := range []string{"a", "b"} {
+		if _, err := c.nodes[1].Process(ctx, req); err != nil {
+			t.Fatalf("cannot process request: %v", err)
+		}
+	}
+
+	c.addNode(dir, 3)
+	if err := c.nodes[1].AddLearner(ctx, 3, ""); err != nil {
+		t.Fatalf("cannot add learner: %v", err)
+	}
+	if err := c.nodes[1].AddLearner(ctx, 3, ""); err == nil {
+		t.Errorf("no error for a duplicate learner")
+	}
+
+	if err := c.nodes[1].WaitVoter(ctx, 3); err != nil {
+		t.Fatalf("learner is not promoted: %v", err)
+	}
+	if _, err := c.nodes[1].Process(ctx, "c"); err != nil {
+		t.Fatalf("cannot process request: %v", err)
+	}
+	if err := c.nodes[3].LinearizableRead(ctx); err != nil {
+		t.Fatalf("error in linearizable read: %v", err)
+	}
+	if l := c.stores[3].last(); l != "c" {
+		t.Errorf("invalid store for the learner: actual=%v want=c", l)
+	}
+}
+
+func TestLearnerFromSnapshot(t *testing.T) {
+	dir := "/tmp/bhtest_raft_learner_snap"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := &testCluster{
+		nodes:  make(map[uint64]*Node),
+		stores: make(map[uint64]*testStore),
+	}
+	peers := []etcdraft.Peer{NodeInfo{ID: 1}.Peer()}
+	c.newNode(dir, 1, peers, SnapshotEntries(2))
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+	for _, req := range []string{"a", "b", "c", "d"} {
+		if _, err := c.nodes[1].Process(ctx, req); err != nil {
+			t.Fatalf("cannot process request: %v", err)
+		}
+	}
+	if i := snapIndex(t, c.nodes[1]); i == 0 {
+		t.Fatalf("node is not snapshotted")
+	}
+
+	// The learner receives the snapshot of the leader, and is promoted on the
+	// ticks of the leader without any new requests.
+	c.addNode(dir, 2)
+	if err := c.nodes[1].AddLearner(ctx, 2, ""); err != nil {
+		t.Fatalf("cannot add learner: %v", err)
+	}
+	if err := c.nodes[1].WaitVoter(ctx, 2); err != nil {
+		t.Fatalf("learner is not promoted: %v", err)
+	}
+	if _, err := c.nodes[1].Process(ctx, "e"); err != nil {
+		t.Fatalf("cannot process request: %v", err)
+	}
+	if err := c.nodes[2].LinearizableRead(ctx); err != nil {
+		t.Fatalf("error in linearizable read: %v", err)
+	}
+	if l := c.stores[2].last(); l != "e" {
+		t.Errorf("invalid store for the learner: actual=%v want=e", l)
+	}
+}
@@ -0,0 +1,155 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/snap"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/wal"
+)
+
+// LoadStore loads the store of a stopped raft node from its data directory,
+// without starting the node. The store is restored from the latest snapshot
+// of the node, and then the committed requests after that snapshot are
+// applied to the store. Configuration changes are not applied.
+//
+// The requests are decoded using gob, so the types of the requests must be
+// registered. LoadStore returns an error if the node is still running.
+func LoadStore(datadir string, store Store) error {
+	var index uint64
+	snapshot, err := snap.New(path.Join(datadir, "snap")).Load()
+	switch {
+	case err == nil:
+		_, d, err := decodeSnapshot(snapshot.Data)
+		if err == nil {
+			err = store.Restore(d)
+		}
+		if err != nil {
+			return fmt.Errorf("raft: cannot restore snapshot: %v", err)
+		}
+		index = snapshot.Metadata.Index
+	case err != snap.ErrNoSnapshot:
+		return err
+	}
+
+	waldir := path.Join(datadir, "wal")
+	if !wal.Exist(waldir) {
+		return nil
+	}
+	w, err := wal.Open(waldir, index+1)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	_, st, ents, err := w.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range ents {
+		if e.Index > st.Commit {
+			break
+		}
+		if e.Type != raftpb.EntryNormal || len(e.Data) == 0 {
+			continue
+		}
+		var req Request
+		if err := req.Decode(e.Data); err != nil {
+			return fmt.Errorf("raft: cannot decode entry %v: %v", e.Index, err)
+		}
+		if req.Data == nil {
+			continue
+		}
+		if _, err := store.Apply(req.Data); err != nil {
+			return fmt.Errorf("raft: cannot apply entry %v: %v", e.Index, err)
+		}
+	}
+	return nil
+}
+
+// ErrReplicatedNode is returned when a request is appended to the log of a
+// stopped node that is not the only member of its group.
+var ErrReplicatedNode = errors.New("raft: node is not the only member of its group")
+
+// AppendRequest appends req to the log of a stopped raft node as a committed
+// entry, which is applied to the store of the node when it restarts. Since the
+// entry is not replicated, only the logs of nodes that are the only member of
+// their group can be appended to. Otherwise, AppendRequest returns
+// ErrReplicatedNode.
+func AppendRequest(datadir string, req interface{}) error {
+	var index uint64
+	var members map[uint64]bool
+	snapshot, err := snap.New(path.Join(datadir, "snap")).Load()
+	switch {
+	case err == nil:
+		index = snapshot.Metadata.Index
+		members = make(map[uint64]bool)
+		for _, id := range snapshot.Metadata.ConfState.Nodes {
+			members[id] = true
+		}
+		learners, _, err := decodeSnapshot(snapshot.Data)
+		if err != nil {
+			return err
+		}
+		for _, id := range learners {
+			members[id] = true
+		}
+	case err == snap.ErrNoSnapshot:
+		members = make(map[uint64]bool)
+	default:
+		return err
+	}
+
+	w, err := wal.Open(path.Join(datadir, "wal"), index+1)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	md, st, ents, err := w.ReadAll()
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(string(md), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	last := index
+	for _, e := range ents {
+		last = e.Index
+		if e.Type != raftpb.EntryConfChange {
+			continue
+		}
+		var cc raftpb.ConfChange
+		if err := cc.Unmarshal(e.Data); err != nil {
+			return fmt.Errorf("raft: cannot decode entry %v: %v", e.Index, err)
+		}
+		switch cc.Type {
+		case raftpb.ConfChangeAddNode, raftpb.ConfChangeUpdateNode:
+			// Learners are added using ConfChangeUpdateNode.
+			members[cc.NodeID] = true
+		case raftpb.ConfChangeRemoveNode:
+			delete(members, cc.NodeID)
+		}
+	}
+	if len(members) != 1 || !members[id] {
+		return ErrReplicatedNode
+	}
+
+	r := Request{Data: req}
+	b, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	e := raftpb.Entry{
+		Term:  st.Term,
+		Index: last + 1,
+		Type:  raftpb.EntryNormal,
+		Data:  b,
+	}
+	st.Commit = e.Index
+	return w.Save(st, []raftpb.Entry{e})
+}
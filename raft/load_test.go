@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestAppendRequest(t *testing.T) {
+	dir := "/tmp/bhtest_raft_append"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := &testCluster{
+		nodes:  make(map[uint64]*Node),
+		stores: make(map[uint64]*testStore),
+	}
+	peers := []etcdraft.Peer{NodeInfo{ID: 1}.Peer()}
+	c.newNode(dir, 1, peers, nil)
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+	if _, err := c.nodes[1].Process(ctx, "a"); err != nil {
+		t.Fatalf("cannot process request: %v", err)
+	}
+	c.stop()
+
+	datadir := fmt.Sprintf("%s/1", dir)
+	if err := AppendRequest(datadir, "b"); err != nil {
+		t.Fatalf("cannot append request: %v", err)
+	}
+	s := &testStore{}
+	if err := LoadStore(datadir, s); err != nil {
+		t.Fatalf("cannot load store: %v", err)
+	}
+	if l := s.last(); l != "b" {
+		t.Errorf("invalid last request: actual=%v want=b", l)
+	}
+}
+
+func TestAppendRequestReplicated(t *testing.T) {
+	dir := "/tmp/bhtest_raft_append_repl"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := startTestCluster(t, dir, 2)
+	c.stop()
+	if err := AppendRequest(fmt.Sprintf("%s/1", dir), "b"); err !=
+		ErrReplicatedNode {
+
+		t.Errorf("invalid error: actual=%v want=%v", err, ErrReplicatedNode)
+	}
+}
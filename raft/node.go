@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/pkg/pbutil"
@@ -63,35 +64,122 @@ type Node struct {
 	store       Store
 	raftStorage *etcdraft.MemoryStorage
 	storage     Storage
-	snapCount   uint64
+	snapPolicy  SnapshotPolicy
+	learnerLag  uint64
+	election    int
+	heartbeat   int
 
 	send SendFunc
 
 	ticker <-chan time.Time
 	stop   chan struct{}
 	done   chan struct{}
+
+	// The status of the node used for linearizable reads.
+	mu           sync.Mutex
+	term         uint64
+	lead         uint64
+	commit       uint64
+	applied      uint64
+	appliedTerm  uint64
+	appliedc     chan struct{}
+	leadc        chan struct{}
+	members      []uint64
+	learners     []uint64
+	learnerPrs   map[uint64]*learnerProgress // the progress of the learners.
+	promoting    bool                        // whether a learner is being promoted.
+	peerSnaps    map[uint64]uint64           // the last snapshot sent to each peer.
+	transfer     *leaderTransfer             // the ongoing leadership transfer.
+	transferTerm uint64                      // the last term we campaigned to take over.
+	readSeq      uint64
+	read         *leaderRead       // the current round of read probes.
+	readBatch    []chan readResult // the reads waiting for the next round.
+	indexReqs    map[uint64]chan readResult
+	snapReqs     []chan struct{}
 }
 
 func init() {
 	gob.Register(NodeInfo{})
+	gob.Register(learnerInfo{})
 	gob.Register(RequestID{})
 	gob.Register(Request{})
 	gob.Register(Response{})
 }
 
+// NewNode creates and starts a raft node. The node stores its log and
+// snapshots under datadir, and restarts from them if they exist. If datadir is
+// empty, the node is kept in memory and is lost when it stops.
 func NewNode(name string, id uint64, peers []etcdraft.Peer, send SendFunc,
-	listener StatusListener, datadir string, store Store, snapCount uint64,
-	ticker <-chan time.Time, election, heartbeat int) *Node {
+	listener StatusListener, datadir string, store Store,
+	snapPolicy SnapshotPolicy, learnerLag uint64, ticker <-chan time.Time,
+	election, heartbeat int) *Node {
 
 	glog.V(2).Infof("creating a new raft node %v (%v) with peers %v", id, name,
 		peers)
 
+	if snapPolicy == nil {
+		snapPolicy = DefaultSnapshotPolicy
+	}
+
+	var lastSeq uint64
+	var n etcdraft.Node
+	var s *etcdraft.MemoryStorage
+	var storage Storage
+	if datadir == "" {
+		if id == 0 {
+			glog.Fatal("raft: node id cannot be 0")
+		}
+
+		glog.V(2).Infof("starting in-memory node %v (%v)", id, name)
+		s = etcdraft.NewMemoryStorage()
+		n = etcdraft.StartNode(id, peers, election, heartbeat, s)
+		storage = NewMemStorage()
+	} else {
+		n, s, storage, lastSeq = startDiskNode(name, id, peers, datadir, store,
+			election, heartbeat)
+	}
+
+	node := &Node{
+		name:        name,
+		id:          id,
+		node:        n,
+		gen:         gen.NewSeqIDGen(lastSeq), // avoid collisions.
+		listener:    listener,
+		store:       store,
+		raftStorage: s,
+		storage:     storage,
+		snapPolicy:  snapPolicy,
+		learnerLag:  learnerLag,
+		election:    election,
+		heartbeat:   heartbeat,
+		send:        send,
+		ticker:      ticker,
+		done:        make(chan struct{}),
+		stop:        make(chan struct{}),
+		appliedc:    make(chan struct{}),
+		leadc:       make(chan struct{}),
+		indexReqs:   make(map[uint64]chan readResult),
+		learnerPrs:  make(map[uint64]*learnerProgress),
+		peerSnaps:   make(map[uint64]uint64),
+	}
+	node.line.init()
+	go node.Start()
+	return node
+}
+
+// startDiskNode starts or restarts a node whose log and snapshots are stored
+// under datadir. It also returns the sequence after which the node should
+// generate its request IDs.
+func startDiskNode(name string, id uint64, peers []etcdraft.Peer,
+	datadir string, store Store, election, heartbeat int) (etcdraft.Node,
+	*etcdraft.MemoryStorage, Storage, uint64) {
+
 	snapdir := path.Join(datadir, "snap")
 	if err := os.MkdirAll(snapdir, 0700); err != nil {
 		glog.Fatal("raft: cannot create snapshot directory")
 	}
 
-	var lastIndex uint64
+	var lastSeq uint64
 	var n etcdraft.Node
 	var s *etcdraft.MemoryStorage
 	ss := snap.New(snapdir)
@@ -120,7 +208,11 @@ func NewNode(name string, id uint64, peers []etcdraft.Peer, send SendFunc,
 		}
 
 		if snapshot != nil {
-			if err := store.Restore(snapshot.Data); err != nil {
+			_, d, err := decodeSnapshot(snapshot.Data)
+			if err == nil {
+				err = store.Restore(d)
+			}
+			if err != nil {
 				glog.Fatalf("cannot restore snapshot: %v", err)
 			}
 			glog.Infof("restarting from snapshot at index %d",
@@ -153,27 +245,40 @@ func NewNode(name string, id uint64, peers []etcdraft.Peer, send SendFunc,
 		s.SetHardState(st)
 		s.Append(ents)
 		n = etcdraft.RestartNode(id, election, heartbeat, s)
-		lastIndex = ents[len(ents)-1].Index
+		lastSeq, _ = s.LastIndex()
+		if seq := lastRequestSeq(id, ents); seq > lastSeq {
+			lastSeq = seq
+		}
 	}
 
-	node := &Node{
-		name:        name,
-		id:          id,
-		node:        n,
-		gen:         gen.NewSeqIDGen(lastIndex + 2*snapCount), // avoid collisions.
-		listener:    listener,
-		store:       store,
-		raftStorage: s,
-		storage:     NewStorage(w, ss),
-		snapCount:   snapCount,
-		send:        send,
-		ticker:      ticker,
-		done:        make(chan struct{}),
-		stop:        make(chan struct{}),
+	return n, s, NewStorage(w, ss), lastSeq
+}
+
+// lastRequestSeq returns the largest sequence of the requests proposed by node
+// id in the entries replayed from the WAL. These entries are applied again
+// after a restart, and new requests must not be answered by them.
+func lastRequestSeq(id uint64, ents []raftpb.Entry) uint64 {
+	var seq uint64
+	for _, e := range ents {
+		b := e.Data
+		if e.Type == raftpb.EntryConfChange {
+			var cc raftpb.ConfChange
+			if err := cc.Unmarshal(e.Data); err != nil {
+				continue
+			}
+			b = cc.Context
+		}
+		// Only decode the ID, since the types of the requests may not be
+		// registered yet.
+		var req struct{ ID RequestID }
+		if len(b) == 0 || bhgob.Decode(&req, b) != nil || req.ID.NodeID != id {
+			continue
+		}
+		if req.ID.Seq > seq {
+			seq = req.ID.Seq
+		}
 	}
-	node.line.init()
-	go node.Start()
-	return node
+	return seq
 }
 
 func (n *Node) genID() RequestID {
@@ -184,9 +289,20 @@ func (n *Node) genID() RequestID {
 }
 
 // Process processes the request and returns the response. It is blocking.
+// While the node is transferring its leadership, the request is proposed once
+// the transfer is over.
 func (n *Node) Process(ctx context.Context, req interface{}) (interface{},
 	error) {
 
+	if err := n.waitTransfer(ctx); err != nil {
+		return nil, err
+	}
+	return n.process(ctx, req)
+}
+
+func (n *Node) process(ctx context.Context, req interface{}) (interface{},
+	error) {
+
 	r := Request{
 		ID:   n.genID(),
 		Data: req,
@@ -233,9 +349,21 @@ func (n *Node) RemoveNode(ctx context.Context, id uint64, addr string) error {
 func (n *Node) ProcessConfChange(ctx context.Context, cc raftpb.ConfChange,
 	info NodeInfo) error {
 
+	return n.processConfChange(ctx, cc, info)
+}
+
+// processConfChange proposes the conf change with data in its context, which
+// is either a NodeInfo or a learnerInfo.
+func (n *Node) processConfChange(ctx context.Context, cc raftpb.ConfChange,
+	data interface{}) error {
+
+	if err := n.waitTransfer(ctx); err != nil {
+		return err
+	}
+
 	r := Request{
 		ID:   n.genID(),
-		Data: info,
+		Data: data,
 	}
 	var err error
 	cc.Context, err = r.Encode()
@@ -270,6 +398,8 @@ func (n *Node) applyEntry(e raftpb.Entry) {
 	}
 
 	if req.Data == nil {
+		// Empty requests are used as barriers.
+		n.line.call(Response{ID: req.ID})
 		return
 	}
 	res := Response{
@@ -288,24 +418,32 @@ func containsNode(nodes []uint64, node uint64) bool {
 	return false
 }
 
-func (n *Node) validConfChange(cc raftpb.ConfChange,
+// validConfChange validates the conf change of type t for node id. Learners
+// are tracked by the node, since etcd raft has no learners. n.mu must be
+// locked.
+func (n *Node) validConfChange(t raftpb.ConfChangeType, id uint64,
 	confs *raftpb.ConfState) error {
 
-	if cc.NodeID == etcdraft.None {
+	if id == etcdraft.None {
 		return errors.New("node id is nil")
 	}
 
-	switch cc.Type {
+	switch t {
 	case raftpb.ConfChangeAddNode:
-		if containsNode(confs.Nodes, cc.NodeID) {
-			return fmt.Errorf("%v is duplicate", cc.NodeID)
+		// Adding a learner promotes it to a voter.
+		if containsNode(confs.Nodes, id) {
+			return fmt.Errorf("%v is duplicate", id)
+		}
+	case ConfChangeAddLearnerNode:
+		if containsNode(confs.Nodes, id) || containsNode(n.learners, id) {
+			return fmt.Errorf("%v is duplicate", id)
 		}
 	case raftpb.ConfChangeRemoveNode:
-		if !containsNode(confs.Nodes, cc.NodeID) {
-			return fmt.Errorf("no such node %v", cc.NodeID)
+		if !containsNode(confs.Nodes, id) && !containsNode(n.learners, id) {
+			return fmt.Errorf("no such node %v", id)
 		}
 	default:
-		glog.Fatalf("invalid ConfChange type %v", cc.Type)
+		glog.Fatalf("invalid ConfChange type %v", t)
 	}
 	return nil
 }
@@ -315,39 +453,58 @@ func (n *Node) applyConfChange(e raftpb.Entry, confs *raftpb.ConfState) error {
 	pbutil.MustUnmarshal(&cc, e.Data)
 	glog.V(2).Infof("%v applies conf change %v: %#v", n, e.Index, cc)
 
-	if err := n.validConfChange(cc, confs); err != nil {
+	// The context is either the node info of an initial peer, or the request of
+	// a proposed conf change.
+	var info NodeInfo
+	var req *Request
+	if len(cc.Context) != 0 {
+		if err := bhgob.Decode(&info, cc.Context); err != nil {
+			req = &Request{}
+			if err := req.Decode(cc.Context); err != nil {
+				glog.Fatalf("raftserver: cannot decode context (%v)", err)
+			}
+		}
+	}
+
+	// Learners are added as ConfChangeUpdateNode, which does not change the
+	// voters of etcd raft.
+	t := cc.Type
+	if req != nil {
+		switch d := req.Data.(type) {
+		case NodeInfo:
+			info = d
+		case learnerInfo:
+			info = NodeInfo(d)
+			t = ConfChangeAddLearnerNode
+		}
+	}
+	if req == nil && len(cc.Context) != 0 && info.ID != cc.NodeID {
+		glog.Fatalf("invalid config change: %v != %v", info.ID, cc.NodeID)
+	}
+
+	n.mu.Lock()
+	err := n.validConfChange(t, cc.NodeID, confs)
+	n.mu.Unlock()
+	if err != nil {
 		glog.Errorf("%v received an invalid conf change for node %v: %v",
 			n, cc.NodeID, err)
 		cc.NodeID = etcdraft.None
 		n.node.ApplyConfChange(cc)
+		// Wake up the proposer, if it is waiting on this node.
+		if req != nil {
+			n.line.call(Response{ID: req.ID, Err: err})
+		}
 		return err
 	}
 
 	*confs = *n.node.ApplyConfChange(cc)
-	if len(cc.Context) == 0 {
-		n.store.ApplyConfChange(cc, NodeInfo{})
-		return nil
-	}
-
-	var info NodeInfo
-	if err := bhgob.Decode(&info, cc.Context); err == nil {
-		if info.ID != cc.NodeID {
-			glog.Fatalf("invalid config change: %v != %v", info.ID, cc.NodeID)
-		}
-		n.store.ApplyConfChange(cc, info)
-		return nil
-	}
+	n.updateLearners(t, cc.NodeID)
 
-	var req Request
-	if err := req.Decode(cc.Context); err != nil {
-		// It should be either a node info or a request.
-		glog.Fatalf("raftserver: cannot decode context (%v)", err)
-	}
-	res := Response{
-		ID: req.ID,
+	cc.Type = t
+	err = n.store.ApplyConfChange(cc, info)
+	if req != nil {
+		n.line.call(Response{ID: req.ID, Err: err})
 	}
-	res.Err = n.store.ApplyConfChange(cc, req.Data.(NodeInfo))
-	n.line.call(res)
 	return nil
 }
 
@@ -360,13 +517,26 @@ func (n *Node) Start() {
 	}
 
 	snapi := snap.Metadata.Index
+	snapt := time.Now()
+	var walBytes uint64
 	appliedi := snap.Metadata.Index
 	confState := snap.Metadata.ConfState
+	n.updateApplied(appliedi, snap.Metadata.Term, confState)
+	if l, _, err := decodeSnapshot(snap.Data); err == nil {
+		n.mu.Lock()
+		n.learners = l
+		n.mu.Unlock()
+	}
 
 	var prevss *etcdraft.SoftState
 	var shouldStop bool
 
+	// The update in progress must finish before the storage is closed.
+	stopping := make(chan struct{})
+	var updating sync.WaitGroup
 	defer func() {
+		close(stopping)
+		updating.Wait()
 		n.node.Stop()
 		if err := n.storage.Close(); err != nil {
 			glog.Fatalf("error in storage close: %v", err)
@@ -380,6 +550,9 @@ func (n *Node) Start() {
 		select {
 		case <-n.ticker:
 			n.node.Tick()
+			n.tickRead()
+			n.tickTransfer()
+			n.tickLearners()
 
 		case <-adv:
 			ready = n.node.Ready()
@@ -387,7 +560,9 @@ func (n *Node) Start() {
 
 		case rd := <-ready:
 			ready = nil
+			updating.Add(1)
 			go func(rd etcdraft.Ready) {
+				defer updating.Done()
 				if rd.SoftState != nil {
 					if prevss != nil && prevss.Lead != rd.SoftState.Lead {
 						n.listener.ProcessStatusChange(LeaderChanged{
@@ -397,6 +572,9 @@ func (n *Node) Start() {
 					}
 					prevss = rd.SoftState
 				}
+				// The listener should observe the leader change before the callers of
+				// TransferLeadership.
+				n.updateStatus(rd)
 
 				empty := etcdraft.IsEmptySnap(rd.Snapshot)
 
@@ -407,6 +585,8 @@ func (n *Node) Start() {
 					}
 					n.raftStorage.ApplySnapshot(rd.Snapshot)
 					snapi = rd.Snapshot.Metadata.Index
+					snapt = time.Now()
+					walBytes = 0
 					glog.Infof("saved incoming snapshot at index %d", snapi)
 				}
 
@@ -414,16 +594,22 @@ func (n *Node) Start() {
 					glog.Fatalf("err in raft storage save: %v", err)
 				}
 				n.raftStorage.Append(rd.Entries)
+				for _, e := range rd.Entries {
+					walBytes += uint64(e.Size())
+				}
 
+				n.deltaSnapshots(rd.Messages)
 				n.send(rd.Messages)
 
 				// Recover from snapshot if it is more recent than the currently applied.
 				if !empty && rd.Snapshot.Metadata.Index > appliedi {
-					if err := n.store.Restore(rd.Snapshot.Data); err != nil {
+					if err := n.restoreSnapshot(rd.Snapshot.Data); err != nil {
 						glog.Fatalf("error in store recovery: %v", err)
 					}
 					// FIXME(soheil): update the nodes and notify the application?
 					appliedi = rd.Snapshot.Metadata.Index
+					n.updateApplied(appliedi, rd.Snapshot.Metadata.Term,
+						rd.Snapshot.Metadata.ConfState)
 					glog.Infof("recovered from incoming snapshot at index %d", snapi)
 				}
 
@@ -441,22 +627,27 @@ func (n *Node) Start() {
 					}
 					if len(ents) > 0 {
 						if appliedi, shouldStop = n.apply(ents, &confState); shouldStop {
-							n.Stop()
+							go n.Stop()
 							return
 						}
+						n.updateApplied(appliedi, ents[len(ents)-1].Term, confState)
 					}
 				}
 
-				if appliedi-snapi > n.snapCount {
-					glog.Infof("start to snapshot (applied: %d, lastsnap: %d)", appliedi,
-						snapi)
-					n.snapshot(appliedi, &confState)
+				s := SnapshotStatus{
+					Entries: appliedi - snapi,
+					Bytes:   walBytes,
+					Elapsed: time.Since(snapt),
+				}
+				if n.maybeSnapshot(s, appliedi, &confState) {
 					snapi = appliedi
+					snapt = time.Now()
+					walBytes = 0
 				}
 
 				select {
 				case adv <- struct{}{}:
-				case <-n.done:
+				case <-stopping:
 				}
 			}(rd)
 
@@ -490,6 +681,9 @@ func (n *Node) snapshot(snapi uint64, confs *raftpb.ConfState) {
 	if err != nil {
 		glog.Fatalf("error in store save: %v", err)
 	}
+	n.mu.Lock()
+	d = encodeSnapshot(n.learners, d)
+	n.mu.Unlock()
 	err = n.raftStorage.Compact(snapi, confs, d)
 	if err != nil {
 		// the snapshot was done asynchronously with the progress of raft.
@@ -531,5 +725,28 @@ func (n *Node) Campaign(ctx context.Context) error {
 }
 
 func (n *Node) Step(ctx context.Context, msg raftpb.Message) error {
+	switch {
+	case isReadMsg(msg):
+		n.stepRead(msg)
+		return nil
+	case msg.Type == msgTimeoutNow:
+		n.stepTimeoutNow(msg)
+		return nil
+	case msg.Type == raftpb.MsgAppResp:
+		if n.stepLearnerResp(msg) {
+			return nil
+		}
+	case msg.Type == msgSnapReject:
+		n.stepSnapReject(msg)
+		return nil
+	case msg.Type == raftpb.MsgProp:
+		if n.holdProposal(msg) {
+			return nil
+		}
+	case msg.Type == raftpb.MsgSnap:
+		if !n.expandSnapshot(&msg) {
+			return nil
+		}
+	}
 	return n.node.Step(ctx, msg)
 }
@@ -0,0 +1,42 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+)
+
+func TestLastRequestSeq(t *testing.T) {
+	req := func(node, seq uint64) []byte {
+		r := Request{ID: RequestID{NodeID: node, Seq: seq}, Data: "a"}
+		b, err := r.Encode()
+		if err != nil {
+			t.Fatalf("cannot encode request: %v", err)
+		}
+		return b
+	}
+	conf := func(ctx []byte) []byte {
+		cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, Context: ctx}
+		b, err := cc.Marshal()
+		if err != nil {
+			t.Fatalf("cannot marshal conf change: %v", err)
+		}
+		return b
+	}
+	info := NodeInfo{ID: 1}.MustEncode()
+
+	ents := []raftpb.Entry{
+		{Index: 1, Data: req(1, 10)},
+		{Index: 2},
+		{Index: 3, Type: raftpb.EntryConfChange, Data: conf(info)},
+		{Index: 4, Type: raftpb.EntryConfChange, Data: conf(req(1, 30))},
+		{Index: 5, Data: req(2, 40)},
+		{Index: 6, Data: req(1, 20)},
+	}
+	if seq := lastRequestSeq(1, ents); seq != 30 {
+		t.Errorf("invalid last sequence: actual=%v want=30", seq)
+	}
+	if seq := lastRequestSeq(3, ents); seq != 0 {
+		t.Errorf("invalid last sequence: actual=%v want=0", seq)
+	}
+}
@@ -0,0 +1,381 @@
+package raft
+
+import (
+	"errors"
+	"time"
+
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var (
+	ErrNoLeader  = errors.New("raft: no leader")
+	ErrNotLeader = errors.New("raft: node is not the leader")
+)
+
+// Message types used for linearizable reads. They are sent using the same
+// transport as raft messages, but are handled by Node instead of etcd raft.
+const (
+	// msgReadIndex is sent by followers to ask the leader for a read index.
+	msgReadIndex raftpb.MessageType = 100 + iota
+	// msgReadIndexResp carries the read index in Commit, or is rejected if the
+	// leader cannot confirm its leadership.
+	msgReadIndexResp
+	// msgReadProbe is sent by the leader to confirm its leadership.
+	msgReadProbe
+	// msgReadProbeResp acknowledges a probe.
+	msgReadProbeResp
+)
+
+// leaderReadTimeout bounds the time the leader spends on the read index
+// requests of followers.
+const leaderReadTimeout = 10 * time.Second
+
+func isReadMsg(m raftpb.Message) bool {
+	return m.Type >= msgReadIndex && m.Type <= msgReadProbeResp
+}
+
+// readResult is the read index confirmed by the leader.
+type readResult struct {
+	index uint64
+	err   error
+}
+
+// leaderRead is a round of read probes that confirms the leadership of the
+// node for a batch of reads, once acknowledged by a quorum.
+type leaderRead struct {
+	seq   uint64
+	term  uint64
+	index uint64
+	ticks int
+	acks  map[uint64]bool
+	chs   []chan readResult
+}
+
+// LinearizableRead waits until the store reflects all the requests committed
+// before the call, so that the store can be read locally as if the read was
+// processed through the raft log. It implements ReadIndex (section 6.4 of the
+// raft thesis): the leader records its commit index, confirms that it is
+// still the leader by exchanging a heartbeat with a quorum of the nodes, and
+// waits until that index is applied. Followers ask the leader for the index.
+// The leader batches concurrent reads, and confirms each batch with a single
+// round of probes.
+//
+// LinearizableRead returns ErrNoLeader if there is no known leader.
+func (n *Node) LinearizableRead(ctx context.Context) error {
+	n.mu.Lock()
+	lead := n.lead
+	n.mu.Unlock()
+
+	var index uint64
+	var err error
+	switch lead {
+	case etcdraft.None:
+		return ErrNoLeader
+	case n.id:
+		index, err = n.leaderReadIndex(ctx)
+	default:
+		index, err = n.followerReadIndex(ctx, lead)
+	}
+	if err != nil {
+		return err
+	}
+	return n.waitApplied(ctx, index)
+}
+
+// leaderReadIndex returns the commit index of the leader once its leadership
+// is confirmed by a quorum.
+func (n *Node) leaderReadIndex(ctx context.Context) (uint64, error) {
+	// The leader does not know the latest commit index until it commits an
+	// entry in its own term.
+	for {
+		n.mu.Lock()
+		if n.lead != n.id {
+			n.mu.Unlock()
+			return 0, ErrNotLeader
+		}
+		if n.appliedTerm >= n.term {
+			break
+		}
+		ch := n.appliedc
+		n.mu.Unlock()
+		if err := n.wait(ctx, ch); err != nil {
+			return 0, err
+		}
+	}
+
+	ch := make(chan readResult, 1)
+	n.readBatch = append(n.readBatch, ch)
+	probes := n.maybeStartRead()
+	n.mu.Unlock()
+
+	n.send(probes)
+	select {
+	case res := <-ch:
+		return res.index, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-n.done:
+		return 0, ErrStopped
+	}
+}
+
+// maybeStartRead starts a new round of probes for the batched reads, unless a
+// round is in progress. The reads that arrive during a round wait for the next
+// one, since the probes of the current round may have been acknowledged before
+// they arrived. It returns the probes to send. n.mu must be locked.
+func (n *Node) maybeStartRead() []raftpb.Message {
+	if n.read != nil || len(n.readBatch) == 0 {
+		return nil
+	}
+
+	n.readSeq++
+	n.read = &leaderRead{
+		seq:   n.readSeq,
+		term:  n.term,
+		index: n.commit,
+		acks:  map[uint64]bool{n.id: true},
+		chs:   n.readBatch,
+	}
+	n.readBatch = nil
+	if probes := n.maybeConfirmRead(); probes != nil {
+		return probes
+	}
+	return n.readProbes()
+}
+
+// readProbes returns the probes of the current round for the nodes that have
+// not acknowledged it. n.mu must be locked.
+func (n *Node) readProbes() []raftpb.Message {
+	var probes []raftpb.Message
+	if n.read == nil {
+		return probes
+	}
+	for _, m := range n.members {
+		if n.read.acks[m] {
+			continue
+		}
+		probes = append(probes, raftpb.Message{
+			Type:  msgReadProbe,
+			To:    m,
+			From:  n.id,
+			Term:  n.read.term,
+			Index: n.read.seq,
+		})
+	}
+	return probes
+}
+
+// maybeConfirmRead confirms the reads of the current round if it is
+// acknowledged by a quorum, and starts the next round. It returns the probes
+// of the next round. n.mu must be locked.
+func (n *Node) maybeConfirmRead() []raftpb.Message {
+	r := n.read
+	acks := 0
+	for _, m := range n.members {
+		if r.acks[m] {
+			acks++
+		}
+	}
+	if len(n.members) == 0 && r.acks[n.id] {
+		acks = 1
+	}
+	if acks <= len(n.members)/2 {
+		return nil
+	}
+	n.read = nil
+	for _, ch := range r.chs {
+		ch <- readResult{index: r.index}
+	}
+	return n.maybeStartRead()
+}
+
+// tickRead resends the probes of a round that has not been confirmed within a
+// tick, in case the probes or their responses are lost.
+func (n *Node) tickRead() {
+	n.mu.Lock()
+	var probes []raftpb.Message
+	if n.read != nil {
+		if n.read.ticks++; n.read.ticks > 1 {
+			probes = n.readProbes()
+		}
+	}
+	n.mu.Unlock()
+
+	if len(probes) != 0 {
+		go n.send(probes)
+	}
+}
+
+// followerReadIndex asks the leader for a read index.
+func (n *Node) followerReadIndex(ctx context.Context, lead uint64) (uint64,
+	error) {
+
+	n.mu.Lock()
+	n.readSeq++
+	seq := n.readSeq
+	ch := make(chan readResult, 1)
+	n.indexReqs[seq] = ch
+	term := n.term
+	n.mu.Unlock()
+
+	n.send([]raftpb.Message{{
+		Type:  msgReadIndex,
+		To:    lead,
+		From:  n.id,
+		Term:  term,
+		Index: seq,
+	}})
+	select {
+	case res := <-ch:
+		return res.index, res.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.indexReqs, seq)
+		n.mu.Unlock()
+		return 0, ctx.Err()
+	case <-n.done:
+		return 0, ErrStopped
+	}
+}
+
+// waitApplied waits until the entry at index is applied to the store.
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mu.Lock()
+		if n.applied >= index {
+			n.mu.Unlock()
+			return nil
+		}
+		ch := n.appliedc
+		n.mu.Unlock()
+		if err := n.wait(ctx, ch); err != nil {
+			return err
+		}
+	}
+}
+
+func (n *Node) wait(ctx context.Context, ch chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return ErrStopped
+	}
+}
+
+// stepRead handles the messages of linearizable reads.
+func (n *Node) stepRead(m raftpb.Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch m.Type {
+	case msgReadIndex:
+		go n.serveReadIndex(m)
+
+	case msgReadIndexResp:
+		if ch, ok := n.indexReqs[m.Index]; ok {
+			delete(n.indexReqs, m.Index)
+			if m.Reject {
+				ch <- readResult{err: ErrNotLeader}
+			} else {
+				ch <- readResult{index: m.Commit}
+			}
+		}
+
+	case msgReadProbe:
+		// Acknowledge the probe unless we know a more recent leader. Since votes
+		// are sent after the term is updated, a node that has voted in a newer
+		// term never acknowledges the probes of older leaders.
+		if m.Term < n.term {
+			glog.V(2).Infof("%v ignores a stale read probe from %v", n, m.From)
+			return
+		}
+		go n.send([]raftpb.Message{{
+			Type:  msgReadProbeResp,
+			To:    m.From,
+			From:  n.id,
+			Term:  m.Term,
+			Index: m.Index,
+		}})
+
+	case msgReadProbeResp:
+		r := n.read
+		if r == nil || r.seq != m.Index || r.term != m.Term {
+			return
+		}
+		r.acks[m.From] = true
+		if probes := n.maybeConfirmRead(); len(probes) != 0 {
+			go n.send(probes)
+		}
+	}
+}
+
+// serveReadIndex replies to the read index request of a follower.
+func (n *Node) serveReadIndex(m raftpb.Message) {
+	ctx, ccl := context.WithTimeout(context.Background(), leaderReadTimeout)
+	defer ccl()
+	index, err := n.leaderReadIndex(ctx)
+	if err != nil {
+		glog.V(2).Infof("%v cannot serve read index for %v: %v", n, m.From, err)
+	}
+	n.send([]raftpb.Message{{
+		Type:   msgReadIndexResp,
+		To:     m.From,
+		From:   n.id,
+		Term:   m.Term,
+		Index:  m.Index,
+		Commit: index,
+		Reject: err != nil,
+	}})
+}
+
+// updateStatus records the status of the node from a raft update.
+func (n *Node) updateStatus(rd etcdraft.Ready) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !etcdraft.IsEmptyHardState(rd.HardState) {
+		n.term = rd.HardState.Term
+		n.commit = rd.HardState.Commit
+	}
+	if rd.SoftState == nil || rd.SoftState.Lead == n.lead {
+		return
+	}
+	n.lead = rd.SoftState.Lead
+	n.learnerPrs = make(map[uint64]*learnerProgress)
+	close(n.leadc)
+	n.leadc = make(chan struct{})
+	if n.read != nil {
+		n.readBatch = append(n.readBatch, n.read.chs...)
+		n.read = nil
+	}
+	for _, ch := range n.readBatch {
+		ch <- readResult{err: ErrNotLeader}
+	}
+	n.readBatch = nil
+	for seq, ch := range n.indexReqs {
+		delete(n.indexReqs, seq)
+		ch <- readResult{err: ErrNotLeader}
+	}
+}
+
+// updateApplied records the last applied entry and the voters of the raft
+// group, and wakes up the reads waiting on the store.
+func (n *Node) updateApplied(index, term uint64, confs raftpb.ConfState) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if index <= n.applied {
+		return
+	}
+	n.applied = index
+	n.appliedTerm = term
+	n.members = append(n.members[:0], confs.Nodes...)
+	close(n.appliedc)
+	n.appliedc = make(chan struct{})
+}
@@ -0,0 +1,258 @@
+package raft
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type testStore struct {
+	sync.Mutex
+	reqs []string
+}
+
+func (s *testStore) Save() ([]byte, error)  { return nil, nil }
+func (s *testStore) Restore(b []byte) error { return nil }
+
+func (s *testStore) Apply(req interface{}) (interface{}, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.reqs = append(s.reqs, req.(string))
+	return nil, nil
+}
+
+func (s *testStore) ApplyConfChange(cc raftpb.ConfChange, n NodeInfo) error {
+	return nil
+}
+
+func (s *testStore) last() string {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.reqs) == 0 {
+		return ""
+	}
+	return s.reqs[len(s.reqs)-1]
+}
+
+type testListener struct{}
+
+func (l testListener) ProcessStatusChange(event interface{}) {}
+
+type testCluster struct {
+	sync.Mutex
+	nodes  map[uint64]*Node
+	stores map[uint64]*testStore
+	all    []*Node
+	drop   func(m raftpb.Message) bool // drops the matching messages.
+}
+
+func (c *testCluster) send(msgs []raftpb.Message) {
+	for _, m := range msgs {
+		c.Lock()
+		n := c.nodes[m.To]
+		drop := c.drop != nil && c.drop(m)
+		c.Unlock()
+		if n != nil && !drop {
+			n.Step(context.TODO(), m)
+		}
+	}
+}
+
+func startTestCluster(t *testing.T, dir string, size int) *testCluster {
+	c := &testCluster{
+		nodes:  make(map[uint64]*Node),
+		stores: make(map[uint64]*testStore),
+	}
+	var peers []etcdraft.Peer
+	for i := 1; i <= size; i++ {
+		peers = append(peers, NodeInfo{ID: uint64(i)}.Peer())
+	}
+	c.Lock()
+	defer c.Unlock()
+	for i := 1; i <= size; i++ {
+		c.newNode(dir, uint64(i), peers, nil)
+	}
+	return c
+}
+
+// addNode starts a node that is not a member of the cluster.
+func (c *testCluster) addNode(dir string, id uint64) {
+	c.Lock()
+	defer c.Unlock()
+	c.newNode(dir, id, nil, nil)
+}
+
+func (c *testCluster) newNode(dir string, id uint64, peers []etcdraft.Peer,
+	policy SnapshotPolicy) {
+
+	s := &testStore{}
+	c.stores[id] = s
+	// Nodes are in memory if dir is empty.
+	datadir := ""
+	if dir != "" {
+		datadir = fmt.Sprintf("%s/%v", dir, id)
+	}
+	c.nodes[id] = NewNode(fmt.Sprintf("test%v", id), id, peers, c.send,
+		testListener{}, datadir, s, policy, 10,
+		time.Tick(10*time.Millisecond), 10, 1)
+	c.all = append(c.all, c.nodes[id])
+}
+
+// waitLeader waits until all the nodes of the cluster know lead as the
+// leader.
+func (c *testCluster) waitLeader(t *testing.T, lead uint64) {
+	for i := 0; i < 100; i++ {
+		elected := true
+		for _, n := range c.all {
+			n.mu.Lock()
+			elected = elected && n.lead == lead
+			n.mu.Unlock()
+		}
+		if elected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("node %v is not elected", lead)
+}
+
+func (c *testCluster) stop() {
+	for _, n := range c.all {
+		n.Stop()
+	}
+}
+
+func TestLinearizableRead(t *testing.T) {
+	dir := "/tmp/bhtest_raft_read"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := startTestCluster(t, dir, 3)
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+
+	// The leader skips the appends of the followers it is probing, and does
+	// not resend them until the next proposal.
+	var err error
+	for _, req := range []string{"a", "b"} {
+		if _, err = c.nodes[1].Process(ctx, req); err != nil {
+			t.Fatalf("cannot process request: %v", err)
+		}
+	}
+
+	for id, n := range c.nodes {
+		// Reads fail while the leader is changing.
+		for i := 0; i < 100; i++ {
+			if err = n.LinearizableRead(ctx); err != ErrNoLeader &&
+				err != ErrNotLeader {
+
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("error in linearizable read on node %v: %v", id, err)
+		}
+		if l := c.stores[id].last(); l != "b" {
+			t.Errorf("invalid store for node %v: actual=%v want=b", id, l)
+		}
+	}
+}
+
+func TestLinearizableReadBatch(t *testing.T) {
+	dir := "/tmp/bhtest_raft_readbatch"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := startTestCluster(t, dir, 3)
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+	if _, err := c.nodes[1].Process(ctx, "a"); err != nil {
+		t.Fatalf("cannot process request: %v", err)
+	}
+
+	// Drop the probes so that the reads wait on the leader.
+	c.Lock()
+	c.drop = func(m raftpb.Message) bool { return m.Type == msgReadProbe }
+	c.Unlock()
+
+	n := c.nodes[1]
+	n.mu.Lock()
+	seq := n.readSeq
+	n.mu.Unlock()
+
+	const reads = 10
+	errs := make(chan error, reads)
+	for i := 0; i < reads; i++ {
+		go func() {
+			errs <- n.LinearizableRead(ctx)
+		}()
+	}
+
+	waiting := false
+	for i := 0; i < 100 && !waiting; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n.mu.Lock()
+		waiting = n.read != nil && len(n.read.chs)+len(n.readBatch) == reads
+		n.mu.Unlock()
+	}
+	if !waiting {
+		t.Fatal("reads are not waiting on the leader")
+	}
+
+	// The leader resends the probes on the next ticks.
+	c.Lock()
+	c.drop = nil
+	c.Unlock()
+	for i := 0; i < reads; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("error in linearizable read: %v", err)
+		}
+	}
+
+	n.mu.Lock()
+	rounds := n.readSeq - seq
+	n.mu.Unlock()
+	if rounds > 2 {
+		t.Errorf("invalid number of read rounds: actual=%v want<=2", rounds)
+	}
+}
+
+func TestLinearizableReadNoLeader(t *testing.T) {
+	dir := "/tmp/bhtest_raft_noleader"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := startTestCluster(t, dir, 3)
+	defer c.stop()
+
+	// Isolate node 1 so that it cannot be elected.
+	c.Lock()
+	c.nodes = map[uint64]*Node{1: c.nodes[1]}
+	c.Unlock()
+	n := c.nodes[1]
+	for i := 0; i < 50; i++ {
+		if err := n.LinearizableRead(context.Background()); err != ErrNoLeader {
+			t.Fatalf("invalid error: actual=%v want=%v", err, ErrNoLeader)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,164 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// SnapshotStatus describes the log of a node since its last snapshot.
+type SnapshotStatus struct {
+	Entries uint64        // number of entries applied since the last snapshot.
+	Bytes   uint64        // bytes written to the WAL since the last snapshot.
+	Elapsed time.Duration // time passed since the last snapshot.
+}
+
+// SnapshotPolicy decides whether the node should snapshot its store and
+// compact its log. It is checked whenever the node applies a raft update, and
+// only if there are new entries since the last snapshot.
+type SnapshotPolicy func(s SnapshotStatus) bool
+
+// DefaultSnapshotPolicy snapshots the store every 1024 entries.
+var DefaultSnapshotPolicy = SnapshotEntries(1024)
+
+// SnapshotEntries returns a policy that snapshots the store once more than n
+// entries are applied since the last snapshot.
+func SnapshotEntries(n uint64) SnapshotPolicy {
+	return func(s SnapshotStatus) bool {
+		return s.Entries > n
+	}
+}
+
+// SnapshotBytes returns a policy that snapshots the store once more than n
+// bytes are written to the WAL since the last snapshot.
+func SnapshotBytes(n uint64) SnapshotPolicy {
+	return func(s SnapshotStatus) bool {
+		return s.Bytes > n
+	}
+}
+
+// SnapshotInterval returns a policy that snapshots the store if d has passed
+// since the last snapshot.
+func SnapshotInterval(d time.Duration) SnapshotPolicy {
+	return func(s SnapshotStatus) bool {
+		return s.Elapsed >= d
+	}
+}
+
+// SnapshotAny returns a policy that snapshots the store if any of the given
+// policies does.
+func SnapshotAny(policies ...SnapshotPolicy) SnapshotPolicy {
+	return func(s SnapshotStatus) bool {
+		for _, p := range policies {
+			if p(s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Snapshot snapshots the store and compacts the log regardless of the
+// snapshot policy. The snapshot includes, at least, the entries applied
+// before the call.
+func (n *Node) Snapshot(ctx context.Context) error {
+	ch := make(chan struct{})
+	n.mu.Lock()
+	n.snapReqs = append(n.snapReqs, ch)
+	n.mu.Unlock()
+
+	// Commit an empty entry to make sure the node processes an update.
+	if _, err := n.Process(ctx, nil); err != nil {
+		return err
+	}
+	return n.wait(ctx, ch)
+}
+
+// maybeSnapshot snapshots the store if it is requested or if the snapshot
+// policy says so. It returns whether the store is snapshotted.
+func (n *Node) maybeSnapshot(s SnapshotStatus, appliedi uint64,
+	confs *raftpb.ConfState) bool {
+
+	n.mu.Lock()
+	reqs := n.snapReqs
+	n.snapReqs = nil
+	n.mu.Unlock()
+
+	defer func() {
+		for _, ch := range reqs {
+			close(ch)
+		}
+	}()
+
+	if s.Entries == 0 || (len(reqs) == 0 && !n.snapPolicy(s)) {
+		return false
+	}
+	glog.Infof("start to snapshot (applied: %d, entries: %d, bytes: %d)",
+		appliedi, s.Entries, s.Bytes)
+	n.snapshot(appliedi, confs)
+	return true
+}
+
+// snapMagic prefixes the snapshots that carry the learners of the group along
+// with the store. etcd raft does not track learners in its ConfState, so they
+// are kept in the data of the snapshot.
+var snapMagic = []byte("bhraft\x00\x01")
+
+var errInvalidSnap = errors.New("raft: invalid snapshot data")
+
+// encodeSnapshot encodes the learners and the snapshot of the store.
+func encodeSnapshot(learners []uint64, store []byte) []byte {
+	b := make([]byte, 0,
+		len(snapMagic)+(len(learners)+1)*binary.MaxVarintLen64+len(store))
+	b = append(b, snapMagic...)
+	var v [binary.MaxVarintLen64]byte
+	b = append(b, v[:binary.PutUvarint(v[:], uint64(len(learners)))]...)
+	for _, l := range learners {
+		b = append(b, v[:binary.PutUvarint(v[:], l)]...)
+	}
+	return append(b, store...)
+}
+
+// decodeSnapshot returns the learners and the snapshot of the store encoded in
+// b. Snapshots taken before the learners were kept are returned as is.
+func decodeSnapshot(b []byte) (learners []uint64, store []byte, err error) {
+	if !bytes.HasPrefix(b, snapMagic) {
+		return nil, b, nil
+	}
+
+	b = b[len(snapMagic):]
+	n, s := binary.Uvarint(b)
+	if s <= 0 {
+		return nil, nil, errInvalidSnap
+	}
+	b = b[s:]
+	for i := uint64(0); i < n; i++ {
+		l, s := binary.Uvarint(b)
+		if s <= 0 {
+			return nil, nil, errInvalidSnap
+		}
+		learners = append(learners, l)
+		b = b[s:]
+	}
+	return learners, b, nil
+}
+
+// restoreSnapshot restores the store and the learners from the snapshot data.
+func (n *Node) restoreSnapshot(b []byte) error {
+	learners, d, err := decodeSnapshot(b)
+	if err != nil {
+		return err
+	}
+	if err := n.store.Restore(d); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.learners = append(n.learners[:0], learners...)
+	n.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,139 @@
+package raft
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestSnapshotPolicies(t *testing.T) {
+	s := SnapshotStatus{Entries: 10, Bytes: 100, Elapsed: time.Second}
+	tests := []struct {
+		name string
+		p    SnapshotPolicy
+		want bool
+	}{
+		{"entries", SnapshotEntries(9), true},
+		{"entries", SnapshotEntries(10), false},
+		{"bytes", SnapshotBytes(99), true},
+		{"bytes", SnapshotBytes(100), false},
+		{"interval", SnapshotInterval(time.Second), true},
+		{"interval", SnapshotInterval(time.Minute), false},
+		{"any", SnapshotAny(SnapshotEntries(100), SnapshotBytes(10)), true},
+		{"any", SnapshotAny(SnapshotEntries(100), SnapshotBytes(1000)), false},
+		{"any", SnapshotAny(), false},
+	}
+	for _, test := range tests {
+		if got := test.p(s); got != test.want {
+			t.Errorf("invalid %v policy: actual=%v want=%v", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestSnapshotEncoding(t *testing.T) {
+	b := encodeSnapshot([]uint64{2, 300}, []byte("store"))
+	learners, d, err := decodeSnapshot(b)
+	if err != nil {
+		t.Fatalf("cannot decode snapshot: %v", err)
+	}
+	if len(learners) != 2 || learners[0] != 2 || learners[1] != 300 {
+		t.Errorf("invalid learners: actual=%v want=[2 300]", learners)
+	}
+	if string(d) != "store" {
+		t.Errorf("invalid store: actual=%s want=store", d)
+	}
+
+	// Snapshots without learners are decoded as is.
+	learners, d, err = decodeSnapshot([]byte("store"))
+	if err != nil || learners != nil || string(d) != "store" {
+		t.Errorf("invalid snapshot: learners=%v store=%s err=%v", learners, d, err)
+	}
+
+	if _, _, err = decodeSnapshot(b[:len(snapMagic)]); err != errInvalidSnap {
+		t.Errorf("invalid error: actual=%v want=%v", err, errInvalidSnap)
+	}
+}
+
+func snapIndex(t *testing.T, n *Node) uint64 {
+	snap, err := n.raftStorage.Snapshot()
+	if err != nil {
+		t.Fatalf("cannot get snapshot: %v", err)
+	}
+	return snap.Metadata.Index
+}
+
+func TestSnapshotPolicy(t *testing.T) {
+	dir := "/tmp/bhtest_raft_snap_policy"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := &testCluster{
+		nodes:  make(map[uint64]*Node),
+		stores: make(map[uint64]*testStore),
+	}
+	peers := []etcdraft.Peer{NodeInfo{ID: 1}.Peer()}
+	c.newNode(dir, 1, peers, SnapshotEntries(2))
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+
+	for _, req := range []string{"a", "b", "c", "d"} {
+		if _, err := c.nodes[1].Process(ctx, req); err != nil {
+			t.Fatalf("cannot process request: %v", err)
+		}
+	}
+	if i := snapIndex(t, c.nodes[1]); i == 0 {
+		t.Errorf("node is not snapshotted")
+	}
+}
+
+func TestSnapshotOnDemand(t *testing.T) {
+	dir := "/tmp/bhtest_raft_snap"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := &testCluster{
+		nodes:  make(map[uint64]*Node),
+		stores: make(map[uint64]*testStore),
+	}
+	never := func(s SnapshotStatus) bool { return false }
+	peers := []etcdraft.Peer{NodeInfo{ID: 1}.Peer()}
+	c.newNode(dir, 1, peers, never)
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+
+	n := c.nodes[1]
+	for _, req := range []string{"a", "b"} {
+		if _, err := n.Process(ctx, req); err != nil {
+			t.Fatalf("cannot process request: %v", err)
+		}
+	}
+	if i := snapIndex(t, n); i != 0 {
+		t.Fatalf("node is snapshotted at %v", i)
+	}
+
+	n.mu.Lock()
+	applied := n.applied
+	n.mu.Unlock()
+	if err := n.Snapshot(ctx); err != nil {
+		t.Fatalf("cannot snapshot: %v", err)
+	}
+	if i := snapIndex(t, n); i < applied {
+		t.Errorf("invalid snapshot index: actual=%v want>=%v", i, applied)
+	}
+}
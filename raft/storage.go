@@ -43,3 +43,21 @@ func (st *storage) SaveSnap(snap raftpb.Snapshot) error {
 	}
 	return nil
 }
+
+// memStorage is the storage of in-memory nodes. Their log and snapshots are
+// only kept in the raft MemoryStorage of the node, and are lost when the node
+// stops.
+type memStorage struct{}
+
+// NewMemStorage returns a storage that does not persist anything.
+func NewMemStorage() Storage {
+	return memStorage{}
+}
+
+func (memStorage) Save(st raftpb.HardState, ents []raftpb.Entry) error {
+	return nil
+}
+
+func (memStorage) SaveSnap(snap raftpb.Snapshot) error { return nil }
+func (memStorage) Cut() error                          { return nil }
+func (memStorage) Close() error                        { return nil }
@@ -0,0 +1,46 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestInMemoryNode(t *testing.T) {
+	c := startTestCluster(t, "", 3)
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+
+	for _, req := range []string{"a", "b"} {
+		if _, err := c.nodes[1].Process(ctx, req); err != nil {
+			t.Fatalf("cannot process request: %v", err)
+		}
+	}
+	last, _ := c.nodes[1].raftStorage.LastIndex()
+	if err := c.nodes[1].Snapshot(ctx); err != nil {
+		t.Fatalf("cannot snapshot: %v", err)
+	}
+	if l := c.stores[1].last(); l != "b" {
+		t.Errorf("invalid store: actual=%v want=b", l)
+	}
+
+	snap, err := c.nodes[1].raftStorage.Snapshot()
+	if err != nil {
+		t.Fatalf("cannot get the snapshot: %v", err)
+	}
+	if snap.Metadata.Index < last {
+		t.Errorf("the snapshot does not cover the requests: index=%v want>=%v",
+			snap.Metadata.Index, last)
+	}
+	if f, _ := c.nodes[1].raftStorage.FirstIndex(); f != snap.Metadata.Index+1 {
+		t.Errorf("the log is not compacted: first=%v snapshot=%v", f,
+			snap.Metadata.Index)
+	}
+}
@@ -19,3 +19,20 @@ type Store interface {
 	// ApplyConfChange processes a configuration change.
 	ApplyConfChange(cc raftpb.ConfChange, n NodeInfo) error
 }
+
+// DeltaStore is a store whose snapshots can be shipped to peers as deltas of
+// the snapshots they already have. The leader remembers the last snapshot it
+// has sent to each peer, and only sends the delta from that snapshot. If the
+// peer cannot expand the delta, the leader sends the whole snapshot instead.
+type DeltaStore interface {
+	Store
+	// SnapshotID returns the ID of the snapshot b, or false if b cannot be used
+	// as the base of a delta.
+	SnapshotID(b []byte) (uint64, bool)
+	// DeltaSnapshot returns the part of the snapshot b that is not included in
+	// the snapshot with ID from, or false if b should be sent as is.
+	DeltaSnapshot(b []byte, from uint64) ([]byte, bool)
+	// ExpandSnapshot rebuilds the snapshot whose delta is b. Snapshots that are
+	// not deltas are returned as is.
+	ExpandSnapshot(b []byte) ([]byte, error)
+}
@@ -0,0 +1,232 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// msgTimeoutNow asks the target of a leadership transfer to campaign if it has
+// applied the entries up to Commit.
+const msgTimeoutNow = msgReadProbeResp + 1
+
+var ErrTransferring = errors.New("raft: leadership transfer in progress")
+
+// leaderTransfer is an ongoing leadership transfer. Similar to the
+// leadTransferee of etcd raft, new proposals wait until the transfer is over.
+type leaderTransfer struct {
+	msg   raftpb.Message // the msgTimeoutNow sent to the target.
+	ticks int
+	done  chan struct{}
+}
+
+// TransferLeadership hands the leadership of the raft group over to node to.
+// If to is 0, the leadership is transferred to another voter of the group. If
+// to is a learner, TransferLeadership waits until it is promoted.
+// The leader stops proposing new entries, commits an empty entry to push its
+// log to the target, and then asks the target to campaign. The request is
+// resent on every heartbeat, and the target campaigns once it has caught up.
+// Since the target campaigns immediately, the group is left without a leader
+// only for the duration of one election round, instead of an election timeout.
+//
+// TransferLeadership returns when the target is elected, or with an error if
+// another node is elected or ctx is done. It returns ErrNotLeader if this
+// node is not the leader, and ErrTransferring if the node is already
+// transferring its leadership.
+func (n *Node) TransferLeadership(ctx context.Context, to uint64) error {
+	n.mu.Lock()
+	if n.lead != n.id {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if to == etcdraft.None {
+		for _, m := range n.members {
+			if m != n.id {
+				to = m
+				break
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	if to == n.id {
+		return nil
+	}
+	if err := n.WaitVoter(ctx, to); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	if n.transfer != nil {
+		n.mu.Unlock()
+		return ErrTransferring
+	}
+	t := &leaderTransfer{done: make(chan struct{})}
+	n.transfer = t
+	n.mu.Unlock()
+	defer n.endTransfer(t)
+
+	glog.V(2).Infof("%v transfers leadership to %v", n, to)
+	if _, err := n.process(ctx, nil); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	if n.lead != n.id {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	t.msg = raftpb.Message{
+		Type:   msgTimeoutNow,
+		To:     to,
+		From:   n.id,
+		Term:   n.term,
+		Commit: n.applied,
+	}
+	m := t.msg
+	n.mu.Unlock()
+	n.send([]raftpb.Message{m})
+
+	for {
+		n.mu.Lock()
+		lead := n.lead
+		ch := n.leadc
+		n.mu.Unlock()
+
+		switch lead {
+		case to:
+			glog.V(2).Infof("%v transferred leadership to %v", n, to)
+			return nil
+		case n.id, etcdraft.None:
+		default:
+			return fmt.Errorf("raft: %v is elected instead of %v", lead, to)
+		}
+		if err := n.wait(ctx, ch); err != nil {
+			return err
+		}
+	}
+}
+
+// endTransfer releases the proposals held during the transfer.
+func (n *Node) endTransfer(t *leaderTransfer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.transfer == t {
+		n.transfer = nil
+		close(t.done)
+	}
+}
+
+// waitTransfer waits until the ongoing leadership transfer, if any, is over.
+func (n *Node) waitTransfer(ctx context.Context) error {
+	n.mu.Lock()
+	t := n.transfer
+	n.mu.Unlock()
+
+	if t == nil {
+		return nil
+	}
+	return n.wait(ctx, t.done)
+}
+
+// holdProposal holds the proposals forwarded by followers during a leadership
+// transfer, and steps them once the transfer is over. If the leadership is
+// transferred, etcd raft forwards them to the new leader. It returns whether
+// the proposal is held.
+func (n *Node) holdProposal(m raftpb.Message) bool {
+	n.mu.Lock()
+	t := n.transfer
+	n.mu.Unlock()
+
+	if t == nil {
+		return false
+	}
+	go func() {
+		ctx, ccl := context.WithTimeout(context.Background(), leaderReadTimeout)
+		defer ccl()
+		if err := n.wait(ctx, t.done); err != nil {
+			glog.Errorf("%v drops a proposal from %v: %v", n, m.From, err)
+			return
+		}
+		n.node.Step(ctx, m)
+	}()
+	return true
+}
+
+// tickTransfer resends msgTimeoutNow on every heartbeat, in case the target
+// has not caught up yet or the message is lost.
+func (n *Node) tickTransfer() {
+	n.mu.Lock()
+	var msgs []raftpb.Message
+	if t := n.transfer; t != nil && t.msg.To != etcdraft.None {
+		if t.ticks++; t.ticks >= n.heartbeat {
+			t.ticks = 0
+			msgs = append(msgs, t.msg)
+		}
+	}
+	n.mu.Unlock()
+
+	if len(msgs) != 0 {
+		go n.send(msgs)
+	}
+}
+
+// WaitVoter waits until the learner id is promoted to a voter. It returns an
+// error if id is not a member of the group.
+func (n *Node) WaitVoter(ctx context.Context, id uint64) error {
+	for {
+		n.mu.Lock()
+		voter := containsNode(n.members, id)
+		learner := containsNode(n.learners, id)
+		ch := n.appliedc
+		n.mu.Unlock()
+
+		switch {
+		case voter:
+			return nil
+		case !learner:
+			return fmt.Errorf("raft: %v is not a member of the group", id)
+		}
+		if err := n.wait(ctx, ch); err != nil {
+			return err
+		}
+	}
+}
+
+// stepTimeoutNow campaigns if the node has caught up with the leader.
+// Otherwise, the node campaigns when the leader resends the message.
+func (n *Node) stepTimeoutNow(m raftpb.Message) {
+	n.mu.Lock()
+	// The leader resends the message until we are elected, but we campaign only
+	// once per term of the leader.
+	stale := m.Term < n.term || m.From != n.lead || m.Term <= n.transferTerm
+	behind := n.applied < m.Commit
+	if !stale && !behind {
+		n.transferTerm = m.Term
+	}
+	n.mu.Unlock()
+	if stale {
+		glog.V(2).Infof("%v ignores a stale leadership transfer from %v", n,
+			m.From)
+		return
+	}
+	if behind {
+		glog.V(2).Infof("%v needs to catch up with %v to take over", n, m.From)
+		return
+	}
+
+	glog.V(2).Infof("%v campaigns to take over the leadership of %v", n,
+		m.From)
+	go func() {
+		ctx, ccl := context.WithTimeout(context.Background(), leaderReadTimeout)
+		defer ccl()
+		if err := n.node.Campaign(ctx); err != nil {
+			glog.Errorf("%v cannot campaign: %v", n, err)
+		}
+	}()
+}
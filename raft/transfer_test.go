@@ -0,0 +1,112 @@
+package raft
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestTransferLeadership(t *testing.T) {
+	dir := "/tmp/bhtest_raft_transfer"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := startTestCluster(t, dir, 3)
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+
+	if err := c.nodes[2].TransferLeadership(ctx, 3); err != ErrNotLeader {
+		t.Errorf("invalid error for a follower: actual=%v want=%v", err,
+			ErrNotLeader)
+	}
+
+	if err := c.nodes[1].TransferLeadership(ctx, 3); err != nil {
+		t.Fatalf("cannot transfer leadership: %v", err)
+	}
+	c.waitLeader(t, 3)
+	if _, err := c.nodes[3].Process(ctx, "a"); err != nil {
+		t.Fatalf("cannot process request on the new leader: %v", err)
+	}
+}
+
+func TestTransferLeadershipHoldsProposals(t *testing.T) {
+	dir := "/tmp/bhtest_raft_transferhold"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	c := startTestCluster(t, dir, 3)
+	defer c.stop()
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	if err := c.nodes[1].Campaign(ctx); err != nil {
+		t.Fatalf("cannot campaign: %v", err)
+	}
+	c.waitLeader(t, 1)
+
+	// Drop the requests to campaign, so that the transfer is held and the
+	// leader has to resend them.
+	var dropped int32
+	c.Lock()
+	c.drop = func(m raftpb.Message) bool {
+		if m.Type != msgTimeoutNow {
+			return false
+		}
+		atomic.AddInt32(&dropped, 1)
+		return true
+	}
+	c.Unlock()
+
+	transferred := make(chan error, 1)
+	go func() {
+		transferred <- c.nodes[1].TransferLeadership(ctx, 3)
+	}()
+	for i := 0; i < 100 && atomic.LoadInt32(&dropped) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	processed := make(chan error, 1)
+	go func() {
+		_, err := c.nodes[1].Process(ctx, "a")
+		processed <- err
+	}()
+
+	select {
+	case err := <-processed:
+		t.Fatalf("request is processed during the transfer: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := atomic.LoadInt32(&dropped); n < 2 {
+		t.Errorf("leader did not resend the transfer request: actual=%v want>1",
+			n)
+	}
+
+	c.Lock()
+	c.drop = nil
+	c.Unlock()
+	if err := <-transferred; err != nil {
+		t.Fatalf("cannot transfer leadership: %v", err)
+	}
+	if err := <-processed; err != nil {
+		t.Fatalf("cannot process request: %v", err)
+	}
+	c.waitLeader(t, 3)
+	// The request is proposed after the transfer, so it is committed by the new
+	// leader.
+	if err := c.nodes[3].LinearizableRead(ctx); err != nil {
+		t.Fatalf("error in linearizable read: %v", err)
+	}
+	if l := c.stores[3].last(); l != "a" {
+		t.Errorf("invalid store: actual=%v want=a", l)
+	}
+}
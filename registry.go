@@ -148,7 +148,8 @@ func (r *registry) ApplyConfChange(cc raftpb.ConfChange,
 
 	glog.V(2).Infof("%v applies conf change %#v for %v", r, cc, n)
 	switch cc.Type {
-	case raftpb.ConfChangeAddNode:
+	case raftpb.ConfChangeAddNode, raft.ConfChangeAddLearnerNode:
+		// Promoted learners have no address.
 		if n.ID != cc.NodeID {
 			glog.Fatalf("invalid data in the config change: %v != %v", n, cc.NodeID)
 		}
@@ -480,4 +481,8 @@ func init() {
 	gob.Register(lockMappedCell{})
 	gob.Register(transferCells{})
 	gob.Register(cellStore{})
+
+	registerValueType(HiveInfo{})
+	registerValueType([]HiveInfo{})
+	registerValueType(BeeInfo{})
 }
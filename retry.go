@@ -0,0 +1,67 @@
+package beehive
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy represents how failed invocations of Rcv are retried. A message
+// is retried when Rcv returns an error or panics, but not when it snoozes.
+// Once a message is retried MaxAttempts times, it is stored in the app's dead
+// letters.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times Rcv is invoked for a message,
+	// including the first attempt.
+	MaxAttempts int
+	// Backoff is the delay before the first retry.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the delay grows after each retry. Values
+	// less than 1 are treated as 1.
+	Multiplier float64
+	// Jitter randomizes each delay by up to +/- Jitter*delay. It must be in
+	// [0, 1].
+	Jitter float64
+}
+
+// DefaultRetryPolicy retries a message 3 times with an exponential backoff
+// starting from 10ms.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	Backoff:     10 * time.Millisecond,
+	MaxBackoff:  1 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.2,
+}
+
+// AppWithRetry is an application option that retries messages whose Rcv
+// function fails, using the given retry policy.
+func AppWithRetry(p RetryPolicy) AppOption {
+	return func(a *app) {
+		a.retry = &p
+	}
+}
+
+// canRetry returns whether a message that has been already tried attempts
+// times can be retried.
+func (p RetryPolicy) canRetry(attempts int) bool {
+	return attempts < p.MaxAttempts
+}
+
+// backoff returns the delay before the given retry. The first retry is 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	m := p.Multiplier
+	if m < 1 {
+		m = 1
+	}
+	d := float64(p.Backoff) * math.Pow(m, float64(retry-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
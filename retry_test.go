@@ -0,0 +1,147 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts: 5,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  30 * time.Millisecond,
+		Multiplier:  2,
+	}
+	want := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		30 * time.Millisecond,
+		30 * time.Millisecond,
+	}
+	for i, w := range want {
+		if d := p.backoff(i + 1); d != w {
+			t.Errorf("invalid backoff for retry %d: actual=%v want=%v", i+1, d, w)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.backoff(1)
+		if d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Errorf("backoff is not in the jitter range: %v", d)
+		}
+	}
+}
+
+func TestRetryPolicyCanRetry(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2}
+	if !p.canRetry(1) {
+		t.Error("cannot retry after the first attempt")
+	}
+	if p.canRetry(2) {
+		t.Error("can retry after max attempts")
+	}
+}
+
+type retryTestHandler struct {
+	fails int
+	tries int
+	ch    chan int
+}
+
+func (h *retryTestHandler) Rcv(m Msg, ctx RcvContext) error {
+	h.tries++
+	if h.tries <= h.fails {
+		return errors.New("retry")
+	}
+	h.ch <- h.tries
+	return nil
+}
+
+func (h *retryTestHandler) Map(m Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func TestAppWithRetry(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_retry"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	p := RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+	}
+	app := h.NewApp("retry", Transactional(), AppWithRetry(p))
+	rcvh := &retryTestHandler{fails: 2, ch: make(chan int)}
+	app.Handle(MyMsg(0), rcvh)
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(MyMsg(1))
+	select {
+	case tries := <-rcvh.ch:
+		if tries != 3 {
+			t.Errorf("invalid number of tries: actual=%v want=3", tries)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not retried")
+	}
+
+	if l := app.DeadLetters().List(); len(l) != 0 {
+		t.Errorf("retried message is in dead letters: %v", l)
+	}
+}
+
+type snoozeTestHandler struct {
+	snoozes int
+	tries   int
+	ch      chan int
+}
+
+func (h *snoozeTestHandler) Rcv(m Msg, ctx RcvContext) error {
+	h.tries++
+	if h.tries <= h.snoozes {
+		ctx.Snooze(time.Millisecond)
+	}
+	h.ch <- h.tries
+	return nil
+}
+
+func (h *snoozeTestHandler) Map(m Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func TestAppWithRetrySnooze(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_retry"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	p := RetryPolicy{
+		MaxAttempts: 2,
+		Backoff:     time.Millisecond,
+	}
+	app := h.NewApp("retry", Transactional(), AppWithRetry(p))
+	rcvh := &snoozeTestHandler{snoozes: 4, ch: make(chan int)}
+	app.Handle(MyMsg(0), rcvh)
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(MyMsg(1))
+	select {
+	case tries := <-rcvh.ch:
+		if tries != 5 {
+			t.Errorf("invalid number of tries: actual=%v want=5", tries)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("snoozed message is not delivered")
+	}
+
+	if l := app.DeadLetters().List(); len(l) != 0 {
+		t.Errorf("snoozed message is in dead letters: %v", l)
+	}
+}
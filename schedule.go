@@ -0,0 +1,260 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	bhgob "github.com/kandoo/beehive/gob"
+	"github.com/kandoo/beehive/state"
+)
+
+const (
+	// scheduleDict is the dictionary that stores the scheduled messages of a
+	// bee.
+	scheduleDict = "__schedule__"
+	// appScheduler is the app that schedules the messages emitted by hives.
+	appScheduler = "bh_scheduler"
+)
+
+// ErrNoScheduler is returned when a hive without a scheduler app schedules a
+// message.
+var ErrNoScheduler = errors.New("hive has no scheduler")
+
+// scheduledMsg is a message that is emitted at Due. If App is set, the message
+// is sent to the bee that owns Cell in App when it is due.
+type scheduledMsg struct {
+	Due  time.Time
+	Msg  msg
+	App  string
+	Cell CellKey
+}
+
+func scheduleKey(sm scheduledMsg) string {
+	return fmt.Sprintf("%016X/%v", sm.Due.UnixNano(), sm.Msg.MsgID)
+}
+
+// schedule stores sm in the state of the bee and arms the scheduler of the
+// bee. Since the scheduled message is a part of the bee's state, it is
+// replicated along with the current transaction and is discarded if the
+// transaction is aborted.
+func (b *bee) schedule(sm scheduledMsg) {
+	// The ID is assigned here so that the message keeps its ID when it is
+	// emitted by a new leader after a failover.
+	if sm.Msg.MsgID.IsNil() {
+		sm.Msg.MsgID = b.hive.newMsgID()
+	}
+
+	if err := b.Dict(scheduleDict).PutGob(scheduleKey(sm), sm); err != nil {
+		glog.Errorf("%v cannot schedule %v: %v", b, sm.Msg, err)
+		return
+	}
+	glog.V(2).Infof("%v schedules %v at %v", b, sm.Msg, sm.Due)
+	b.armScheduler(sm.Due)
+}
+
+// armScheduler makes sure that the scheduled messages of the bee are
+// inspected at t.
+func (b *bee) armScheduler(t time.Time) {
+	if b.schedTimer != nil {
+		if !b.schedAt.After(t) {
+			return
+		}
+		b.schedTimer.Stop()
+	}
+
+	b.schedAt = t
+	b.schedTimer = time.AfterFunc(t.Sub(time.Now()), func() {
+		b.enqueCmd(newCmdAndChannel(cmdFireScheduled{}, b.app.Name(), b.ID(),
+			nil))
+	})
+}
+
+func (b *bee) disarmScheduler() {
+	if b.schedTimer == nil {
+		return
+	}
+	b.schedTimer.Stop()
+	b.schedTimer = nil
+}
+
+// fireScheduled emits the scheduled messages and the cell timers that are
+// due, deletes the expired keys, and re-arms the scheduler for the remaining
+// ones. Only the leader of a colony fires the scheduled messages and expires
+// keys, and the changes are replicated to followers in a transaction.
+func (b *bee) fireScheduled() {
+	b.schedTimer = nil
+	if !b.detached && !b.isLeader() {
+		return
+	}
+
+	now := time.Now()
+	keys, msgs, next := b.dueScheduledMsgs(now)
+	timers, tnext := b.dueTimers(now)
+	if next.IsZero() || (!tnext.IsZero() && tnext.Before(next)) {
+		next = tnext
+	}
+	dicts, _ := b.currentState()
+	exp := state.NextExpiry(dicts)
+	expire := !exp.IsZero() && !exp.After(now)
+
+	if len(msgs) != 0 || len(timers) != 0 || expire {
+		usetx := b.app.transactional()
+		if usetx {
+			if err := b.BeginTx(); err != nil {
+				glog.Errorf("%v cannot fire scheduled messages: %v", b, err)
+				b.armScheduler(now.Add(b.hive.config.RaftElectTimeout()))
+				return
+			}
+		}
+
+		d := b.Dict(scheduleDict)
+		for i := range msgs {
+			d.Del(keys[i])
+			b.emitScheduled(msgs[i])
+		}
+
+		d = b.Dict(timerDict)
+		for _, t := range timers {
+			b.emitScheduled(scheduledMsg{Msg: t.firingMsg(), App: t.App,
+				Cell: t.Cell})
+			if t.Next.IsZero() {
+				d.Del(t.Name)
+				continue
+			}
+			d.PutGob(t.Name, t)
+			if next.IsZero() || t.Next.Before(next) {
+				next = t.Next
+			}
+		}
+
+		if expire {
+			dicts, _ = b.currentState()
+			n := state.Expire(dicts, now)
+			glog.V(2).Infof("%v expires %d keys", b, n)
+			exp = state.NextExpiry(dicts)
+		}
+
+		if usetx {
+			if err := b.CommitTx(); err != nil && err != state.ErrNoTx {
+				glog.Errorf("%v cannot commit scheduled messages: %v", b, err)
+				b.AbortTx()
+				next = now.Add(b.hive.config.RaftElectTimeout())
+				exp = time.Time{}
+			}
+		}
+	}
+
+	if next.IsZero() || (!exp.IsZero() && exp.Before(next)) {
+		next = exp
+	}
+	if !next.IsZero() {
+		b.armScheduler(next)
+	}
+}
+
+// dueScheduledMsgs returns the scheduled messages that are due at now along
+// with their keys, and the earliest due time of the other messages.
+func (b *bee) dueScheduledMsgs(now time.Time) (keys []string,
+	msgs []scheduledMsg, next time.Time) {
+
+	b.Dict(scheduleDict).ForEach(func(k string, v []byte) {
+		var sm scheduledMsg
+		if err := bhgob.Decode(&sm, v); err != nil {
+			glog.Errorf("%v cannot decode scheduled message %v: %v", b, k, err)
+			return
+		}
+		if sm.Due.After(now) {
+			if next.IsZero() || sm.Due.Before(next) {
+				next = sm.Due
+			}
+			return
+		}
+		keys = append(keys, k)
+		msgs = append(msgs, sm)
+	})
+	return
+}
+
+func (b *bee) emitScheduled(sm scheduledMsg) {
+	m := sm.Msg
+	// Scheduled messages can be restored from older versions of the app.
+	if err := upcastMsg(&m); err != nil {
+		glog.Errorf("%v cannot upcast %v: %v", b, m, err)
+		return
+	}
+	if sm.App != "" {
+		// If no bee owns the cell yet, the message is emitted as is and is
+		// mapped to the cell by its handler.
+		bi, _, err := b.hive.registry.beeForCells(sm.App, MappedCells{sm.Cell})
+		if err == nil {
+			m.MsgTo = bi.ID
+		} else {
+			glog.V(2).Infof("%v finds no bee in app %v for cell %v", b, sm.App,
+				sm.Cell)
+		}
+	}
+	glog.V(2).Infof("%v emits scheduled message %v", b, m)
+	b.bufferOrEmit(&m)
+}
+
+func (b *bee) EmitAfter(d time.Duration, msgData interface{}) {
+	b.schedule(scheduledMsg{
+		Due: time.Now().Add(d),
+		Msg: *b.newMsg(msgData, b.ID(), 0),
+	})
+}
+
+func (b *bee) SendToCellAt(t time.Time, msgData interface{}, app string,
+	cell CellKey) {
+
+	b.schedule(scheduledMsg{
+		Due:  t,
+		Msg:  *b.newMsg(msgData, 0, 0),
+		App:  app,
+		Cell: cell,
+	})
+}
+
+// scheduleReq is emitted by hives to schedule a message on the scheduler app.
+type scheduleReq scheduledMsg
+
+type schedulerHandler struct{}
+
+func (h schedulerHandler) Rcv(m Msg, ctx RcvContext) error {
+	ctx.(*bee).schedule(scheduledMsg(m.Data().(scheduleReq)))
+	return nil
+}
+
+func (h schedulerHandler) Map(m Msg, ctx MapContext) MappedCells {
+	return ctx.LocalMappedCells()
+}
+
+// newAppScheduler installs the app that durably stores the messages scheduled
+// by the hive.
+func newAppScheduler(h *hive) {
+	a := h.NewApp(appScheduler, Persistent(h.config.SchedReplFactor))
+	a.Handle(scheduleReq{}, schedulerHandler{})
+	glog.V(1).Infof("%v installs app scheduler", h)
+}
+
+func (h *hive) EmitAfter(d time.Duration, msgData interface{}) error {
+	return h.EmitAt(time.Now().Add(d), msgData)
+}
+
+func (h *hive) EmitAt(t time.Time, msgData interface{}) error {
+	if _, ok := h.app(appScheduler); !ok {
+		return ErrNoScheduler
+	}
+	return h.TryEmit(scheduleReq{
+		Due: t,
+		Msg: msg{MsgData: msgData},
+	})
+}
+
+func init() {
+	gob.Register(scheduleReq{})
+	gob.Register(scheduledMsg{})
+}
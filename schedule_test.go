@@ -0,0 +1,188 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type scheduleTestMsg int
+
+func registerScheduleTestApp(h Hive, d time.Duration, ch chan time.Time,
+	options ...AppOption) App {
+
+	app := h.NewApp("schedule", options...)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	app.HandleFunc(MyMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+		ctx.EmitAfter(d, scheduleTestMsg(msg.Data().(MyMsg)))
+		ch <- time.Time{}
+		return nil
+	})
+	app.HandleFunc(scheduleTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+		ch <- time.Now()
+		return nil
+	})
+	return app
+}
+
+func TestEmitAfter(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_schedule"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	d := 200 * time.Millisecond
+	ch := make(chan time.Time, 2)
+	registerScheduleTestApp(h, d, ch)
+	go h.Start()
+	defer h.Stop()
+
+	start := time.Now()
+	h.Emit(MyMsg(1))
+	<-ch
+	select {
+	case at := <-ch:
+		if at.Sub(start) < d {
+			t.Errorf("scheduled message is emitted too early: %v", at.Sub(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled message is not emitted")
+	}
+}
+
+func TestHiveEmitAfter(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_hive_schedule"
+	cfg.Addr = newHiveAddrForTest()
+	cfg.SchedReplFactor = 1
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	ch := make(chan time.Time, 1)
+	app := h.NewApp("schedule")
+	app.HandleFunc(scheduleTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- time.Now()
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	d := 200 * time.Millisecond
+	start := time.Now()
+	if err := h.EmitAfter(d, scheduleTestMsg(1)); err != nil {
+		t.Fatalf("cannot schedule message: %v", err)
+	}
+	select {
+	case at := <-ch:
+		if at.Sub(start) < d {
+			t.Errorf("scheduled message is emitted too early: %v", at.Sub(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled message is not emitted")
+	}
+}
+
+func TestScheduledMsgAfterRestart(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_schedule_restart"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+
+	h := NewHiveWithConfig(cfg)
+	ch := make(chan time.Time, 2)
+	registerScheduleTestApp(h, 2*time.Second, ch, Persistent(1))
+	go h.Start()
+	waitTilStareted(h)
+
+	h.Emit(MyMsg(1))
+	<-ch
+	h.Stop()
+
+	time.Sleep(1 * time.Second)
+	h = NewHiveWithConfig(cfg)
+	registerScheduleTestApp(h, 2*time.Second, ch, Persistent(1))
+	go h.Start()
+	defer h.Stop()
+
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatal("scheduled message is lost after restart")
+	}
+}
+
+func TestSendToCellAt(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_schedule_cell"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	cell := CellKey{Dict: "D", Key: "0"}
+	ch1 := make(chan scheduleTestMsg, 2)
+	ch2 := make(chan scheduleTestMsg, 2)
+	app1 := h.NewApp("schedule1")
+	app1.HandleFunc(MyMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+		ctx.SendToCellAt(time.Now().Add(100*time.Millisecond),
+			scheduleTestMsg(msg.Data().(MyMsg)), "schedule2", cell)
+		return nil
+	})
+	app1.HandleFunc(scheduleTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+		ch1 <- msg.Data().(scheduleTestMsg)
+		return nil
+	})
+	app2 := h.NewApp("schedule2")
+	app2.HandleFunc(scheduleTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+		ch2 <- msg.Data().(scheduleTestMsg)
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+
+	// Create the bees of both apps.
+	h.Emit(scheduleTestMsg(0))
+	<-ch1
+	<-ch2
+
+	h.Emit(MyMsg(1))
+	select {
+	case m := <-ch2:
+		if m != 1 {
+			t.Errorf("invalid message: actual=%v want=1", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled message is not sent to the cell")
+	}
+	select {
+	case m := <-ch1:
+		t.Errorf("scheduled message %v is sent to the wrong app", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestEmitAfterWithoutScheduler(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_no_schedule"
+	cfg.Addr = newHiveAddrForTest()
+	cfg.InMemory = true
+	cfg.SchedReplFactor = 0
+	h := NewHiveWithConfig(cfg)
+	if _, ok := h.(*hive).app(appScheduler); ok {
+		t.Errorf("scheduler app is installed")
+	}
+	if err := h.EmitAfter(time.Second, scheduleTestMsg(1)); err !=
+		ErrNoScheduler {
+
+		t.Errorf("invalid error: actual=%v want=%v", err, ErrNoScheduler)
+	}
+}
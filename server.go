@@ -2,10 +2,13 @@ package beehive
 
 import (
 	"bytes"
-	"encoding/gob"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,7 +21,9 @@ import (
 )
 
 // state is served as json while other endpoints serve gob. The reason is that
-// state should be human readable.
+// state should be human readable. Messages and commands are decoded using the
+// codec of the request's content type, and command results are encoded using
+// the same codec.
 const (
 	serverV1StatePath   = "/api/v1/state"
 	serverV1BeesPath    = "/api/v1/bees"
@@ -26,6 +31,9 @@ const (
 	serverV1CmdPath     = "/api/v1/cmd"
 	serverV1RaftPath    = "/api/v1/raft"
 	serverV1BeeRaftPath = "/api/v1/beeraft"
+
+	serverV1DeadLettersPath = "/api/v1/deadletters"
+	serverV1ChangesPath     = "/api/v1/changes"
 )
 
 func buildURL(scheme, addr, path string) string {
@@ -81,18 +89,47 @@ func (h *v1Handler) install(r *mux.Router) {
 	r.HandleFunc(serverV1CmdPath, h.handleCmd)
 	r.HandleFunc(serverV1BeeRaftPath, h.handleBeeRaft)
 	r.HandleFunc(serverV1RaftPath, h.handleRaft)
+
+	r.HandleFunc(serverV1DeadLettersPath, h.handleDeadLetters).Methods("GET")
+	r.HandleFunc(serverV1DeadLettersPath+"/{app}", h.handleAppDeadLetters).
+		Methods("GET")
+	r.HandleFunc(serverV1DeadLettersPath+"/{app}", h.handlePurgeDeadLetters).
+		Methods("DELETE")
+	r.HandleFunc(serverV1DeadLettersPath+"/{app}/{id:[0-9]+}",
+		h.handlePurgeDeadLetter).Methods("DELETE")
+	r.HandleFunc(serverV1DeadLettersPath+"/{app}/{id:[0-9]+}/replay",
+		h.handleReplayDeadLetter).Methods("POST")
+
+	r.HandleFunc(serverV1ChangesPath+"/{app}/{dict}", h.handleChanges).
+		Methods("GET")
+
+	r.HandleFunc(serverV1StatePath+"/{app}/{id:[0-9]+}", h.handleExportState).
+		Methods("GET")
+	r.HandleFunc(serverV1StatePath+"/{app}/{id:[0-9]+}", h.handleImportState).
+		Methods("POST")
 }
 
+// serverAcceptedHeader is the HTTP header that contains the number of messages
+// accepted by the hive when it rejects the rest of the messages.
+const serverAcceptedHeader = "X-Beehive-Accepted"
+
 func (h *v1Handler) handleMsg(w http.ResponseWriter, r *http.Request) {
-	dec := gob.NewDecoder(r.Body)
+	dec := newMsgDecoder(codecByContentType(r.Header.Get("Content-Type")),
+		r.Body)
 	var err error
+	accepted := 0
 	for {
 		var m msg
 		err = dec.Decode(&m)
 		if err != nil {
 			break
 		}
-		h.srv.hive.enqueMsg(&m)
+		if err = h.srv.hive.enqueMsg(&m); err != nil {
+			w.Header().Set(serverAcceptedHeader, strconv.Itoa(accepted))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		accepted++
 	}
 	if err != io.EOF {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -100,8 +137,10 @@ func (h *v1Handler) handleMsg(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *v1Handler) handleCmd(w http.ResponseWriter, r *http.Request) {
-	dec := gob.NewDecoder(r.Body)
-	enc := gob.NewEncoder(w)
+	codec := codecByContentType(r.Header.Get("Content-Type"))
+	w.Header().Set("Content-Type", codec.ContentType())
+	dec := newCmdDecoder(codec, r.Body)
+	enc := newCmdEncoder(codec, w)
 
 	for {
 		var c cmd
@@ -119,7 +158,7 @@ func (h *v1Handler) handleCmd(w http.ResponseWriter, r *http.Request) {
 			glog.Errorf("error in running remote command: %v", res.Err)
 			res.Err = bhgob.Error(res.Err.Error())
 		}
-		if err := enc.Encode(res); err != nil {
+		if err := enc.EncodeResult(res); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -279,3 +318,187 @@ func (h *v1Handler) handleBees(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(j)
 }
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func (h *v1Handler) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	dls := make(map[string][]DeadLetter)
+	for _, a := range h.srv.hive.appList() {
+		dls[a.Name()] = a.dlq.List()
+	}
+	writeJSON(w, dls)
+}
+
+// deadLetters returns the dead-letter queue of the app in the request path.
+func (h *v1Handler) deadLetters(w http.ResponseWriter,
+	r *http.Request) (DeadLetters, bool) {
+
+	n := mux.Vars(r)["app"]
+	a, ok := h.srv.hive.app(n)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such app %v", n), http.StatusNotFound)
+		return nil, false
+	}
+	return a.DeadLetters(), true
+}
+
+func (h *v1Handler) handleAppDeadLetters(w http.ResponseWriter,
+	r *http.Request) {
+
+	dlq, ok := h.deadLetters(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, dlq.List())
+}
+
+func (h *v1Handler) handlePurgeDeadLetters(w http.ResponseWriter,
+	r *http.Request) {
+
+	dlq, ok := h.deadLetters(w, r)
+	if !ok {
+		return
+	}
+	dlq.PurgeAll()
+}
+
+func (h *v1Handler) handlePurgeDeadLetter(w http.ResponseWriter,
+	r *http.Request) {
+
+	h.handleDeadLetter(w, r, DeadLetters.Purge)
+}
+
+func (h *v1Handler) handleReplayDeadLetter(w http.ResponseWriter,
+	r *http.Request) {
+
+	h.handleDeadLetter(w, r, DeadLetters.Replay)
+}
+
+func (h *v1Handler) handleDeadLetter(w http.ResponseWriter, r *http.Request,
+	fn func(dlq DeadLetters, id uint64) error) {
+
+	dlq, ok := h.deadLetters(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := fn(dlq, id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+// handleChanges streams the changes committed to a dictionary by the local
+// bees of an application as newline-delimited JSON.
+func (h *v1Handler) handleChanges(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	a, ok := h.srv.hive.app(vars["app"])
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such app %v", vars["app"]),
+			http.StatusNotFound)
+		return
+	}
+	d := vars["dict"]
+	if a.changes == nil || !a.changes.watches(d) {
+		http.Error(w, fmt.Sprintf("changes of %v/%v are not published", a.Name(),
+			d), http.StatusNotFound)
+		return
+	}
+
+	ch := a.changes.subscribe(d)
+	defer a.changes.unsubscribe(d, ch)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f, _ := w.(http.Flusher)
+	if f != nil {
+		f.Flush()
+	}
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case c, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(c); err != nil {
+				return
+			}
+			if f != nil {
+				f.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// beeStateCmd processes a command for the bee in the request path.
+func (h *v1Handler) beeStateCmd(w http.ResponseWriter, r *http.Request,
+	data interface{}) (interface{}, bool) {
+
+	vars := mux.Vars(r)
+	if _, ok := h.srv.hive.app(vars["app"]); !ok {
+		http.Error(w, fmt.Sprintf("no such app %v", vars["app"]),
+			http.StatusNotFound)
+		return nil, false
+	}
+	id, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	res := h.processCommand(cmd{App: vars["app"], To: id, Data: data})
+	if res.Err != nil {
+		http.Error(w, res.Err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return res.Data, true
+}
+
+// handleExportState writes the state of a local bee as JSON lines. The
+// dictionaries to export can be specified using the comma-separated "dicts"
+// parameter.
+func (h *v1Handler) handleExportState(w http.ResponseWriter,
+	r *http.Request) {
+
+	var dicts []string
+	if d := r.URL.Query().Get("dicts"); d != "" {
+		dicts = strings.Split(d, ",")
+	}
+	data, ok := h.beeStateCmd(w, r, cmdExportState{Dicts: dicts})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Write(data.([]byte))
+}
+
+// handleImportState imports JSON lines of records into the state of a local
+// bee in a transaction.
+func (h *v1Handler) handleImportState(w http.ResponseWriter,
+	r *http.Request) {
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, ok := h.beeStateCmd(w, r, cmdImportState{Data: b})
+	if !ok {
+		return
+	}
+	writeJSON(w, map[string]int{"records": data.(int)})
+}
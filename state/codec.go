@@ -0,0 +1,73 @@
+package state
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"reflect"
+)
+
+// Codec encodes the snapshots of states. The codecs of beehive (e.g., its JSON
+// codec) implement Codec. When the codec of a state is nil, its snapshots are
+// encoded using gob.
+type Codec interface {
+	// Marshal encodes v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes b into v.
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// marshal encodes v using c, or using gob if c is nil.
+func marshal(c Codec, v interface{}) ([]byte, error) {
+	if c != nil {
+		return c.Marshal(v)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshal decodes b into v using c. If c is nil or cannot decode b, b is
+// decoded using gob, so that the snapshots saved before the codec of a state
+// is changed can still be restored.
+func unmarshal(c Codec, b []byte, v interface{}) error {
+	if c != nil {
+		err := c.Unmarshal(b, v)
+		if err == nil {
+			return nil
+		}
+		// c may have partially decoded b into v.
+		p := reflect.ValueOf(v).Elem()
+		p.Set(reflect.Zero(p.Type()))
+		if gob.NewDecoder(bytes.NewBuffer(b)).Decode(v) != nil {
+			return err
+		}
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewBuffer(b)).Decode(v)
+}
+
+// decodeOps decodes the operations in a snapshot of an OnDisk state, which is
+// either a list of operations encoded using c or a stream of operations
+// encoded using gob.
+func decodeOps(c Codec, b []byte) ([]Op, error) {
+	var ops []Op
+	if c != nil && c.Unmarshal(b, &ops) == nil {
+		return ops, nil
+	}
+
+	ops = nil
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	for {
+		var o Op
+		if err := dec.Decode(&o); err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			return ops, nil
+		}
+		ops = append(ops, o)
+	}
+}
@@ -0,0 +1,133 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+type jsonTestCodec struct{}
+
+func (c jsonTestCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonTestCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+func checkCodecTestState(t *testing.T, s State, want string) {
+	if v, err := s.Dict("d").Get("k"); err != nil || !bytes.Equal(v,
+		[]byte(want)) {
+
+		t.Errorf("invalid value: actual=%s want=%s (%v)", v, want, err)
+	}
+}
+
+func TestInMemCodec(t *testing.T) {
+	s := NewInMem()
+	s.SetCodec(jsonTestCodec{})
+	s.Dict("d").Put("k", []byte("v"))
+	b, err := s.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if !json.Valid(b) {
+		t.Errorf("snapshot is not encoded using the codec: %q", b)
+	}
+
+	r := NewInMem()
+	r.SetCodec(jsonTestCodec{})
+	if err := r.Restore(b); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+	checkCodecTestState(t, r, "v")
+
+	// Snapshots saved using gob are still restored.
+	g := NewInMem()
+	g.Dict("d").Put("k", []byte("g"))
+	if b, err = g.Save(); err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if err := r.Restore(b); err != nil {
+		t.Fatalf("cannot restore a gob snapshot: %v", err)
+	}
+	checkCodecTestState(t, r, "g")
+}
+
+func TestOnDiskCodec(t *testing.T) {
+	s := newOnDiskForTest(t, t.TempDir())
+	defer s.Close()
+	s.SetCodec(jsonTestCodec{})
+	s.Dict("d").Put("k", []byte("v"))
+	b, err := s.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if !json.Valid(b) {
+		t.Errorf("snapshot is not encoded using the codec: %q", b)
+	}
+
+	r := newOnDiskForTest(t, t.TempDir())
+	defer r.Close()
+	r.SetCodec(jsonTestCodec{})
+	if err := r.Restore(b); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+	checkCodecTestState(t, r, "v")
+
+	m := NewInMem()
+	m.SetCodec(jsonTestCodec{})
+	if err := m.Restore(b); err != nil {
+		t.Fatalf("cannot restore into an in-memory state: %v", err)
+	}
+	checkCodecTestState(t, m, "v")
+}
+
+func TestIncrementalCodec(t *testing.T) {
+	newState := func() *Incremental {
+		inm := NewInMem()
+		inm.SetCodec(jsonTestCodec{})
+		s := NewIncremental(inm)
+		s.Codec = jsonTestCodec{}
+		return s
+	}
+
+	leader := newState()
+	for i := 0; i < 10; i++ {
+		leader.Dict("d").Put(string('a'+byte(i)), []byte("v"))
+	}
+	b1, err := leader.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	follower := newState()
+	if err := follower.Restore(b1); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+
+	leader.Dict("d").Put("k", []byte("v"))
+	b2, err := leader.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if !json.Valid(b2) {
+		t.Errorf("snapshot is not encoded using the codec: %q", b2)
+	}
+	if _, ok := SnapshotID(b2); ok {
+		t.Error("snapshot is decoded using gob")
+	}
+
+	id, ok := follower.SnapshotID(b1)
+	if !ok {
+		t.Fatal("cannot find the ID of the snapshot")
+	}
+	d, ok := leader.DeltaSnapshot(b2, id)
+	if !ok {
+		t.Fatal("cannot create a delta snapshot")
+	}
+	if err := follower.Restore(d); err != nil {
+		t.Fatalf("cannot restore the delta snapshot: %v", err)
+	}
+	checkCodecTestState(t, follower, "v")
+}
@@ -3,10 +3,17 @@ package state
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
+	"strconv"
+	"time"
 )
 
 type IterFn func(k string, v []byte)
 
+// RangeFn is called for the entries of a dictionary in order. The scan stops
+// when it returns false.
+type RangeFn func(k string, v []byte) bool
+
 // Dict is a simple key-value store.
 type Dict interface {
 	Name() string
@@ -16,6 +23,45 @@ type Dict interface {
 	Del(k string) error
 	ForEach(f IterFn)
 
+	// PutWithTTL stores v for k, and deletes k once ttl elapses. Expired keys
+	// are deleted by the owner of the state (e.g., the leader of a colony) in a
+	// transaction, using Expire. The deadline of the key is kept when the key
+	// is updated using Put, is reset by PutWithTTL, and is removed by Del.
+	// Deadlines are only maintained by Transactional states, and other
+	// dictionaries return ErrTTLUnsupported.
+	PutWithTTL(k string, v []byte, ttl time.Duration) error
+
+	// CompareAndSwap stores new for k if the current value of k is old, and
+	// returns whether the value is stored. If old is nil, new is only stored if
+	// k does not exist.
+	CompareAndSwap(k string, old, new []byte) (bool, error)
+	// Increment adds delta to the integer value of k and returns the new
+	// value. Integers are stored as decimal strings, and keys that do not exist
+	// are considered zero.
+	Increment(k string, delta int64) (int64, error)
+	// GetOrPut returns the value of k if it exists. Otherwise, it stores v for
+	// k and returns v. loaded is true if the value existed.
+	GetOrPut(k string, v []byte) (actual []byte, loaded bool, err error)
+
+	// Range calls f for the keys in [start, end) in ascending order, until f
+	// returns false. If end is empty, there is no upper bound.
+	Range(start, end string, f RangeFn)
+	// ReverseRange calls f for the keys in [start, end) in descending order,
+	// until f returns false. If end is empty, there is no upper bound.
+	ReverseRange(start, end string, f RangeFn)
+	// Prefix calls f for the keys with prefix p in ascending order, until f
+	// returns false.
+	Prefix(p string, f RangeFn)
+	// ReversePrefix calls f for the keys with prefix p in descending order,
+	// until f returns false.
+	ReversePrefix(p string, f RangeFn)
+
+	// Index returns the secondary index of the dictionary with the given name.
+	// Indexes are defined using Transactional.AddIndex and are maintained when
+	// keys are modified through a Transactional state. The indexes of other
+	// dictionaries return ErrNoSuchIndex.
+	Index(name string) Index
+
 	// GetGob retrieves the value stored for k in d, and decodes it into v using
 	// gob. Returns error when there is no value or when it cannot decode it.
 	GetGob(k string, v interface{}) error
@@ -42,3 +88,65 @@ func PutGob(d Dict, k string, v interface{}) error {
 	d.Put(k, buf.Bytes())
 	return nil
 }
+
+// CompareAndSwap implements Dict.CompareAndSwap using d's Get and Put.
+func CompareAndSwap(d Dict, k string, old, new []byte) (bool, error) {
+	if !casMatches(d, k, old) {
+		return false, nil
+	}
+	if err := d.Put(k, new); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func casMatches(d Dict, k string, old []byte) bool {
+	v, err := d.Get(k)
+	if old == nil {
+		return err != nil
+	}
+	return err == nil && bytes.Equal(v, old)
+}
+
+// Increment implements Dict.Increment using d's Get and Put.
+func Increment(d Dict, k string, delta int64) (int64, error) {
+	n, err := GetInt(d, k)
+	if err != nil {
+		return 0, err
+	}
+	n += delta
+	if err := d.Put(k, formatInt(n)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// GetInt returns the integer value of k in d, or zero if k does not exist.
+func GetInt(d Dict, k string) (int64, error) {
+	v, err := d.Get(k)
+	if err != nil {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %v is not an integer: %v", k, err)
+	}
+	return n, nil
+}
+
+func formatInt(n int64) []byte {
+	return []byte(strconv.FormatInt(n, 10))
+}
+
+// GetOrPut implements Dict.GetOrPut using d's Get and Put.
+func GetOrPut(d Dict, k string, v []byte) (actual []byte, loaded bool,
+	err error) {
+
+	if actual, err = d.Get(k); err == nil {
+		return actual, true, nil
+	}
+	if err = d.Put(k, v); err != nil {
+		return nil, false, err
+	}
+	return v, false, nil
+}
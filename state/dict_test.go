@@ -0,0 +1,145 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func collectKeys(scan func(f RangeFn), limit int) []string {
+	var keys []string
+	scan(func(k string, v []byte) bool {
+		if k != string(v) {
+			panic("invalid value for " + k)
+		}
+		keys = append(keys, k)
+		return len(keys) < limit
+	})
+	return keys
+}
+
+func testDictRange(t *testing.T, name string, d Dict) {
+	cases := []struct {
+		scan  func(f RangeFn)
+		limit int
+		keys  []string
+	}{
+		{
+			scan:  func(f RangeFn) { d.Range("", "", f) },
+			limit: 100,
+			keys:  []string{"a", "b/1", "b/2", "b/3", "c", "d"},
+		},
+		{
+			scan:  func(f RangeFn) { d.Range("b", "c", f) },
+			limit: 100,
+			keys:  []string{"b/1", "b/2", "b/3"},
+		},
+		{
+			scan:  func(f RangeFn) { d.Range("b/2", "", f) },
+			limit: 2,
+			keys:  []string{"b/2", "b/3"},
+		},
+		{
+			scan:  func(f RangeFn) { d.ReverseRange("", "c", f) },
+			limit: 100,
+			keys:  []string{"b/3", "b/2", "b/1", "a"},
+		},
+		{
+			scan:  func(f RangeFn) { d.ReverseRange("", "", f) },
+			limit: 1,
+			keys:  []string{"d"},
+		},
+		{
+			scan:  func(f RangeFn) { d.Prefix("b/", f) },
+			limit: 100,
+			keys:  []string{"b/1", "b/2", "b/3"},
+		},
+		{
+			scan:  func(f RangeFn) { d.ReversePrefix("b/", f) },
+			limit: 2,
+			keys:  []string{"b/3", "b/2"},
+		},
+		{
+			scan:  func(f RangeFn) { d.Prefix("x", f) },
+			limit: 100,
+			keys:  nil,
+		},
+	}
+	for i, c := range cases {
+		if keys := collectKeys(c.scan, c.limit); !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("%v: invalid keys in scan %d: actual=%v want=%v", name, i, keys,
+				c.keys)
+		}
+	}
+}
+
+func putKeys(d Dict, keys ...string) {
+	for _, k := range keys {
+		d.Put(k, []byte(k))
+	}
+}
+
+func TestInMemRange(t *testing.T) {
+	d := NewInMem().Dict("d")
+	putKeys(d, "d", "b/2", "a", "b/1", "x", "c")
+	// Scan once to build the sorted keys and then modify the dictionary.
+	d.Range("", "", func(k string, v []byte) bool { return true })
+	putKeys(d, "b/3")
+	d.Del("x")
+	testDictRange(t, "inmem", d)
+}
+
+func TestOnDiskRange(t *testing.T) {
+	s := newOnDiskForTest(t, t.TempDir())
+	defer s.Close()
+	d := s.Dict("d")
+	putKeys(d, "d", "b/2", "a", "b/1", "x", "c")
+	d.Range("", "", func(k string, v []byte) bool { return true })
+	putKeys(d, "b/3")
+	d.Del("x")
+	testDictRange(t, "ondisk", d)
+}
+
+func TestTxRange(t *testing.T) {
+	inm := NewInMem()
+	putKeys(inm.Dict("d"), "d", "b/2", "a", "x", "y")
+	tx := NewTransactional(inm)
+	tx.BeginTx()
+	d := tx.Dict("d")
+	putKeys(d, "b/1", "b/3", "c")
+	d.Del("x")
+	d.Del("y")
+	testDictRange(t, "tx", d)
+}
+
+func TestRangeModify(t *testing.T) {
+	d := NewInMem().Dict("d")
+	putKeys(d, "a", "b", "c", "d")
+	var keys []string
+	d.Range("", "", func(k string, v []byte) bool {
+		keys = append(keys, k)
+		d.Del(k)
+		if k == "b" {
+			putKeys(d, "bb")
+		}
+		return true
+	})
+	want := []string{"a", "b", "bb", "c", "d"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("invalid keys: actual=%v want=%v", keys, want)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"":         "",
+		"a":        "b",
+		"a/":       "a0",
+		"a\xff":    "b",
+		"\xff\xff": "",
+	}
+	for p, e := range cases {
+		if a := prefixEnd(p); a != e {
+			t.Errorf("invalid prefix end for %q: actual=%q want=%q", p, a, e)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+const (
+	diskLogName = "dicts.log"
+	// diskHeaderLen is the length of the record header: crc (4), op (1),
+	// dictionary length (4), key length (4) and value length (4).
+	diskHeaderLen = 17
+	// The log is compacted when it has more than diskCompactMinBytes of stale
+	// records and stale records are more than half of the log.
+	diskCompactMinBytes = 1 << 20
+)
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// OnDisk is a state that stores its dictionaries in an append-only log on
+// disk. Only the keys and the location of their values in the log are kept in
+// memory, and values are read from the disk on demand. Stale records are
+// removed from the log by compacting it once they occupy more than half of
+// the log.
+//
+// Similar to InMem, OnDisk is not thread-safe.
+type OnDisk struct {
+	name  string // Path of the log.
+	f     *os.File
+	size  int64 // Size of the log.
+	stale int64 // Size of the stale records in the log.
+	iters int   // Number of ongoing iterations, which block compaction.
+	index map[string]map[string]diskLoc
+	keys  map[string]*sortedKeys // Sorted keys of scanned dictionaries.
+	codec Codec                  // Codec of the snapshots.
+}
+
+// diskLoc is the location of a record in the log.
+type diskLoc struct {
+	off  int64  // Offset of the record.
+	klen uint32 // Length of the key.
+	vlen uint32 // Length of the value.
+	dlen uint32 // Length of the dictionary name.
+}
+
+func (l diskLoc) len() int64 {
+	return int64(diskHeaderLen + l.dlen + l.klen + l.vlen)
+}
+
+func (l diskLoc) valOff() int64 {
+	return l.off + int64(diskHeaderLen+l.dlen+l.klen)
+}
+
+// NewOnDisk opens the on-disk state stored in dir, and creates one if it does
+// not exist.
+func NewOnDisk(dir string) (*OnDisk, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	name := path.Join(dir, diskLogName)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &OnDisk{
+		name:  name,
+		f:     f,
+		index: make(map[string]map[string]diskLoc),
+		keys:  make(map[string]*sortedKeys),
+	}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load rebuilds the index from the log. If the log ends with a partially
+// written record, the record is truncated.
+func (s *OnDisk) load() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, fi.Size()))
+	var off int64
+	for {
+		op, d, k, v, err := readDiskRecord(r, fi.Size()-off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			glog.Warningf("truncating %v at %d: %v", s.name, off, err)
+			if err := s.f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+
+		l := diskLoc{
+			off:  off,
+			dlen: uint32(len(d)),
+			klen: uint32(len(k)),
+			vlen: uint32(len(v)),
+		}
+		off += l.len()
+		s.apply(op, d, k, l)
+	}
+	s.size = off
+	return nil
+}
+
+// apply updates the index for a record written at l.
+func (s *OnDisk) apply(op OpType, d, k string, l diskLoc) {
+	dict := s.dictIndex(d)
+	old, ok := dict[k]
+	if ok {
+		s.stale += old.len()
+	}
+
+	switch op {
+	case Put:
+		dict[k] = l
+		if keys := s.keys[d]; !ok && keys != nil {
+			keys.add(k)
+		}
+	case Del:
+		delete(dict, k)
+		s.stale += l.len()
+		if keys := s.keys[d]; keys != nil {
+			keys.del(k)
+		}
+	}
+}
+
+func (s *OnDisk) dictIndex(name string) map[string]diskLoc {
+	d, ok := s.index[name]
+	if !ok {
+		d = make(map[string]diskLoc)
+		s.index[name] = d
+	}
+	return d
+}
+
+// write appends a record to the log.
+func (s *OnDisk) write(op OpType, d, k string, v []byte) error {
+	b := encodeDiskRecord(op, d, k, v)
+	if _, err := s.f.WriteAt(b, s.size); err != nil {
+		return err
+	}
+
+	l := diskLoc{
+		off:  s.size,
+		dlen: uint32(len(d)),
+		klen: uint32(len(k)),
+		vlen: uint32(len(v)),
+	}
+	s.size += l.len()
+	s.apply(op, d, k, l)
+	return s.maybeCompact()
+}
+
+func (s *OnDisk) read(l diskLoc) ([]byte, error) {
+	v := make([]byte, l.vlen)
+	if _, err := s.f.ReadAt(v, l.valOff()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *OnDisk) maybeCompact() error {
+	if s.iters > 0 || s.stale < diskCompactMinBytes || s.stale < s.size/2 {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact rewrites the log with only the live records.
+func (s *OnDisk) compact() error {
+	tmp, err := os.OpenFile(s.name+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	index := make(map[string]map[string]diskLoc, len(s.index))
+	var off int64
+	for d, dict := range s.index {
+		if len(dict) == 0 {
+			continue
+		}
+		nd := make(map[string]diskLoc, len(dict))
+		index[d] = nd
+		for k, l := range dict {
+			v, err := s.read(l)
+			if err == nil {
+				_, err = w.Write(encodeDiskRecord(Put, d, k, v))
+			}
+			if err != nil {
+				tmp.Close()
+				os.Remove(tmp.Name())
+				return err
+			}
+			l.off = off
+			nd[k] = l
+			off += l.len()
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.name); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := syncDir(path.Dir(s.name)); err != nil {
+		glog.Errorf("cannot sync %v: %v", path.Dir(s.name), err)
+	}
+
+	s.f.Close()
+	s.f = tmp
+	s.index = index
+	s.size = off
+	s.stale = 0
+	return nil
+}
+
+// Close closes the log of the state.
+func (s *OnDisk) Close() error {
+	return s.f.Close()
+}
+
+func (s *OnDisk) Dict(name string) Dict {
+	return &diskDict{name: name, s: s}
+}
+
+// DictNames returns the names of the dictionaries in the state.
+func (s *OnDisk) DictNames() []string {
+	names := make([]string, 0, len(s.index))
+	for n := range s.index {
+		names = append(names, n)
+	}
+	return names
+}
+
+// SetCodec sets the codec of the snapshots of the state. The state can still
+// restore the snapshots encoded using gob.
+func (s *OnDisk) SetCodec(c Codec) {
+	s.codec = c
+}
+
+// Save encodes all the entries of the state as Put operations. The operations
+// are encoded as a list using the codec of the state, or as a stream using gob
+// if the state has no codec.
+func (s *OnDisk) Save() ([]byte, error) {
+	var ops []Op
+	for d, dict := range s.index {
+		for k, l := range dict {
+			v, err := s.read(l)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, Op{T: Put, D: d, K: k, V: v})
+		}
+	}
+	if s.codec != nil {
+		return s.codec.Marshal(ops)
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for _, o := range ops {
+		if err := enc.Encode(o); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore replaces the entries of the state with the ones saved in b. The
+// entries are written into a new log, which atomically replaces the current
+// log once it is synced. Hence, the state is not lost if Restore fails.
+func (s *OnDisk) Restore(b []byte) error {
+	tmp, err := os.OpenFile(s.name+".restore", os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0600)
+	if err != nil {
+		return err
+	}
+
+	r := &OnDisk{
+		name:  s.name,
+		f:     tmp,
+		index: make(map[string]map[string]diskLoc),
+		keys:  make(map[string]*sortedKeys),
+		codec: s.codec,
+	}
+	if err := r.restore(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.name); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := syncDir(path.Dir(s.name)); err != nil {
+		glog.Errorf("cannot sync %v: %v", path.Dir(s.name), err)
+	}
+
+	s.f.Close()
+	*s = *r
+	return nil
+}
+
+// restore writes the entries saved in b into the log of s and syncs the log.
+func (s *OnDisk) restore(b []byte) error {
+	ops, err := decodeOps(s.codec, b)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(s.f)
+	for _, o := range ops {
+		if _, err := w.Write(encodeDiskRecord(o.T, o.D, o.K, o.V)); err != nil {
+			return err
+		}
+
+		l := diskLoc{
+			off:  s.size,
+			dlen: uint32(len(o.D)),
+			klen: uint32(len(o.K)),
+			vlen: uint32(len(o.V)),
+		}
+		s.size += l.len()
+		s.apply(o.T, o.D, o.K, l)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// syncDir syncs the directory dir, which persists the files renamed in dir.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type diskDict struct {
+	name string
+	s    *OnDisk
+}
+
+func (d *diskDict) Name() string {
+	return d.name
+}
+
+func (d *diskDict) Get(k string) ([]byte, error) {
+	l, ok := d.s.index[d.name][k]
+	if !ok {
+		return nil, fmt.Errorf("%v does not exist", k)
+	}
+	return d.s.read(l)
+}
+
+func (d *diskDict) Put(k string, v []byte) error {
+	return d.s.write(Put, d.name, k, v)
+}
+
+func (d *diskDict) Del(k string) error {
+	if _, ok := d.s.index[d.name][k]; !ok {
+		return nil
+	}
+	return d.s.write(Del, d.name, k, nil)
+}
+
+func (d *diskDict) ForEach(f IterFn) {
+	d.s.iters++
+	defer func() { d.s.iters-- }()
+	for k, l := range d.s.index[d.name] {
+		v, err := d.s.read(l)
+		if err != nil {
+			glog.Errorf("cannot read %v from %v: %v", k, d.name, err)
+			continue
+		}
+		f(k, v)
+	}
+}
+
+func (d *diskDict) PutWithTTL(k string, v []byte, ttl time.Duration) error {
+	return ErrTTLUnsupported
+}
+
+func (d *diskDict) Index(name string) Index {
+	return noIndex{}
+}
+
+func (d *diskDict) Range(start, end string, f RangeFn) {
+	d.scan(start, end, false, f)
+}
+
+func (d *diskDict) ReverseRange(start, end string, f RangeFn) {
+	d.scan(start, end, true, f)
+}
+
+func (d *diskDict) Prefix(p string, f RangeFn) {
+	d.scan(p, prefixEnd(p), false, f)
+}
+
+func (d *diskDict) ReversePrefix(p string, f RangeFn) {
+	d.scan(p, prefixEnd(p), true, f)
+}
+
+func (d *diskDict) scan(start, end string, reverse bool, f RangeFn) {
+	keys, ok := d.s.keys[d.name]
+	if !ok {
+		keys = &sortedKeys{}
+		d.s.keys[d.name] = keys
+	}
+	keys.build(func(add func(k string)) {
+		for k := range d.s.index[d.name] {
+			add(k)
+		}
+	})
+
+	d.s.iters++
+	defer func() { d.s.iters-- }()
+	keys.scan(start, end, reverse, func(k string) bool {
+		v, err := d.s.read(d.s.index[d.name][k])
+		if err != nil {
+			glog.Errorf("cannot read %v from %v: %v", k, d.name, err)
+			return true
+		}
+		return f(k, v)
+	})
+}
+
+func (d *diskDict) CompareAndSwap(k string, old, new []byte) (bool, error) {
+	return CompareAndSwap(d, k, old, new)
+}
+
+func (d *diskDict) Increment(k string, delta int64) (int64, error) {
+	return Increment(d, k, delta)
+}
+
+func (d *diskDict) GetOrPut(k string, v []byte) ([]byte, bool, error) {
+	return GetOrPut(d, k, v)
+}
+
+func (d *diskDict) GetGob(k string, v interface{}) error {
+	return GetGob(d, k, v)
+}
+
+func (d *diskDict) PutGob(k string, v interface{}) error {
+	return PutGob(d, k, v)
+}
+
+func encodeDiskRecord(op OpType, d, k string, v []byte) []byte {
+	b := make([]byte, diskHeaderLen+len(d)+len(k)+len(v))
+	b[4] = byte(op)
+	binary.BigEndian.PutUint32(b[5:], uint32(len(d)))
+	binary.BigEndian.PutUint32(b[9:], uint32(len(k)))
+	binary.BigEndian.PutUint32(b[13:], uint32(len(v)))
+	n := diskHeaderLen
+	n += copy(b[n:], d)
+	n += copy(b[n:], k)
+	copy(b[n:], v)
+	binary.BigEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+// readDiskRecord reads a record of at most max bytes from r.
+func readDiskRecord(r io.Reader, max int64) (op OpType, d, k string,
+	v []byte, err error) {
+
+	var h [diskHeaderLen]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorruptRecord
+		}
+		return
+	}
+
+	dlen := binary.BigEndian.Uint32(h[5:])
+	klen := binary.BigEndian.Uint32(h[9:])
+	vlen := binary.BigEndian.Uint32(h[13:])
+	if int64(diskHeaderLen)+int64(dlen)+int64(klen)+int64(vlen) > max {
+		err = errCorruptRecord
+		return
+	}
+	b := make([]byte, int(dlen)+int(klen)+int(vlen))
+	if _, err = io.ReadFull(r, b); err != nil {
+		err = errCorruptRecord
+		return
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(h[4:])
+	crc.Write(b)
+	if crc.Sum32() != binary.BigEndian.Uint32(h[:]) {
+		err = errCorruptRecord
+		return
+	}
+
+	op = OpType(h[4])
+	d = string(b[:dlen])
+	k = string(b[dlen : dlen+klen])
+	v = b[dlen+klen:]
+	return
+}
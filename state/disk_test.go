@@ -0,0 +1,160 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func newOnDiskForTest(t *testing.T, dir string) *OnDisk {
+	s, err := NewOnDisk(dir)
+	if err != nil {
+		t.Fatalf("cannot open on-disk state: %v", err)
+	}
+	return s
+}
+
+func TestOnDiskReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := newOnDiskForTest(t, dir)
+	d := s.Dict("d")
+	for i := 0; i < 10; i++ {
+		if err := d.Put(fmt.Sprint(i), []byte(fmt.Sprint("v", i))); err != nil {
+			t.Errorf("error in put: %v", err)
+		}
+	}
+	d.Del("3")
+	d.Put("5", []byte("v55"))
+	s.Close()
+
+	s = newOnDiskForTest(t, dir)
+	defer s.Close()
+	d = s.Dict("d")
+	n := 0
+	d.ForEach(func(k string, v []byte) { n++ })
+	if n != 9 {
+		t.Errorf("invalid number of keys: actual=%d want=9", n)
+	}
+	if _, err := d.Get("3"); err == nil {
+		t.Error("deleted key is restored")
+	}
+	if v, err := d.Get("5"); err != nil || string(v) != "v55" {
+		t.Errorf("invalid value: actual=%s want=v55 (%v)", v, err)
+	}
+}
+
+func TestOnDiskTruncatedLog(t *testing.T) {
+	dir := t.TempDir()
+	s := newOnDiskForTest(t, dir)
+	s.Dict("d").Put("k1", []byte("v1"))
+	s.Dict("d").Put("k2", []byte("v2"))
+	s.Close()
+
+	// Simulate a partially written record.
+	f := path.Join(dir, diskLogName)
+	fi, _ := os.Stat(f)
+	if err := os.Truncate(f, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newOnDiskForTest(t, dir)
+	defer s.Close()
+	if _, err := s.Dict("d").Get("k1"); err != nil {
+		t.Errorf("cannot read the intact record: %v", err)
+	}
+	if _, err := s.Dict("d").Get("k2"); err == nil {
+		t.Error("can read the partial record")
+	}
+	s.Dict("d").Put("k3", []byte("v3"))
+	if v, _ := s.Dict("d").Get("k3"); string(v) != "v3" {
+		t.Errorf("invalid value after truncation: actual=%s want=v3", v)
+	}
+}
+
+func TestOnDiskCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s := newOnDiskForTest(t, dir)
+	v := make([]byte, 1024)
+	for i := 0; i < 4*1024; i++ {
+		s.Dict("d").Put(fmt.Sprint(i%16), v)
+	}
+	if s.size > 2*diskCompactMinBytes {
+		t.Errorf("log is not compacted: size=%d", s.size)
+	}
+	s.Dict("d").Put("last", []byte("last"))
+	s.Close()
+
+	s = newOnDiskForTest(t, dir)
+	defer s.Close()
+	n := 0
+	s.Dict("d").ForEach(func(k string, v []byte) { n++ })
+	if n != 17 {
+		t.Errorf("invalid number of keys after compaction: actual=%d want=17", n)
+	}
+	if v, _ := s.Dict("d").Get("last"); string(v) != "last" {
+		t.Errorf("invalid value after compaction: actual=%s want=last", v)
+	}
+}
+
+func TestOnDiskSaveRestore(t *testing.T) {
+	s1 := newOnDiskForTest(t, t.TempDir())
+	defer s1.Close()
+	s1.Dict("d1").Put("k", []byte("v1"))
+	s1.Dict("d2").Put("k", []byte("v2"))
+	b, err := s1.Save()
+	if err != nil {
+		t.Fatalf("cannot save the state: %v", err)
+	}
+
+	s2 := newOnDiskForTest(t, t.TempDir())
+	defer s2.Close()
+	s2.Dict("d1").Put("old", []byte("old"))
+	if err := s2.Restore(b); err != nil {
+		t.Fatalf("cannot restore the state: %v", err)
+	}
+	if _, err := s2.Dict("d1").Get("old"); err == nil {
+		t.Error("old key is not removed on restore")
+	}
+	for _, d := range []string{"d1", "d2"} {
+		v1, _ := s1.Dict(d).Get("k")
+		v2, _ := s2.Dict(d).Get("k")
+		if !bytes.Equal(v1, v2) {
+			t.Errorf("invalid restored value: actual=%s want=%s", v2, v1)
+		}
+	}
+}
+
+func TestOnDiskRestoreFailure(t *testing.T) {
+	dir := t.TempDir()
+	s := newOnDiskForTest(t, dir)
+	s.Dict("d").Put("k", []byte("v"))
+	b, err := s.Save()
+	if err != nil {
+		t.Fatalf("cannot save the state: %v", err)
+	}
+	if err := s.Restore(b[:len(b)-1]); err == nil {
+		t.Fatal("corrupt snapshot is restored")
+	}
+	if v, _ := s.Dict("d").Get("k"); string(v) != "v" {
+		t.Errorf("invalid value after failed restore: actual=%s want=v", v)
+	}
+	s.Close()
+
+	s = newOnDiskForTest(t, dir)
+	defer s.Close()
+	if v, _ := s.Dict("d").Get("k"); string(v) != "v" {
+		t.Errorf("invalid value after reopen: actual=%s want=v", v)
+	}
+	if _, err := os.Stat(path.Join(dir, diskLogName+".restore")); err == nil {
+		t.Error("temporary log is not removed")
+	}
+}
+
+func TestOnDiskTxCommit(t *testing.T) {
+	s := newOnDiskForTest(t, t.TempDir())
+	defer s.Close()
+	tx := NewTransactional(s)
+	testTx(t, s, tx, false)
+}
@@ -0,0 +1,111 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// ErrNotListable is returned when exporting a state that cannot list its
+// dictionaries.
+var ErrNotListable = errors.New("state cannot list its dictionaries")
+
+// Record is a key-value pair of a dictionary in a JSON lines dump of a state.
+// Values that are valid UTF-8 are stored in Text for readability, and other
+// values are stored in Value.
+type Record struct {
+	Dict  string `json:"dict"`
+	Key   string `json:"key"`
+	Text  string `json:"text,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// NewRecord creates the record of key k with value v in dictionary d.
+func NewRecord(d, k string, v []byte) Record {
+	r := Record{Dict: d, Key: k}
+	if utf8.Valid(v) {
+		r.Text = string(v)
+	} else {
+		r.Value = v
+	}
+	return r
+}
+
+// Val returns the value of the record.
+func (r Record) Val() []byte {
+	if r.Value != nil {
+		return r.Value
+	}
+	return []byte(r.Text)
+}
+
+// DictNames returns the sorted names of the dictionaries in s. s should be an
+// InMem or an OnDisk state, or a state wrapping one of them.
+func DictNames(s State) ([]string, error) {
+	var names []string
+	switch s := s.(type) {
+	case *Transactional:
+		return DictNames(s.State)
+	case *Incremental:
+		return DictNames(s.State)
+	case interface {
+		DictNames() []string
+	}:
+		names = s.DictNames()
+	default:
+		return nil, ErrNotListable
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Export writes the entries of the given dictionaries of s to w as JSON lines,
+// one Record per line, ordered by dictionary and key. If no dictionary is
+// given, all dictionaries are exported.
+func Export(w io.Writer, s State, dicts ...string) error {
+	if len(dicts) == 0 {
+		var err error
+		if dicts, err = DictNames(s); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var err error
+	for _, d := range dicts {
+		s.Dict(d).Range("", "", func(k string, v []byte) bool {
+			err = enc.Encode(NewRecord(d, k, v))
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Import reads JSON lines of records from r and puts them in s. It returns
+// the number of imported records.
+func Import(r io.Reader, s State) (n int, err error) {
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		if err = dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		if rec.Dict == "" {
+			return n, errors.New("record has no dictionary")
+		}
+		if err = s.Dict(rec.Dict).Put(rec.Key, rec.Val()); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
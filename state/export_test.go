@@ -0,0 +1,74 @@
+package state
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	s := NewInMem()
+	putKeys(s.Dict("d1"), "b", "a")
+	s.Dict("d2").Put("bin", []byte{0xff, 0x00})
+	s.Dict("d2").Put("empty", nil)
+
+	var buf bytes.Buffer
+	if err := Export(&buf, NewTransactional(s)); err != nil {
+		t.Fatalf("cannot export state: %v", err)
+	}
+	want := `{"dict":"d1","key":"a","text":"a"}
+{"dict":"d1","key":"b","text":"b"}
+{"dict":"d2","key":"bin","value":"/wA="}
+{"dict":"d2","key":"empty"}
+`
+	if buf.String() != want {
+		t.Errorf("invalid export:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	r := NewInMem()
+	n, err := Import(strings.NewReader(want), r)
+	if err != nil || n != 4 {
+		t.Fatalf("cannot import state: n=%d err=%v", n, err)
+	}
+	if v, _ := r.Dict("d1").Get("b"); string(v) != "b" {
+		t.Errorf("invalid value for b: %s", v)
+	}
+	if v, _ := r.Dict("d2").Get("bin"); !bytes.Equal(v, []byte{0xff, 0x00}) {
+		t.Errorf("invalid value for bin: %v", v)
+	}
+	if _, err := r.Dict("d2").Get("empty"); err != nil {
+		t.Errorf("empty value is not imported: %v", err)
+	}
+
+	buf.Reset()
+	if err := Export(&buf, r, "d1"); err != nil {
+		t.Fatalf("cannot export dictionary: %v", err)
+	}
+	if strings.Count(buf.String(), "\n") != 2 {
+		t.Errorf("invalid export of d1:\n%s", buf.String())
+	}
+
+	if _, err := Import(strings.NewReader(`{"key":"k"}`), r); err == nil {
+		t.Error("record without a dictionary is imported")
+	}
+}
+
+func TestRestoreOnDiskInMem(t *testing.T) {
+	d := newOnDiskForTest(t, t.TempDir())
+	defer d.Close()
+	putKeys(d.Dict("d"), "a", "b")
+	b, err := d.Save()
+	if err != nil {
+		t.Fatalf("cannot save state: %v", err)
+	}
+
+	s := NewInMem()
+	if err := s.Restore(b); err != nil {
+		t.Fatalf("cannot restore on-disk snapshot: %v", err)
+	}
+	if keys := collectKeys(func(f RangeFn) { s.Dict("d").Range("", "", f) },
+		100); len(keys) != 2 {
+
+		t.Errorf("invalid keys: %v", keys)
+	}
+}
@@ -0,0 +1,441 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultMaxDeltas is the default maximum number of deltas in an incremental
+// snapshot before it is compacted into a full snapshot.
+const DefaultMaxDeltas = 16
+
+// Incremental wraps a state and makes its snapshots incremental. Instead of
+// serializing the whole state on every Save, Incremental keeps the last full
+// snapshot (i.e., the base) and only serializes the keys modified since the
+// previous Save as a delta. A snapshot never has more than MaxDeltas deltas,
+// and its deltas are never larger than its base: a Save that would exceed
+// either limit folds the deltas back into a new base instead.
+//
+// When an incremental snapshot is restored into a state that has already
+// restored an earlier snapshot of the same chain, only the new deltas are
+// applied. This is the case for followers that catch up with their leader.
+//
+// A snapshot is self-contained, so that it can be restored from scratch. To
+// ship a snapshot to a state that already has an earlier snapshot of the same
+// chain, use DeltaSnapshot to strip the base and the deltas that the receiver
+// already has, and ExpandSnapshot on the receiver to rebuild the snapshot.
+type Incremental struct {
+	State State
+	// MaxDeltas is the maximum number of deltas in a snapshot.
+	MaxDeltas int
+	// Codec is the codec of the snapshots, and should be the codec of State.
+	// Snapshots are encoded using gob if Codec is nil.
+	Codec Codec
+
+	mu         sync.Mutex
+	dirty      map[string]map[string]struct{}
+	base       uint64
+	full       []byte
+	deltas     []delta
+	deltaBytes int
+	// The ID of the last delta (or the base if there is no delta) that this
+	// state is known to include.
+	tip uint64
+}
+
+// NewIncremental wraps s and returns an incremental state.
+func NewIncremental(s State) *Incremental {
+	return &Incremental{
+		State:     s,
+		MaxDeltas: DefaultMaxDeltas,
+		dirty:     make(map[string]map[string]struct{}),
+	}
+}
+
+// ErrUnknownBase is returned when a delta snapshot is expanded by a state
+// that does not have the snapshot the delta is based on.
+var ErrUnknownBase = errors.New("state: unknown snapshot base")
+
+// incrementalSnapshot is the encoded form of incremental snapshots.
+type incrementalSnapshot struct {
+	Base   uint64
+	Full   []byte
+	Deltas []delta
+	// From is the ID of the snapshot this snapshot is a delta of. If From is
+	// not 0, Full and the deltas up to From are stripped.
+	From uint64
+}
+
+// id returns the ID of the snapshot, which is the ID of its last delta or its
+// base if it has no delta.
+func (snap incrementalSnapshot) id() uint64 {
+	if len(snap.Deltas) == 0 {
+		return snap.Base
+	}
+	return snap.Deltas[len(snap.Deltas)-1].ID
+}
+
+// includes returns the number of deltas of snap that are included in the
+// snapshot with the given ID, or -1 if the snapshot is not in the chain of
+// snap.
+func (snap incrementalSnapshot) includes(id uint64) int {
+	if id == 0 {
+		return -1
+	}
+	if id == snap.Base {
+		return 0
+	}
+	for i, d := range snap.Deltas {
+		if d.ID == id {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// errNotIncremental is returned when decoding a snapshot that is not
+// incremental.
+var errNotIncremental = errors.New("state: not an incremental snapshot")
+
+func decodeIncrementalSnapshot(c Codec, b []byte) (snap incrementalSnapshot,
+	err error) {
+
+	if err = unmarshal(c, b, &snap); err == nil && snap.Base == 0 {
+		// Codecs such as JSON decode other snapshots without an error.
+		err = errNotIncremental
+	}
+	return
+}
+
+func encodeIncrementalSnapshot(c Codec, snap incrementalSnapshot) ([]byte,
+	error) {
+
+	return marshal(c, snap)
+}
+
+// SnapshotID returns the ID of the incremental snapshot b, encoded using gob.
+// It returns false if b is not an incremental snapshot.
+func SnapshotID(b []byte) (uint64, bool) {
+	return snapshotID(nil, b)
+}
+
+// SnapshotID returns the ID of the incremental snapshot b saved by the state.
+// It returns false if b is not an incremental snapshot.
+func (s *Incremental) SnapshotID(b []byte) (uint64, bool) {
+	return snapshotID(s.Codec, b)
+}
+
+func snapshotID(c Codec, b []byte) (uint64, bool) {
+	snap, err := decodeIncrementalSnapshot(c, b)
+	if err != nil || snap.From != 0 {
+		return 0, false
+	}
+	return snap.id(), true
+}
+
+// DeltaSnapshot returns the part of the incremental snapshot b, encoded using
+// gob, that is not included in the snapshot with ID from. It returns false if
+// from is not in the chain of b, in which case b should be shipped as is.
+func DeltaSnapshot(b []byte, from uint64) ([]byte, bool) {
+	return deltaSnapshot(nil, b, from)
+}
+
+// DeltaSnapshot returns the part of the incremental snapshot b saved by the
+// state that is not included in the snapshot with ID from.
+func (s *Incremental) DeltaSnapshot(b []byte, from uint64) ([]byte, bool) {
+	return deltaSnapshot(s.Codec, b, from)
+}
+
+func deltaSnapshot(c Codec, b []byte, from uint64) ([]byte, bool) {
+	snap, err := decodeIncrementalSnapshot(c, b)
+	if err != nil || snap.From != 0 {
+		return nil, false
+	}
+	i := snap.includes(from)
+	if i < 0 {
+		return nil, false
+	}
+	d, err := encodeIncrementalSnapshot(c, incrementalSnapshot{
+		Base:   snap.Base,
+		Deltas: snap.Deltas[i:],
+		From:   from,
+	})
+	if err != nil {
+		return nil, false
+	}
+	return d, true
+}
+
+// ExpandSnapshot rebuilds the snapshot that the delta snapshot b is stripped
+// from, using the base and the deltas of the last snapshot saved or restored by
+// the state. Snapshots that are not deltas are returned as is. It returns
+// ErrUnknownBase if the state does not have the snapshot b is a delta of.
+func (s *Incremental) ExpandSnapshot(b []byte) ([]byte, error) {
+	snap, err := decodeIncrementalSnapshot(s.Codec, b)
+	if err != nil || snap.From == 0 {
+		return b, nil
+	}
+
+	s.mu.Lock()
+	local := incrementalSnapshot{Base: s.base, Full: s.full, Deltas: s.deltas}
+	s.mu.Unlock()
+
+	if local.Full == nil || local.Base != snap.Base {
+		return nil, ErrUnknownBase
+	}
+	i := local.includes(snap.From)
+	if i < 0 {
+		return nil, ErrUnknownBase
+	}
+	deltas := make([]delta, 0, i+len(snap.Deltas))
+	deltas = append(deltas, local.Deltas[:i]...)
+	deltas = append(deltas, snap.Deltas...)
+	return encodeIncrementalSnapshot(s.Codec, incrementalSnapshot{
+		Base:   snap.Base,
+		Full:   local.Full,
+		Deltas: deltas,
+	})
+}
+
+// delta stores the modified keys of a state as a list of encoded operations.
+type delta struct {
+	ID  uint64
+	Ops []byte
+}
+
+var snapIDs = struct {
+	sync.Mutex
+	*rand.Rand
+}{
+	Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+}
+
+// newSnapID returns a random, non-zero snapshot ID.
+func newSnapID() uint64 {
+	snapIDs.Lock()
+	defer snapIDs.Unlock()
+	for {
+		if id := uint64(snapIDs.Int63()); id != 0 {
+			return id
+		}
+	}
+}
+
+func (s *Incremental) Dict(name string) Dict {
+	return &incDict{Dict: s.State.Dict(name), s: s}
+}
+
+func (s *Incremental) markDirty(d, k string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, ok := s.dirty[d]
+	if !ok {
+		keys = make(map[string]struct{})
+		s.dirty[d] = keys
+	}
+	keys[k] = struct{}{}
+}
+
+// Save returns an incremental snapshot of the state.
+func (s *Incremental) Save() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.full == nil || s.exceeds(len(s.deltas), s.deltaBytes):
+		// The chain may exceed the limits if it is restored from a snapshot
+		// saved with larger limits.
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	case len(s.dirty) != 0:
+		d, err := s.newDelta()
+		if err != nil {
+			return nil, err
+		}
+		if s.exceeds(len(s.deltas)+1, s.deltaBytes+len(d.Ops)) {
+			if err := s.compact(); err != nil {
+				return nil, err
+			}
+			break
+		}
+		s.deltas = append(s.deltas, d)
+		s.deltaBytes += len(d.Ops)
+		s.tip = d.ID
+	}
+
+	return encodeIncrementalSnapshot(s.Codec, incrementalSnapshot{
+		Base:   s.base,
+		Full:   s.full,
+		Deltas: s.deltas,
+	})
+}
+
+// exceeds returns whether a chain of n deltas with the given size exceeds the
+// limits of the state, in which case it must be folded into a new base.
+func (s *Incremental) exceeds(n, size int) bool {
+	return n > s.MaxDeltas || size > len(s.full)
+}
+
+// compact creates a new base from the whole state.
+func (s *Incremental) compact() error {
+	full, err := s.State.Save()
+	if err != nil {
+		return err
+	}
+	s.base = newSnapID()
+	s.full = full
+	s.deltas = nil
+	s.deltaBytes = 0
+	s.tip = s.base
+	s.dirty = make(map[string]map[string]struct{})
+	return nil
+}
+
+// newDelta creates a delta from the dirty keys.
+func (s *Incremental) newDelta() (delta, error) {
+	var ops []Op
+	for dn, keys := range s.dirty {
+		d := s.State.Dict(dn)
+		for k := range keys {
+			if v, err := d.Get(k); err == nil {
+				ops = append(ops, Op{T: Put, D: dn, K: k, V: v})
+			} else {
+				ops = append(ops, Op{T: Del, D: dn, K: k})
+			}
+		}
+	}
+
+	b, err := marshal(s.Codec, ops)
+	if err != nil {
+		return delta{}, err
+	}
+	s.dirty = make(map[string]map[string]struct{})
+	return delta{ID: newSnapID(), Ops: b}, nil
+}
+
+// Restore restores the state from an incremental snapshot. If the state
+// already includes a prefix of the snapshot's deltas, only the rest of the
+// deltas are applied. Otherwise, the state is restored from the base of the
+// snapshot. Delta snapshots are expanded using ExpandSnapshot. Snapshots that
+// are not incremental are restored as is by the underlying state.
+func (s *Incremental) Restore(b []byte) error {
+	snap, err := decodeIncrementalSnapshot(s.Codec, b)
+	if err != nil {
+		s.mu.Lock()
+		s.reset()
+		s.mu.Unlock()
+		return s.State.Restore(b)
+	}
+	if snap.From != 0 {
+		if b, err = s.ExpandSnapshot(b); err != nil {
+			return err
+		}
+		if snap, err = decodeIncrementalSnapshot(s.Codec, b); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := -1
+	if s.base == snap.Base {
+		next = snap.includes(s.tip)
+	}
+
+	if next < 0 {
+		if err := s.State.Restore(snap.Full); err != nil {
+			return err
+		}
+		next = 0
+	}
+
+	for _, d := range snap.Deltas[next:] {
+		var ops []Op
+		if err := unmarshal(s.Codec, d.Ops, &ops); err != nil {
+			return err
+		}
+		if err := applyOps(s.State, ops); err != nil {
+			return err
+		}
+	}
+
+	s.base = snap.Base
+	s.full = snap.Full
+	s.deltas = snap.Deltas
+	s.deltaBytes = 0
+	for _, d := range snap.Deltas {
+		s.deltaBytes += len(d.Ops)
+	}
+	s.tip = snap.id()
+	s.dirty = make(map[string]map[string]struct{})
+	return nil
+}
+
+// reset discards the snapshot chain of the state.
+func (s *Incremental) reset() {
+	s.base = 0
+	s.full = nil
+	s.deltas = nil
+	s.deltaBytes = 0
+	s.tip = 0
+	s.dirty = make(map[string]map[string]struct{})
+}
+
+// Close closes the underlying state if it is closable.
+func (s *Incremental) Close() error {
+	if c, ok := s.State.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func applyOps(s State, ops []Op) error {
+	for _, o := range ops {
+		if err := applyOp(s.Dict(o.D), o); err != nil {
+			return fmt.Errorf("cannot apply %v on %v: %v", o.K, o.D, err)
+		}
+	}
+	return nil
+}
+
+// incDict tracks the keys modified in a dictionary of an incremental state.
+type incDict struct {
+	Dict
+	s *Incremental
+}
+
+func (d *incDict) Put(k string, v []byte) error {
+	d.s.markDirty(d.Name(), k)
+	return d.Dict.Put(k, v)
+}
+
+func (d *incDict) Del(k string) error {
+	d.s.markDirty(d.Name(), k)
+	return d.Dict.Del(k)
+}
+
+func (d *incDict) CompareAndSwap(k string, old, new []byte) (bool, error) {
+	return CompareAndSwap(d, k, old, new)
+}
+
+func (d *incDict) Increment(k string, delta int64) (int64, error) {
+	return Increment(d, k, delta)
+}
+
+func (d *incDict) GetOrPut(k string, v []byte) ([]byte, bool, error) {
+	return GetOrPut(d, k, v)
+}
+
+func (d *incDict) GetGob(k string, v interface{}) error {
+	return GetGob(d, k, v)
+}
+
+func (d *incDict) PutGob(k string, v interface{}) error {
+	return PutGob(d, k, v)
+}
@@ -0,0 +1,238 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestIncrementalSaveRestore(t *testing.T) {
+	leader := NewIncremental(NewInMem())
+	leader.Dict("d").Put("k1", []byte("v1"))
+	leader.Dict("d").Put("k2", []byte("v2"))
+	b1, err := leader.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if len(leader.deltas) != 0 {
+		t.Errorf("first snapshot has deltas: %d", len(leader.deltas))
+	}
+
+	follower := NewIncremental(NewInMem())
+	if err := follower.Restore(b1); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+
+	leader.Dict("d").Put("k1", []byte("v11"))
+	leader.Dict("d").Del("k2")
+	b2, err := leader.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if len(leader.deltas) != 1 {
+		t.Errorf("invalid number of deltas: actual=%d want=1", len(leader.deltas))
+	}
+
+	// The follower only applies the new delta. k3 would be removed if the base
+	// was restored again.
+	follower.State.Dict("d").Put("k3", []byte("v3"))
+	if err := follower.Restore(b2); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+	if v, _ := follower.Dict("d").Get("k1"); !bytes.Equal(v, []byte("v11")) {
+		t.Errorf("invalid value for k1: actual=%s want=v11", v)
+	}
+	if _, err := follower.Dict("d").Get("k2"); err == nil {
+		t.Error("deleted key is restored")
+	}
+	if _, err := follower.Dict("d").Get("k3"); err != nil {
+		t.Error("the base is restored instead of the delta")
+	}
+
+	// A fresh state restores the base and all the deltas.
+	fresh := NewIncremental(NewInMem())
+	if err := fresh.Restore(b2); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+	if v, _ := fresh.Dict("d").Get("k1"); !bytes.Equal(v, []byte("v11")) {
+		t.Errorf("invalid value for k1: actual=%s want=v11", v)
+	}
+	if _, err := fresh.Dict("d").Get("k2"); err == nil {
+		t.Error("deleted key is restored")
+	}
+}
+
+func TestIncrementalCompaction(t *testing.T) {
+	s := NewIncremental(NewInMem())
+	s.MaxDeltas = 2
+	// Use a base larger than the deltas, so that only MaxDeltas is reached.
+	for i := 0; i < 100; i++ {
+		s.Dict("d").Put(fmt.Sprintf("k%d", i), []byte("v"))
+	}
+	s.Save()
+	base := s.base
+	for i := 0; i < 2; i++ {
+		s.Dict("d").Put("k", []byte{byte(i)})
+		s.Save()
+		if s.base != base {
+			t.Fatalf("snapshot is compacted after %d deltas", i+1)
+		}
+	}
+	s.Dict("d").Put("k", []byte("v"))
+	s.Save()
+	if s.base == base || len(s.deltas) != 0 {
+		t.Errorf("snapshot is not compacted: deltas=%d", len(s.deltas))
+	}
+}
+
+func TestIncrementalRestoreFull(t *testing.T) {
+	inm := NewInMem()
+	inm.Dict("d").Put("k", []byte("v"))
+	b, err := inm.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+
+	s := NewIncremental(NewInMem())
+	if err := s.Restore(b); err != nil {
+		t.Fatalf("cannot restore a full snapshot: %v", err)
+	}
+	if v, _ := s.Dict("d").Get("k"); !bytes.Equal(v, []byte("v")) {
+		t.Errorf("invalid value: actual=%s want=v", v)
+	}
+}
+
+func TestIncrementalTx(t *testing.T) {
+	s := NewIncremental(NewInMem())
+	tx := NewTransactional(s)
+	testTx(t, s, tx, false)
+	if len(s.dirty["d"]) != 1 {
+		t.Errorf("invalid number of dirty keys: actual=%d want=1", len(s.dirty["d"]))
+	}
+}
+
+func TestIncrementalDeltaSnapshot(t *testing.T) {
+	leader := NewIncremental(NewInMem())
+	for i := 0; i < 64; i++ {
+		leader.Dict("d").Put(fmt.Sprintf("k%d", i), bytes.Repeat([]byte{'v'}, 64))
+	}
+	b1, err := leader.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	id1, ok := SnapshotID(b1)
+	if !ok {
+		t.Fatal("cannot get the snapshot ID")
+	}
+
+	follower := NewIncremental(NewInMem())
+	if err := follower.Restore(b1); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+
+	leader.Dict("d").Put("k0", []byte("v0"))
+	b2, err := leader.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	d, ok := DeltaSnapshot(b2, id1)
+	if !ok {
+		t.Fatal("cannot create a delta snapshot")
+	}
+	if len(d) >= len(b2)/4 {
+		t.Errorf("delta snapshot is not smaller: delta=%d full=%d", len(d),
+			len(b2))
+	}
+	if _, ok := DeltaSnapshot(b2, 1); ok {
+		t.Error("delta snapshot is created from an unknown snapshot")
+	}
+
+	if _, err := NewIncremental(NewInMem()).ExpandSnapshot(d); err !=
+		ErrUnknownBase {
+
+		t.Errorf("invalid error: actual=%v want=%v", err, ErrUnknownBase)
+	}
+	e, err := follower.ExpandSnapshot(d)
+	if err != nil {
+		t.Fatalf("cannot expand the delta snapshot: %v", err)
+	}
+	if !bytes.Equal(e, b2) {
+		t.Error("expanded snapshot is not the same as the original snapshot")
+	}
+	if err := follower.Restore(d); err != nil {
+		t.Fatalf("cannot restore the delta snapshot: %v", err)
+	}
+	if v, _ := follower.Dict("d").Get("k0"); !bytes.Equal(v, []byte("v0")) {
+		t.Errorf("invalid value for k0: actual=%s want=v0", v)
+	}
+}
+
+func TestIncrementalDeltaLimits(t *testing.T) {
+	s := NewIncremental(NewInMem())
+	s.MaxDeltas = 4
+	for i := 0; i < 10; i++ {
+		s.Dict("d").Put(fmt.Sprintf("k%d", i), []byte("v"))
+	}
+	check := func(i int, b []byte, err error) {
+		if err != nil {
+			t.Fatalf("cannot save: %v", err)
+		}
+		snap, err := decodeIncrementalSnapshot(nil, b)
+		if err != nil {
+			t.Fatalf("cannot decode the snapshot: %v", err)
+		}
+		size := 0
+		for _, d := range snap.Deltas {
+			size += len(d.Ops)
+		}
+		if len(snap.Deltas) > s.MaxDeltas || size > len(snap.Full) {
+			t.Fatalf("snapshot %d exceeds the limits: deltas=%d size=%d base=%d",
+				i, len(snap.Deltas), size, len(snap.Full))
+		}
+	}
+	b, err := s.Save()
+	check(0, b, err)
+
+	// A delta larger than the base is folded into a new base by the same Save.
+	s.Dict("d").Put("k0", make([]byte, 1024))
+	b, err = s.Save()
+	check(1, b, err)
+
+	for i := 2; i < 100; i++ {
+		s.Dict("d").Put(fmt.Sprintf("k%d", i%10), []byte{byte(i)})
+		b, err = s.Save()
+		check(i, b, err)
+	}
+}
+
+func TestIncrementalCompactRestoredChain(t *testing.T) {
+	leader := NewIncremental(NewInMem())
+	for i := 0; i < 100; i++ {
+		leader.Dict("d").Put(fmt.Sprintf("k%d", i), []byte("v"))
+	}
+	var b []byte
+	for i := 0; i < 4; i++ {
+		leader.Dict("d").Put("k", []byte{byte(i)})
+		var err error
+		if b, err = leader.Save(); err != nil {
+			t.Fatalf("cannot save: %v", err)
+		}
+	}
+	if len(leader.deltas) != 3 {
+		t.Fatalf("invalid number of deltas: actual=%d want=3",
+			len(leader.deltas))
+	}
+
+	follower := NewIncremental(NewInMem())
+	follower.MaxDeltas = 2
+	if err := follower.Restore(b); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+	if _, err := follower.Save(); err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if follower.base == leader.base || len(follower.deltas) != 0 {
+		t.Errorf("restored chain is not compacted: deltas=%d",
+			len(follower.deltas))
+	}
+}
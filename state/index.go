@@ -0,0 +1,84 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// IndexDict is the dictionary that stores the entries of secondary indexes.
+// Since index entries are stored in the state, they are saved, restored and
+// replicated along with the dictionaries they index.
+const IndexDict = "__index__"
+
+// ErrNoSuchIndex is returned when querying an index that is not defined, or
+// that is queried through a dictionary of a state that is not Transactional.
+var ErrNoSuchIndex = errors.New("no such index")
+
+// IndexFn extracts the indexed values of key k with value v. A key can have
+// zero or more indexed values.
+type IndexFn func(k string, v []byte) []string
+
+// Index is a secondary index of a dictionary.
+type Index interface {
+	// Get returns the keys whose indexed values include v in ascending order.
+	Get(v string) ([]string, error)
+}
+
+const indexSep = "\x00"
+
+// indexPrefix returns the prefix of the entries of value v in index name of
+// dictionary d. The value is prefixed with its length, so that an entry is
+// unambiguously split into the value and the key.
+func indexPrefix(d, name, v string) string {
+	return fmt.Sprintf("%s%s%s%s%08X%s", d, indexSep, name, indexSep, len(v), v)
+}
+
+// reindex replaces the entries of key k in the indexes of dictionary d. hadOld
+// and hasNew are false if the key did not exist before or does not exist
+// after the update, respectively.
+func reindex(idx Dict, fns map[string]IndexFn, d, k string, old []byte,
+	hadOld bool, new []byte, hasNew bool) error {
+
+	for name, f := range fns {
+		if hadOld {
+			for _, v := range f(k, old) {
+				if err := idx.Del(indexPrefix(d, name, v) + k); err != nil {
+					return err
+				}
+			}
+		}
+		if hasNew {
+			for _, v := range f(k, new) {
+				if err := idx.Put(indexPrefix(d, name, v)+k, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dictIndex queries the entries of an index stored in IndexDict.
+type dictIndex struct {
+	idx  Dict
+	d    string
+	name string
+}
+
+func (i dictIndex) Get(v string) ([]string, error) {
+	p := indexPrefix(i.d, i.name, v)
+	var keys []string
+	i.idx.Prefix(p, func(ik string, _ []byte) bool {
+		keys = append(keys, strings.TrimPrefix(ik, p))
+		return true
+	})
+	return keys, nil
+}
+
+// noIndex is returned for the indexes that are not defined.
+type noIndex struct{}
+
+func (i noIndex) Get(v string) ([]string, error) {
+	return nil, ErrNoSuchIndex
+}
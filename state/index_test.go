@@ -0,0 +1,116 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// byTag indexes comma-separated values by each of their tags.
+func byTag(k string, v []byte) []string {
+	if len(v) == 0 {
+		return nil
+	}
+	return strings.Split(string(v), ",")
+}
+
+func checkIndex(t *testing.T, name string, d Dict, v string, keys ...string) {
+	actual, err := d.Index("tag").Get(v)
+	if err != nil {
+		t.Fatalf("%v: cannot get index: %v", name, err)
+	}
+	if !reflect.DeepEqual(actual, keys) {
+		t.Errorf("%v: invalid keys for %v: actual=%v want=%v", name, v, actual,
+			keys)
+	}
+}
+
+func TestTxIndex(t *testing.T) {
+	leader := NewTransactional(NewInMem())
+	leader.AddIndex("d", "tag", byTag)
+	follower := NewTransactional(NewInMem())
+	follower.AddIndex("d", "tag", byTag)
+
+	leader.BeginTx()
+	d := leader.Dict("d")
+	d.Put("k1", []byte("a,b"))
+	d.Put("k2", []byte("b"))
+	d.Put("k3", []byte("a"))
+	d.Put("k3", []byte("c"))
+	d.CompareAndSwap("k4", nil, []byte("a"))
+	d.GetOrPut("k5", []byte("c"))
+	d.Del("k2")
+	checkIndex(t, "tx", d, "a", "k1", "k4")
+	checkIndex(t, "tx", d, "b", "k1")
+	checkIndex(t, "tx", d, "c", "k3", "k5")
+	if _, err := d.Index("x").Get("a"); err != ErrNoSuchIndex {
+		t.Errorf("undefined index is queried: %v", err)
+	}
+
+	if err := follower.Apply(leader.TxOps()); err != nil {
+		t.Fatalf("cannot apply ops: %v", err)
+	}
+	leader.CommitTx()
+	for n, s := range map[string]*Transactional{"leader": leader,
+		"follower": follower} {
+
+		checkIndex(t, n, s.Dict("d"), "a", "k1", "k4")
+		checkIndex(t, n, s.Dict("d"), "b", "k1")
+		checkIndex(t, n, s.Dict("d"), "c", "k3", "k5")
+	}
+
+	leader.BeginTx()
+	leader.Dict("d").Put("k1", []byte("c"))
+	leader.AbortTx()
+	checkIndex(t, "abort", leader.Dict("d"), "a", "k1", "k4")
+	checkIndex(t, "abort", leader.Dict("d"), "c", "k3", "k5")
+}
+
+func TestIndexWithoutTx(t *testing.T) {
+	s := NewTransactional(NewInMem())
+	s.AddIndex("d", "tag", byTag)
+	d := s.Dict("d")
+	d.Put("k1", []byte("a"))
+	d.Put("k2", []byte("a,b"))
+	d.Put("k1", []byte("b"))
+	d.CompareAndSwap("k3", nil, []byte("b"))
+	d.Del("k2")
+	checkIndex(t, "no tx", d, "a")
+	checkIndex(t, "no tx", d, "b", "k1", "k3")
+
+	if _, err := NewInMem().Dict("d").Index("tag").Get("a"); err !=
+		ErrNoSuchIndex {
+
+		t.Errorf("index is queried on a non-transactional state: %v", err)
+	}
+}
+
+func TestIndexSaveRestore(t *testing.T) {
+	s := NewTransactional(NewInMem())
+	s.AddIndex("d", "tag", byTag)
+	s.BeginTx()
+	s.Dict("d").Put("k1", []byte("a"))
+	s.Dict("d").Put("k2", []byte("a"))
+	s.CommitTx()
+	b, err := s.Save()
+	if err != nil {
+		t.Fatalf("cannot save state: %v", err)
+	}
+
+	r := NewTransactional(NewInMem())
+	r.AddIndex("d", "tag", byTag)
+	if err := r.Restore(b); err != nil {
+		t.Fatalf("cannot restore state: %v", err)
+	}
+	checkIndex(t, "restore", r.Dict("d"), "a", "k1", "k2")
+
+	// Layered transactions share the indexes of their parent.
+	r.BeginTx()
+	l2 := NewTransactional(r)
+	l2.BeginTx()
+	l2.Dict("d").Del("k1")
+	checkIndex(t, "layered", l2.Dict("d"), "a", "k2")
+	l2.CommitTx()
+	r.CommitTx()
+	checkIndex(t, "layered", r.Dict("d"), "a", "k2")
+}
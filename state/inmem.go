@@ -1,14 +1,15 @@
 package state
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
+	"time"
 )
 
 // InMem is a simple dictionary that uses in memory maps.
 type InMem struct {
 	Dicts map[string]*inMemDict
+
+	codec Codec
 }
 
 // NewInMem creates a new InMem state.
@@ -18,19 +19,48 @@ func NewInMem() *InMem {
 	}
 }
 
+// SetCodec sets the codec of the snapshots of the state. The state can still
+// restore the snapshots encoded using gob.
+func (s *InMem) SetCodec(c Codec) {
+	s.codec = c
+}
+
 func (s *InMem) Save() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return marshal(s.codec, s)
 }
 
+// Restore restores the state from b. b can be a snapshot of either an InMem
+// or an OnDisk state.
 func (s *InMem) Restore(b []byte) error {
-	buf := bytes.NewBuffer(b)
-	dec := gob.NewDecoder(buf)
-	return dec.Decode(s)
+	var r InMem
+	if err := unmarshal(s.codec, b, &r); err != nil {
+		// Snapshots of OnDisk are lists of Put operations.
+		ops, oerr := decodeOps(s.codec, b)
+		if oerr != nil {
+			return err
+		}
+		r.Dicts = make(map[string]*inMemDict)
+		for _, o := range ops {
+			r.inMemDict(o.D).Dict[o.K] = o.V
+		}
+	}
+	if r.Dicts == nil {
+		r.Dicts = make(map[string]*inMemDict)
+	}
+	for _, d := range r.Dicts {
+		d.keys.reset()
+	}
+	s.Dicts = r.Dicts
+	return nil
+}
+
+// DictNames returns the names of the dictionaries in the state.
+func (s *InMem) DictNames() []string {
+	names := make([]string, 0, len(s.Dicts))
+	for n := range s.Dicts {
+		names = append(names, n)
+	}
+	return names
 }
 
 func (s *InMem) Dict(name string) Dict {
@@ -40,7 +70,7 @@ func (s *InMem) Dict(name string) Dict {
 func (s *InMem) inMemDict(name string) *inMemDict {
 	d, ok := s.Dicts[name]
 	if !ok {
-		d = &inMemDict{name, make(map[string][]byte)}
+		d = &inMemDict{DictName: name, Dict: make(map[string][]byte)}
 		s.Dicts[name] = d
 	}
 	return d
@@ -49,6 +79,7 @@ func (s *InMem) inMemDict(name string) *inMemDict {
 type inMemDict struct {
 	DictName string
 	Dict     map[string][]byte
+	keys     sortedKeys
 }
 
 func (d inMemDict) Name() string {
@@ -64,12 +95,18 @@ func (d *inMemDict) Get(k string) ([]byte, error) {
 }
 
 func (d *inMemDict) Put(k string, v []byte) error {
+	if _, ok := d.Dict[k]; !ok {
+		d.keys.add(k)
+	}
 	d.Dict[k] = v
 	return nil
 }
 
 func (d *inMemDict) Del(k string) error {
-	delete(d.Dict, k)
+	if _, ok := d.Dict[k]; ok {
+		d.keys.del(k)
+		delete(d.Dict, k)
+	}
 	return nil
 }
 
@@ -79,6 +116,53 @@ func (d *inMemDict) ForEach(f IterFn) {
 	}
 }
 
+func (d *inMemDict) PutWithTTL(k string, v []byte, ttl time.Duration) error {
+	return ErrTTLUnsupported
+}
+
+func (d *inMemDict) Index(name string) Index {
+	return noIndex{}
+}
+
+func (d *inMemDict) Range(start, end string, f RangeFn) {
+	d.scan(start, end, false, f)
+}
+
+func (d *inMemDict) ReverseRange(start, end string, f RangeFn) {
+	d.scan(start, end, true, f)
+}
+
+func (d *inMemDict) Prefix(p string, f RangeFn) {
+	d.scan(p, prefixEnd(p), false, f)
+}
+
+func (d *inMemDict) ReversePrefix(p string, f RangeFn) {
+	d.scan(p, prefixEnd(p), true, f)
+}
+
+func (d *inMemDict) scan(start, end string, reverse bool, f RangeFn) {
+	d.keys.build(func(add func(k string)) {
+		for k := range d.Dict {
+			add(k)
+		}
+	})
+	d.keys.scan(start, end, reverse, func(k string) bool {
+		return f(k, d.Dict[k])
+	})
+}
+
+func (d *inMemDict) CompareAndSwap(k string, old, new []byte) (bool, error) {
+	return CompareAndSwap(d, k, old, new)
+}
+
+func (d *inMemDict) Increment(k string, delta int64) (int64, error) {
+	return Increment(d, k, delta)
+}
+
+func (d *inMemDict) GetOrPut(k string, v []byte) ([]byte, bool, error) {
+	return GetOrPut(d, k, v)
+}
+
 func (d *inMemDict) GetGob(k string, v interface{}) error {
 	return GetGob(d, k, v)
 }
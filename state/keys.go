@@ -0,0 +1,103 @@
+package state
+
+import "sort"
+
+// sortedKeys maintains the keys of a dictionary in ascending order for range
+// scans. It is built lazily on the first scan, and is kept up to date
+// afterwards. Dictionaries that are never scanned do not pay its cost.
+type sortedKeys struct {
+	keys  []string
+	built bool
+}
+
+// add adds k to the keys if it does not exist.
+func (s *sortedKeys) add(k string) {
+	if !s.built {
+		return
+	}
+	i := sort.SearchStrings(s.keys, k)
+	if i < len(s.keys) && s.keys[i] == k {
+		return
+	}
+	s.keys = append(s.keys, "")
+	copy(s.keys[i+1:], s.keys[i:])
+	s.keys[i] = k
+}
+
+// del removes k from the keys.
+func (s *sortedKeys) del(k string) {
+	if !s.built {
+		return
+	}
+	i := sort.SearchStrings(s.keys, k)
+	if i == len(s.keys) || s.keys[i] != k {
+		return
+	}
+	s.keys = append(s.keys[:i], s.keys[i+1:]...)
+}
+
+// reset discards the keys. They are rebuilt on the next scan.
+func (s *sortedKeys) reset() {
+	s.keys = nil
+	s.built = false
+}
+
+// build builds the keys using forEach, if they are not already built.
+func (s *sortedKeys) build(forEach func(add func(k string))) {
+	if s.built {
+		return
+	}
+	s.keys = s.keys[:0]
+	forEach(func(k string) {
+		s.keys = append(s.keys, k)
+	})
+	sort.Strings(s.keys)
+	s.built = true
+}
+
+// scan calls f for the keys in [start, end) until f returns false. An empty
+// end means there is no upper bound. Keys can be added or removed in f.
+func (s *sortedKeys) scan(start, end string, reverse bool,
+	f func(k string) bool) {
+
+	inRange := func(k string) bool {
+		return k >= start && (end == "" || k < end)
+	}
+
+	if !reverse {
+		for i := sort.SearchStrings(s.keys, start); i < len(s.keys); {
+			k := s.keys[i]
+			if !inRange(k) || !f(k) {
+				return
+			}
+			// Search for the key after k, since f might have modified the keys.
+			i = sort.Search(len(s.keys), func(j int) bool { return s.keys[j] > k })
+		}
+		return
+	}
+
+	i := len(s.keys) - 1
+	if end != "" {
+		i = sort.SearchStrings(s.keys, end) - 1
+	}
+	for i >= 0 {
+		k := s.keys[i]
+		if !inRange(k) || !f(k) {
+			return
+		}
+		i = sort.SearchStrings(s.keys, k) - 1
+	}
+}
+
+// prefixEnd returns the smallest key that is larger than all the keys with
+// prefix p, or an empty string if there is no such key.
+func prefixEnd(p string) string {
+	b := []byte(p)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -1,19 +1,45 @@
 package state
 
+import "fmt"
+
 // OpType is the type of an operation in a transaction.
 type OpType int
 
-// Valid values for OpType.
+// Valid values for OpType. CAS, Incr and PutIfAbsent record the atomic
+// operations of transactional dictionaries. Their V is the value of the key
+// after the operation, so that replaying them is deterministic and idempotent.
 const (
 	Unknown OpType = iota
 	Put            = iota
 	Del            = iota
+	// CAS sets the value of the key to V after checking that its value was Old,
+	// or that the key did not exist when Old is nil.
+	CAS = iota
+	// Incr sets the value of the key to V after adding Delta to its integer
+	// value. Integers are stored as decimal strings.
+	Incr = iota
+	// PutIfAbsent sets the value of the key to V, which did not exist.
+	PutIfAbsent = iota
 )
 
 // Op is a state operation in a transaction.
 type Op struct {
-	T OpType
-	D string // Dictionary.
-	K string // Key.
-	V []byte // Value.
+	T     OpType
+	D     string // Dictionary.
+	K     string // Key.
+	V     []byte // Value.
+	Old   []byte // Expected value for CAS.
+	Delta int64  // Increment of Incr.
+}
+
+// applyOp applies o on dictionary d. The checks of atomic operations are done
+// when they are staged in a transaction, and they are applied as puts.
+func applyOp(d Dict, o Op) error {
+	switch o.T {
+	case Put, CAS, Incr, PutIfAbsent:
+		return d.Put(o.K, o.V)
+	case Del:
+		return d.Del(o.K)
+	}
+	return fmt.Errorf("invalid operation type %v", o.T)
 }
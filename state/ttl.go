@@ -0,0 +1,187 @@
+package state
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TTLDict is the dictionary that stores the deadlines of the keys put using
+// PutWithTTL. For each key, it stores the deadline of the key as well as an
+// entry in an index ordered by deadlines.
+const TTLDict = "__ttl__"
+
+// ErrTTLUnsupported is returned by PutWithTTL of dictionaries that are not
+// accessed through a Transactional state.
+var ErrTTLUnsupported = errors.New(
+	"TTL is only supported by transactional states")
+
+const (
+	ttlSep         = "\x00"
+	ttlMetaPrefix  = "k" + ttlSep
+	ttlIndexPrefix = "e" + ttlSep
+)
+
+func ttlMetaKey(d, k string) string {
+	return ttlMetaPrefix + d + ttlSep + k
+}
+
+func ttlIndexKey(exp int64, d, k string) string {
+	return fmt.Sprintf("%s%016X%s%s%s%s", ttlIndexPrefix, exp, ttlSep, d, ttlSep,
+		k)
+}
+
+// parseTTLIndexKey returns the deadline, the dictionary and the key of an
+// index entry.
+func parseTTLIndexKey(ik string) (exp int64, d, k string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(ik, ttlIndexPrefix), ttlSep, 3)
+	if len(parts) != 3 {
+		return 0, "", "", fmt.Errorf("invalid TTL index entry %q", ik)
+	}
+	e, err := strconv.ParseUint(parts[0], 16, 64)
+	if err != nil {
+		return 0, "", "", err
+	}
+	return int64(e), parts[1], parts[2], nil
+}
+
+// putWithTTL puts v for k in d, and records its deadline in ttls.
+func putWithTTL(ttls, d Dict, k string, v []byte, ttl time.Duration) error {
+	if err := clearTTL(ttls, d.Name(), k); err != nil {
+		return err
+	}
+	if err := d.Put(k, v); err != nil {
+		return err
+	}
+
+	exp := time.Now().Add(ttl).UnixNano()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(exp))
+	if err := ttls.Put(ttlMetaKey(d.Name(), k), b[:]); err != nil {
+		return err
+	}
+	return ttls.Put(ttlIndexKey(exp, d.Name(), k), nil)
+}
+
+// clearTTL removes the deadline of key k in dictionary d, if any.
+func clearTTL(ttls Dict, d, k string) error {
+	mk := ttlMetaKey(d, k)
+	b, err := ttls.Get(mk)
+	if err != nil || len(b) != 8 {
+		return nil
+	}
+	exp := int64(binary.BigEndian.Uint64(b))
+	if err := ttls.Del(ttlIndexKey(exp, d, k)); err != nil {
+		return err
+	}
+	return ttls.Del(mk)
+}
+
+// NextExpiry returns the earliest deadline of the keys in s, or a zero time
+// if no key has a TTL.
+func NextExpiry(s State) (next time.Time) {
+	s.Dict(TTLDict).Prefix(ttlIndexPrefix, func(ik string, v []byte) bool {
+		if exp, _, _, err := parseTTLIndexKey(ik); err == nil {
+			next = time.Unix(0, exp)
+		}
+		return false
+	})
+	return
+}
+
+// Expire deletes the keys of s whose deadline is not after now, and returns
+// the number of deleted keys. s should be a Transactional state with an open
+// transaction so that expired keys are removed atomically, and the deletions
+// can be replicated as a normal transaction.
+func Expire(s State, now time.Time) (n int) {
+	type dictKey struct{ d, k string }
+	var due []dictKey
+	end := fmt.Sprintf("%s%016X", ttlIndexPrefix, now.UnixNano()+1)
+	ttls := s.Dict(TTLDict)
+	ttls.Range(ttlIndexPrefix, end, func(ik string, v []byte) bool {
+		_, d, k, err := parseTTLIndexKey(ik)
+		if err != nil {
+			ttls.Del(ik)
+			return true
+		}
+		due = append(due, dictKey{d, k})
+		return true
+	})
+
+	for _, dk := range due {
+		s.Dict(dk.d).Del(dk.k)
+		// The key might have been deleted without clearing its deadline if it was
+		// not deleted through a Transactional state.
+		clearTTL(ttls, dk.d, dk.k)
+		n++
+	}
+	return
+}
+
+// ttlDict wraps the dictionaries of a Transactional state when there is no
+// open transaction, and maintains the deadlines of keys in TTLDict as well as
+// the entries of their indexes in IndexDict.
+type ttlDict struct {
+	Dict
+	t *Transactional
+}
+
+func (d *ttlDict) Put(k string, v []byte) error {
+	if err := d.reindex(k, v, true); err != nil {
+		return err
+	}
+	return d.Dict.Put(k, v)
+}
+
+func (d *ttlDict) Del(k string) error {
+	if d.Name() != TTLDict {
+		if err := clearTTL(d.t.State.Dict(TTLDict), d.Name(), k); err != nil {
+			return err
+		}
+	}
+	if err := d.reindex(k, nil, false); err != nil {
+		return err
+	}
+	return d.Dict.Del(k)
+}
+
+func (d *ttlDict) reindex(k string, v []byte, exists bool) error {
+	fns := d.t.indexes[d.Name()]
+	if len(fns) == 0 {
+		return nil
+	}
+	old, err := d.Dict.Get(k)
+	return reindex(d.t.State.Dict(IndexDict), fns, d.Name(), k, old, err == nil,
+		v, exists)
+}
+
+func (d *ttlDict) PutWithTTL(k string, v []byte, ttl time.Duration) error {
+	return putWithTTL(d.t.State.Dict(TTLDict), d, k, v, ttl)
+}
+
+func (d *ttlDict) CompareAndSwap(k string, old, new []byte) (bool, error) {
+	return CompareAndSwap(d, k, old, new)
+}
+
+func (d *ttlDict) Increment(k string, delta int64) (int64, error) {
+	return Increment(d, k, delta)
+}
+
+func (d *ttlDict) GetOrPut(k string, v []byte) ([]byte, bool, error) {
+	return GetOrPut(d, k, v)
+}
+
+func (d *ttlDict) Index(name string) Index {
+	return d.t.index(d.t.State.Dict(IndexDict), d.Name(), name)
+}
+
+func (d *ttlDict) GetGob(k string, v interface{}) error {
+	return GetGob(d, k, v)
+}
+
+func (d *ttlDict) PutGob(k string, v interface{}) error {
+	return PutGob(d, k, v)
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	inm := NewInMem()
+	tx := NewTransactional(inm)
+	tx.BeginTx()
+	err := tx.Dict("d").PutWithTTL("k1", []byte("v1"), time.Minute)
+	if err != nil {
+		t.Fatalf("cannot put with TTL: %v", err)
+	}
+	tx.Dict("d").PutWithTTL("k2", []byte("v2"), time.Hour)
+	tx.CommitTx()
+
+	next := NextExpiry(tx)
+	if next.IsZero() || next.After(time.Now().Add(time.Minute)) {
+		t.Errorf("invalid next expiry: %v", next)
+	}
+
+	tx.BeginTx()
+	if n := Expire(tx, time.Now().Add(2*time.Minute)); n != 1 {
+		t.Errorf("invalid number of expired keys: actual=%d want=1", n)
+	}
+	tx.CommitTx()
+	if _, err := inm.Dict("d").Get("k1"); err == nil {
+		t.Error("expired key is not deleted")
+	}
+	if _, err := inm.Dict("d").Get("k2"); err != nil {
+		t.Error("key is deleted before its deadline")
+	}
+
+	// Del removes the deadline of the key.
+	tx.Dict("d").Del("k2")
+	if next := NextExpiry(tx); !next.IsZero() {
+		t.Errorf("deadline is not removed: %v", next)
+	}
+	if n := len(inm.Dict(TTLDict).(*inMemDict).Dict); n != 0 {
+		t.Errorf("TTL dictionary is not empty: %d", n)
+	}
+}
+
+func TestPutWithTTLUpdate(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	d := tx.Dict("d")
+	d.PutWithTTL("k", []byte("v1"), time.Minute)
+	// Put keeps the deadline.
+	d.Put("k", []byte("v2"))
+	if next := NextExpiry(tx); next.IsZero() {
+		t.Error("put removes the deadline")
+	}
+	// PutWithTTL resets the deadline.
+	d.PutWithTTL("k", []byte("v3"), time.Hour)
+	if n := Expire(tx, time.Now().Add(2*time.Minute)); n != 0 {
+		t.Errorf("key is expired using its old deadline")
+	}
+	if n := Expire(tx, time.Now().Add(2*time.Hour)); n != 1 {
+		t.Errorf("key is not expired using its new deadline")
+	}
+}
+
+func TestPutWithTTLReplication(t *testing.T) {
+	leader := NewTransactional(NewInMem())
+	follower := NewTransactional(NewInMem())
+
+	replicate := func() {
+		if err := follower.Apply(leader.TxOps()); err != nil {
+			t.Fatalf("cannot apply ops: %v", err)
+		}
+		leader.CommitTx()
+	}
+
+	leader.BeginTx()
+	leader.Dict("d").PutWithTTL("k1", []byte("v1"), time.Minute)
+	leader.Dict("d").PutWithTTL("k2", []byte("v2"), time.Minute)
+	replicate()
+
+	leader.BeginTx()
+	leader.Dict("d").Del("k2")
+	Expire(leader, time.Now().Add(time.Hour))
+	replicate()
+
+	for _, s := range []*Transactional{leader, follower} {
+		for _, d := range []string{"d", TTLDict} {
+			n := 0
+			s.Dict(d).ForEach(func(k string, v []byte) { n++ })
+			if n != 0 {
+				t.Errorf("dictionary %v has %d keys after expiry", d, n)
+			}
+		}
+	}
+}
+
+func TestPutWithTTLUnsupported(t *testing.T) {
+	if err := NewInMem().Dict("d").PutWithTTL("k", nil, time.Minute); err !=
+		ErrTTLUnsupported {
+
+		t.Errorf("invalid error: %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package state
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 )
@@ -19,6 +21,9 @@ const (
 var (
 	ErrOpenTx error = errors.New("transaction is already open")
 	ErrNoTx   error = errors.New("no open transaction")
+	// ErrInvalidSavepoint is returned when rolling back to or releasing a
+	// savepoint that is released or belongs to another transaction.
+	ErrInvalidSavepoint error = errors.New("invalid savepoint")
 )
 
 // Tx represents the side effects of an operation: messages emitted during the
@@ -55,9 +60,16 @@ func (t Tx) String() string {
 	return fmt.Sprintf("Tx (ops: %d, open: %v)", len(t.Ops), t.Status == TxOpen)
 }
 
-// NewTransactional wraps s and writtens a transactional state.
+// NewTransactional wraps s and writtens a transactional state. If s is also
+// transactional, the new state shares the indexes of s.
 func NewTransactional(s State) *Transactional {
-	return &Transactional{State: s}
+	t := &Transactional{State: s}
+	if p, ok := s.(*Transactional); ok {
+		t.indexes = p.indexes
+	} else {
+		t.indexes = make(map[string]map[string]IndexFn)
+	}
+	return t
 }
 
 // Transactional wraps any state dictionary and makes it transactional.
@@ -65,6 +77,43 @@ type Transactional struct {
 	State  State
 	stage  map[string]*TxDict
 	status TxStatus
+
+	// txID identifies the current transaction so that savepoints of committed
+	// or aborted transactions cannot be used.
+	txID       uint64
+	savepoints []map[string]map[string]Op
+
+	// Index functions by dictionary and index name.
+	indexes map[string]map[string]IndexFn
+}
+
+// AddIndex defines index name on dictionary dict. The entries of the index
+// are extracted using f and are maintained when the keys of the dictionary
+// are modified. Only the keys modified after the index is added are indexed,
+// so indexes should be added before the state is used.
+func (t *Transactional) AddIndex(dict, name string, f IndexFn) {
+	fns, ok := t.indexes[dict]
+	if !ok {
+		fns = make(map[string]IndexFn)
+		t.indexes[dict] = fns
+	}
+	fns[name] = f
+}
+
+// index returns the index of dictionary d with the given name, whose entries
+// are stored in idx.
+func (t *Transactional) index(idx Dict, d, name string) Index {
+	if _, ok := t.indexes[d][name]; !ok {
+		return noIndex{}
+	}
+	return dictIndex{idx: idx, d: d, name: name}
+}
+
+// Savepoint marks a point in a transaction. Rolling back to a savepoint
+// discards the operations of the transaction after that point.
+type Savepoint struct {
+	tx    uint64
+	depth int
 }
 
 func (t *Transactional) TxStatus() TxStatus {
@@ -78,6 +127,7 @@ func (t *Transactional) BeginTx() error {
 
 	t.maybeNewTransaction()
 	t.status = TxOpen
+	t.txID++
 	return nil
 }
 func (t *Transactional) maybeNewTransaction() {
@@ -117,11 +167,14 @@ func (t *Transactional) CommitTx() error {
 		return ErrNoTx
 	}
 
+	var err error
 	for _, d := range t.stage {
-		d.CommitTx()
+		if derr := d.CommitTx(); derr != nil && derr != ErrNoTx && err == nil {
+			err = derr
+		}
 	}
 	t.Reset()
-	return nil
+	return err
 }
 
 func (t *Transactional) AbortTx() error {
@@ -133,8 +186,73 @@ func (t *Transactional) AbortTx() error {
 	return nil
 }
 
+// Savepoint creates a savepoint in the open transaction. Savepoints can be
+// nested: rolling back to a savepoint releases all the savepoints created
+// after it.
+func (t *Transactional) Savepoint() (Savepoint, error) {
+	if t.status != TxOpen {
+		return Savepoint{}, ErrNoTx
+	}
+
+	ops := make(map[string]map[string]Op, len(t.stage))
+	for n, d := range t.stage {
+		ops[n] = copyOps(d.Ops)
+	}
+	t.savepoints = append(t.savepoints, ops)
+	return Savepoint{tx: t.txID, depth: len(t.savepoints)}, nil
+}
+
+// RollbackTo discards the operations of the transaction after savepoint sp.
+// The savepoint remains valid and can be rolled back to again.
+func (t *Transactional) RollbackTo(sp Savepoint) error {
+	if err := t.checkSavepoint(sp); err != nil {
+		return err
+	}
+
+	ops := t.savepoints[sp.depth-1]
+	for n, d := range t.stage {
+		if o, ok := ops[n]; ok {
+			d.Ops = copyOps(o)
+			continue
+		}
+		d.Ops = make(map[string]Op)
+	}
+	t.savepoints = t.savepoints[:sp.depth]
+	return nil
+}
+
+// ReleaseSavepoint releases savepoint sp and all the savepoints created after
+// it, while keeping the operations of the transaction.
+func (t *Transactional) ReleaseSavepoint(sp Savepoint) error {
+	if err := t.checkSavepoint(sp); err != nil {
+		return err
+	}
+
+	t.savepoints = t.savepoints[:sp.depth-1]
+	return nil
+}
+
+func (t *Transactional) checkSavepoint(sp Savepoint) error {
+	if t.status != TxOpen {
+		return ErrNoTx
+	}
+	if sp.tx != t.txID || sp.depth < 1 || len(t.savepoints) < sp.depth {
+		return ErrInvalidSavepoint
+	}
+	return nil
+}
+
+func copyOps(ops map[string]Op) map[string]Op {
+	c := make(map[string]Op, len(ops))
+	for k, o := range ops {
+		c[k] = o
+	}
+	return c
+}
+
 func (t *Transactional) Reset() {
 	t.status = TxNone
+	t.savepoints = nil
 	if len(t.stage) == 0 {
 		return
 	}
@@ -152,11 +270,8 @@ func (t *Transactional) Apply(ops []Op) error {
 		return ErrOpenTx
 	}
 	for _, o := range ops {
-		switch o.T {
-		case Put:
-			t.Dict(o.D).Put(o.K, o.V)
-		case Del:
-			t.Dict(o.D).Del(o.K)
+		if err := applyOp(t.State.Dict(o.D), o); err != nil {
+			return fmt.Errorf("cannot apply %v on %v: %v", o.K, o.D, err)
 		}
 	}
 	return nil
@@ -176,7 +291,7 @@ func (t *Transactional) Restore(b []byte) error {
 
 func (t *Transactional) Dict(name string) Dict {
 	if t.status != TxOpen {
-		return t.State.Dict(name)
+		return &ttlDict{Dict: t.State.Dict(name), t: t}
 	}
 
 	d, ok := t.stage[name]
@@ -188,6 +303,7 @@ func (t *Transactional) Dict(name string) Dict {
 	d = &TxDict{
 		Dict: t.State.Dict(name),
 		Ops:  make(map[string]Op),
+		tx:   t,
 	}
 	d.BeginTx()
 	t.stage[name] = d
@@ -200,6 +316,8 @@ type TxDict struct {
 	Dict   Dict
 	Status TxStatus
 	Ops    map[string]Op
+
+	tx *Transactional
 }
 
 func (d *TxDict) Name() string {
@@ -207,6 +325,9 @@ func (d *TxDict) Name() string {
 }
 
 func (d *TxDict) Put(k string, v []byte) error {
+	if err := d.reindex(k, v, true); err != nil {
+		return err
+	}
 	d.Ops[k] = Op{
 		T: Put,
 		D: d.Dict.Name(),
@@ -219,17 +340,32 @@ func (d *TxDict) Put(k string, v []byte) error {
 func (d *TxDict) Get(k string) ([]byte, error) {
 	op, ok := d.Ops[k]
 	if ok {
-		switch op.T {
-		case Put:
-			return op.V, nil
-		case Del:
-			return nil, errors.New("No such key")
+		if v, ok := d.staged(op); ok {
+			return v, nil
 		}
+		return nil, errors.New("No such key")
 	}
 	return d.Dict.Get(k)
 }
 
+// staged returns the value of a key after applying its staged operation, and
+// whether the key exists.
+func (d *TxDict) staged(op Op) ([]byte, bool) {
+	if op.T == Del {
+		return nil, false
+	}
+	return op.V, true
+}
+
 func (d *TxDict) Del(k string) error {
+	if d.tx != nil && d.Name() != TTLDict {
+		if err := clearTTL(d.tx.Dict(TTLDict), d.Name(), k); err != nil {
+			return err
+		}
+	}
+	if err := d.reindex(k, nil, false); err != nil {
+		return err
+	}
 	d.Ops[k] = Op{
 		T: Del,
 		D: d.Dict.Name(),
@@ -242,19 +378,192 @@ func (d *TxDict) ForEach(f IterFn) {
 	d.Dict.ForEach(func(k string, v []byte) {
 		op, ok := d.Ops[k]
 		if ok {
-			switch op.T {
-			case Put:
-				f(op.K, op.V)
-				return
-			case Del:
-				return
+			if v, ok := d.staged(op); ok {
+				f(op.K, v)
 			}
+			return
 		}
 
 		f(k, v)
 	})
 }
 
+func (d *TxDict) PutWithTTL(k string, v []byte, ttl time.Duration) error {
+	if d.tx == nil {
+		return ErrTTLUnsupported
+	}
+	return putWithTTL(d.tx.Dict(TTLDict), d, k, v, ttl)
+}
+
+// CompareAndSwap is recorded as a CAS operation if there is no other
+// operation on k in the transaction.
+func (d *TxDict) CompareAndSwap(k string, old, new []byte) (bool, error) {
+	if !casMatches(d, k, old) {
+		return false, nil
+	}
+	if _, ok := d.Ops[k]; ok {
+		return true, d.Put(k, new)
+	}
+	if err := d.reindex(k, new, true); err != nil {
+		return false, err
+	}
+	d.Ops[k] = Op{
+		T:   CAS,
+		D:   d.Dict.Name(),
+		K:   k,
+		V:   new,
+		Old: old,
+	}
+	return true, nil
+}
+
+// Increment is recorded as an Incr operation if there is no other operation
+// on k in the transaction.
+func (d *TxDict) Increment(k string, delta int64) (int64, error) {
+	n, err := GetInt(d, k)
+	if err != nil {
+		return 0, err
+	}
+	n += delta
+	if _, ok := d.Ops[k]; ok {
+		return n, d.Put(k, formatInt(n))
+	}
+	if err := d.reindex(k, formatInt(n), true); err != nil {
+		return 0, err
+	}
+	d.Ops[k] = Op{
+		T:     Incr,
+		D:     d.Dict.Name(),
+		K:     k,
+		V:     formatInt(n),
+		Delta: delta,
+	}
+	return n, nil
+}
+
+// GetOrPut is recorded as a PutIfAbsent operation if k does not exist and
+// there is no other operation on k in the transaction.
+func (d *TxDict) GetOrPut(k string, v []byte) ([]byte, bool, error) {
+	if actual, err := d.Get(k); err == nil {
+		return actual, true, nil
+	}
+	if _, ok := d.Ops[k]; ok {
+		return v, false, d.Put(k, v)
+	}
+	if err := d.reindex(k, v, true); err != nil {
+		return nil, false, err
+	}
+	d.Ops[k] = Op{
+		T: PutIfAbsent,
+		D: d.Dict.Name(),
+		K: k,
+		V: v,
+	}
+	return v, false, nil
+}
+
+func (d *TxDict) Index(name string) Index {
+	if d.tx == nil {
+		return noIndex{}
+	}
+	return d.tx.index(d.tx.Dict(IndexDict), d.Name(), name)
+}
+
+// reindex updates the index entries of k before v is staged for k. exists is
+// false if k is being deleted.
+func (d *TxDict) reindex(k string, v []byte, exists bool) error {
+	if d.tx == nil {
+		return nil
+	}
+	fns := d.tx.indexes[d.Name()]
+	if len(fns) == 0 {
+		return nil
+	}
+	old, err := d.Get(k)
+	return reindex(d.tx.Dict(IndexDict), fns, d.Name(), k, old, err == nil, v,
+		exists)
+}
+
+func (d *TxDict) Range(start, end string, f RangeFn) {
+	d.scan(start, end, false, f)
+}
+
+func (d *TxDict) ReverseRange(start, end string, f RangeFn) {
+	d.scan(start, end, true, f)
+}
+
+func (d *TxDict) Prefix(p string, f RangeFn) {
+	d.scan(p, prefixEnd(p), false, f)
+}
+
+func (d *TxDict) ReversePrefix(p string, f RangeFn) {
+	d.scan(p, prefixEnd(p), true, f)
+}
+
+// scan merges the keys of the underlying dictionary with the operations of
+// the transaction in order.
+func (d *TxDict) scan(start, end string, reverse bool, f RangeFn) {
+	var staged []string
+	for k := range d.Ops {
+		if k >= start && (end == "" || k < end) {
+			staged = append(staged, k)
+		}
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(staged)))
+	} else {
+		sort.Strings(staged)
+	}
+	before := func(k1, k2 string) bool {
+		if reverse {
+			return k1 > k2
+		}
+		return k1 < k2
+	}
+
+	// emitStaged calls f for the staged puts that come before k, or for all of
+	// them if all is true.
+	emitStaged := func(k string, all bool) bool {
+		for len(staged) > 0 && (all || before(staged[0], k)) {
+			op := d.Ops[staged[0]]
+			staged = staged[1:]
+			if v, ok := d.staged(op); ok && !f(op.K, v) {
+				return false
+			}
+		}
+		return true
+	}
+
+	done := false
+	rf := func(k string, v []byte) bool {
+		if !emitStaged(k, false) {
+			done = true
+			return false
+		}
+		if len(staged) > 0 && staged[0] == k {
+			staged = staged[1:]
+		}
+		if op, ok := d.Ops[k]; ok {
+			if v, ok = d.staged(op); !ok {
+				return true
+			}
+		}
+		if !f(k, v) {
+			done = true
+			return false
+		}
+		return true
+	}
+	if reverse {
+		d.Dict.ReverseRange(start, end, rf)
+	} else {
+		d.Dict.Range(start, end, rf)
+	}
+	if !done {
+		emitStaged("", true)
+	}
+}
+
 func (d *TxDict) GetGob(k string, v interface{}) error {
 	return GetGob(d, k, v)
 }
@@ -275,16 +584,15 @@ func (d *TxDict) CommitTx() error {
 	if d.Status == TxNone {
 		return ErrNoTx
 	}
+	var err error
 	for _, o := range d.Ops {
-		switch o.T {
-		case Put:
-			d.Dict.Put(o.K, o.V)
-		case Del:
-			d.Dict.Del(o.K)
+		if err = applyOp(d.Dict, o); err != nil {
+			err = fmt.Errorf("cannot apply %v on %v: %v", o.K, o.D, err)
+			break
 		}
 	}
 	d.reset()
-	return nil
+	return err
 }
 
 func (d *TxDict) AbortTx() error {
@@ -66,3 +66,194 @@ func BenchmarkTransactions(b *testing.B) {
 		tx.CommitTx()
 	}
 }
+
+func TestTxAtomicOps(t *testing.T) {
+	leader := NewTransactional(NewInMem())
+	follower := NewTransactional(NewInMem())
+	leader.Dict("d").Put("cas", []byte("v1"))
+	follower.Dict("d").Put("cas", []byte("v1"))
+
+	leader.BeginTx()
+	d := leader.Dict("d")
+	if ok, err := d.CompareAndSwap("cas", []byte("v0"), []byte("v2")); ok ||
+		err != nil {
+
+		t.Errorf("compare-and-swap with an invalid value: ok=%v err=%v", ok, err)
+	}
+	if ok, _ := d.CompareAndSwap("cas", []byte("v1"), []byte("v2")); !ok {
+		t.Error("compare-and-swap fails")
+	}
+	if ok, _ := d.CompareAndSwap("new", nil, []byte("v")); !ok {
+		t.Error("compare-and-swap fails for a new key")
+	}
+	if n, _ := d.Increment("cnt", 2); n != 2 {
+		t.Errorf("invalid counter: actual=%d want=2", n)
+	}
+	if v, loaded, _ := d.GetOrPut("gop", []byte("v1")); loaded ||
+		string(v) != "v1" {
+
+		t.Errorf("invalid get-or-put: v=%s loaded=%v", v, loaded)
+	}
+	if v, loaded, _ := d.GetOrPut("gop", []byte("v2")); !loaded ||
+		string(v) != "v1" {
+
+		t.Errorf("invalid get-or-put: v=%s loaded=%v", v, loaded)
+	}
+
+	want := map[string]OpType{"cas": CAS, "new": CAS, "cnt": Incr,
+		"gop": PutIfAbsent}
+	ops := leader.TxOps()
+	if len(ops) != len(want) {
+		t.Errorf("invalid number of ops: actual=%d want=%d", len(ops), len(want))
+	}
+	for _, o := range ops {
+		if want[o.K] != o.T {
+			t.Errorf("invalid op type for %v: actual=%v want=%v", o.K, o.T,
+				want[o.K])
+		}
+	}
+
+	// Replaying the ops is idempotent.
+	for i := 0; i < 2; i++ {
+		if err := follower.Apply(ops); err != nil {
+			t.Fatalf("cannot apply ops: %v", err)
+		}
+	}
+	if err := leader.CommitTx(); err != nil {
+		t.Fatalf("cannot commit: %v", err)
+	}
+
+	for k, v := range map[string]string{"cas": "v2", "new": "v", "cnt": "2",
+		"gop": "v1"} {
+
+		for _, s := range []*Transactional{leader, follower} {
+			if sv, _ := s.Dict("d").Get(k); string(sv) != v {
+				t.Errorf("invalid value for %v: actual=%s want=%s", k, sv, v)
+			}
+		}
+	}
+}
+
+func TestTxApplyError(t *testing.T) {
+	s := NewTransactional(NewInMem())
+	if err := s.Apply([]Op{{T: Unknown, D: "d", K: "k"}}); err == nil {
+		t.Error("invalid op is applied")
+	}
+}
+
+func TestTxIncrement(t *testing.T) {
+	inm := NewInMem()
+	inm.Dict("d").Put("cnt", []byte("10"))
+	tx := NewTransactional(inm)
+	tx.BeginTx()
+	d := tx.Dict("d")
+	d.Increment("cnt", 1)
+	if v, _ := d.Get("cnt"); string(v) != "11" {
+		t.Errorf("invalid staged counter: actual=%s want=11", v)
+	}
+	// The second increment is merged with the first one.
+	if n, _ := d.Increment("cnt", 5); n != 16 {
+		t.Errorf("invalid counter: actual=%d want=16", n)
+	}
+	tx.CommitTx()
+	if v, _ := inm.Dict("d").Get("cnt"); string(v) != "16" {
+		t.Errorf("invalid counter after commit: actual=%s want=16", v)
+	}
+
+	inm.Dict("d").Put("str", []byte("a"))
+	if _, err := tx.Dict("d").Increment("str", 1); err == nil {
+		t.Error("can increment a non-integer value")
+	}
+}
+
+func TestTxSavepoint(t *testing.T) {
+	inm := NewInMem()
+	inm.Dict("d").Put("k0", []byte("v0"))
+	tx := NewTransactional(inm)
+	if _, err := tx.Savepoint(); err != ErrNoTx {
+		t.Errorf("savepoint created without a tx: %v", err)
+	}
+
+	tx.BeginTx()
+	tx.Dict("d").Put("k1", []byte("v1"))
+	sp1, err := tx.Savepoint()
+	if err != nil {
+		t.Fatalf("cannot create savepoint: %v", err)
+	}
+	tx.Dict("d").Put("k1", []byte("v2"))
+	tx.Dict("d").Del("k0")
+	sp2, _ := tx.Savepoint()
+	tx.Dict("e").Put("k2", []byte("v2"))
+
+	if err := tx.RollbackTo(sp2); err != nil {
+		t.Fatalf("cannot rollback to savepoint: %v", err)
+	}
+	if _, err := tx.Dict("e").Get("k2"); err == nil {
+		t.Error("key is not rolled back")
+	}
+	if _, err := tx.Dict("d").Get("k0"); err == nil {
+		t.Error("key is restored by rollback")
+	}
+
+	if err := tx.RollbackTo(sp1); err != nil {
+		t.Fatalf("cannot rollback to savepoint: %v", err)
+	}
+	if v, _ := tx.Dict("d").Get("k1"); string(v) != "v1" {
+		t.Errorf("invalid value after rollback: %s", v)
+	}
+	if v, _ := tx.Dict("d").Get("k0"); string(v) != "v0" {
+		t.Errorf("invalid value after rollback: %s", v)
+	}
+	if err := tx.RollbackTo(sp2); err != ErrInvalidSavepoint {
+		t.Errorf("can rollback to a released savepoint: %v", err)
+	}
+
+	// The savepoint remains valid after rollback.
+	tx.Dict("d").Put("k3", []byte("v3"))
+	if err := tx.RollbackTo(sp1); err != nil {
+		t.Fatalf("cannot rollback to savepoint twice: %v", err)
+	}
+	if _, err := tx.Dict("d").Get("k3"); err == nil {
+		t.Error("key is not rolled back")
+	}
+
+	tx.CommitTx()
+	if v, _ := inm.Dict("d").Get("k1"); string(v) != "v1" {
+		t.Errorf("invalid value after commit: %s", v)
+	}
+	if _, err := inm.Dict("e").Get("k2"); err == nil {
+		t.Error("rolled back key is committed")
+	}
+
+	tx.BeginTx()
+	if err := tx.RollbackTo(sp1); err != ErrInvalidSavepoint {
+		t.Errorf("can rollback to a savepoint of another tx: %v", err)
+	}
+	tx.AbortTx()
+}
+
+func TestTxReleaseSavepoint(t *testing.T) {
+	inm := NewInMem()
+	tx := NewTransactional(inm)
+	tx.BeginTx()
+	sp1, _ := tx.Savepoint()
+	tx.Dict("d").Put("k1", []byte("v1"))
+	sp2, _ := tx.Savepoint()
+	tx.Dict("d").Put("k2", []byte("v2"))
+	if err := tx.ReleaseSavepoint(sp2); err != nil {
+		t.Fatalf("cannot release savepoint: %v", err)
+	}
+	if err := tx.RollbackTo(sp2); err != ErrInvalidSavepoint {
+		t.Errorf("can rollback to a released savepoint: %v", err)
+	}
+	if _, err := tx.Dict("d").Get("k2"); err != nil {
+		t.Error("release discarded the operations of the tx")
+	}
+	if err := tx.RollbackTo(sp1); err != nil {
+		t.Fatalf("cannot rollback to savepoint: %v", err)
+	}
+	if _, err := tx.Dict("d").Get("k1"); err == nil {
+		t.Error("key is not rolled back")
+	}
+	tx.CommitTx()
+}
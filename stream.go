@@ -2,7 +2,6 @@ package beehive
 
 import (
 	"bytes"
-	"encoding/gob"
 	"errors"
 	"sync"
 	"time"
@@ -218,6 +217,10 @@ func (lb *loadBalancer) stopped() bool {
 	}
 }
 
+// batcherMaxBackoff is the maximum delay between retries when a remote hive
+// applies backpressure.
+const batcherMaxBackoff = 1 * time.Second
+
 const (
 	batcherMsgIndex = iota
 	batcherCmdIndex
@@ -356,19 +359,26 @@ func (b *batcher) batchBeeRaft(wg *sync.WaitGroup) {
 func (b *batcher) batchMsg(wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	var msgs []msg
 	var msgBuf bytes.Buffer
-	msgEnc := gob.NewEncoder(&msgBuf)
+	msgEnc := newMsgEncoder(b.h.codec, &msgBuf)
 
 	msgd := b.batchTick * time.Duration(b.weights[batcherMsgIndex])
+	backoff := msgd
 	var tch <-chan time.Time
+	// When the remote hive applies backpressure, we stop reading new messages
+	// until the pending messages are accepted.
+	msgCh := b.msgs
 
 	for {
 		reset := false
 		select {
-		case m := <-b.msgs:
+		case m := <-msgCh:
 			if err := msgEnc.Encode(m); err != nil {
 				glog.Errorf("cannot encode message: %v", err)
 				reset = true
+			} else {
+				msgs = append(msgs, m)
 			}
 
 			if tch == nil {
@@ -381,7 +391,23 @@ func (b *batcher) batchMsg(wg *sync.WaitGroup) {
 				continue
 			}
 
-			err := b.prx.sendMsgNew(&msgBuf)
+			err := b.prx.sendMsgNew(&msgBuf, b.h.codec.ContentType())
+			if bp, ok := err.(errBackpressure); ok && bp.accepted < len(msgs) {
+				glog.V(1).Infof("%v applies backpressure, retrying in %v", b.prx.to,
+					backoff)
+				msgs = msgs[bp.accepted:]
+				msgBuf.Reset()
+				msgEnc = newMsgEncoder(b.h.codec, &msgBuf)
+				for _, m := range msgs {
+					msgEnc.Encode(m)
+				}
+				msgCh = nil
+				tch = time.After(backoff)
+				if backoff < batcherMaxBackoff {
+					backoff *= 2
+				}
+				continue
+			}
 			if err != nil {
 				glog.Errorf("error in sending messages %v: %v", b.prx.to, err)
 			}
@@ -393,8 +419,11 @@ func (b *batcher) batchMsg(wg *sync.WaitGroup) {
 
 		if reset {
 			tch = nil
+			msgs = msgs[:0]
 			msgBuf.Reset()
-			msgEnc = gob.NewEncoder(&msgBuf)
+			msgEnc = newMsgEncoder(b.h.codec, &msgBuf)
+			msgCh = b.msgs
+			backoff = msgd
 		}
 	}
 }
@@ -404,7 +433,8 @@ func (b *batcher) batchCmd(wg *sync.WaitGroup) {
 
 	var cmds []cmdAndChannel
 	var cmdBuf bytes.Buffer
-	cmdEnc := gob.NewEncoder(&cmdBuf)
+	codec := valueCodec(b.h.codec)
+	cmdEnc := newCmdEncoder(codec, &cmdBuf)
 
 	cmdd := b.batchTick * time.Duration(b.weights[batcherCmdIndex])
 	var tch <-chan time.Time
@@ -417,7 +447,7 @@ func (b *batcher) batchCmd(wg *sync.WaitGroup) {
 			if err := cmdEnc.Encode(c.cmd); err != nil {
 				glog.Errorf("cannot encode command: %v", err)
 				cmdBuf.Reset()
-				cmdEnc = gob.NewEncoder(&cmdBuf)
+				cmdEnc = newCmdEncoder(codec, &cmdBuf)
 				for _, cc := range cmds {
 					cc.ch <- cmdResult{Err: err}
 				}
@@ -435,15 +465,15 @@ func (b *batcher) batchCmd(wg *sync.WaitGroup) {
 				continue
 			}
 
-			res, err := b.prx.sendCmdNew(&cmdBuf)
+			res, err := b.prx.sendCmdNew(&cmdBuf, codec.ContentType())
 			if err != nil {
 				glog.Errorf("error in sending cmd to %v: %v", b.prx.to, err)
 			} else {
-				dec := gob.NewDecoder(res.Body)
+				dec := newCmdDecoder(codec, res.Body)
 				var i int
 				for i = range cmds {
 					var cr cmdResult
-					if err := dec.Decode(&cr); err != nil {
+					if err := dec.DecodeResult(&cr); err != nil {
 						glog.Errorf("error in decoding results from %v: %v", b.prx.to, err)
 						break
 					}
@@ -469,7 +499,7 @@ func (b *batcher) batchCmd(wg *sync.WaitGroup) {
 		if reset {
 			tch = nil
 			cmdBuf.Reset()
-			cmdEnc = gob.NewEncoder(&cmdBuf)
+			cmdEnc = newCmdEncoder(codec, &cmdBuf)
 			cmds = cmds[:0]
 		}
 	}
@@ -577,20 +607,20 @@ func (b *batcher) stopped() bool {
 
 var _ streamer = &batcher{}
 
-func sendCmd(prx *proxy, c cmd) (interface{}, error) {
+func sendCmd(prx *proxy, codec Codec, c cmd) (interface{}, error) {
 	var cmdBuf bytes.Buffer
-	cmdEnc := gob.NewEncoder(&cmdBuf)
+	cmdEnc := newCmdEncoder(codec, &cmdBuf)
 	if err := cmdEnc.Encode(c); err != nil {
 		return nil, err
 	}
-	res, err := prx.sendCmdNew(&cmdBuf)
+	res, err := prx.sendCmdNew(&cmdBuf, codec.ContentType())
 	defer maybeCloseResponse(res)
 	if err != nil {
 		return nil, err
 	}
-	dec := gob.NewDecoder(res.Body)
+	dec := newCmdDecoder(codec, res.Body)
 	var cr cmdResult
-	if err := dec.Decode(&cr); err != nil {
+	if err := dec.DecodeResult(&cr); err != nil {
 		return nil, err
 	}
 	return cr.get()
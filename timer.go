@@ -1,6 +1,14 @@
 package beehive
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	bhgob "github.com/kandoo/beehive/gob"
+)
 
 // NewTimer returns a detached handler that calls fn per tick.
 func NewTimer(tick time.Duration, fn func()) DetachedHandler {
@@ -35,3 +43,98 @@ func (t timer) Stop(ctx RcvContext) {
 func (t timer) Rcv(msg Msg, ctx RcvContext) error {
 	return nil
 }
+
+// timerDict is the dictionary that stores the cell timers of a bee.
+const timerDict = "__timers__"
+
+// ErrNoSuchTimer is returned when a cell timer cannot be found.
+var ErrNoSuchTimer = errors.New("no such timer")
+
+// cellTimer is a persistent timer that sends Msg to the bee that owns Cell in
+// App according to a cron expression.
+type cellTimer struct {
+	Name  string
+	Spec  string
+	Next  time.Time
+	Fired time.Time // when the timer was last due.
+	Msg   msg
+	App   string
+	Cell  CellKey
+}
+
+// firingMsg returns the message sent when the timer fires at t.Fired. Each
+// firing has its own ID, derived from the timer and t.Fired, so that firings
+// are not dropped as duplicates of each other, but a firing repeated after a
+// failover is.
+func (t cellTimer) firingMsg() msg {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v/%v/%v/%d", t.App, t.Name, t.Msg.MsgID,
+		t.Fired.UnixNano())
+	m := t.Msg
+	m.MsgID = MsgID{Hive: t.Msg.MsgID.Hive, Seq: h.Sum64()}
+	return m
+}
+
+func (b *bee) SetTimer(name string, spec string, msgData interface{},
+	cell CellKey) error {
+
+	s, err := parseCron(spec)
+	if err != nil {
+		return err
+	}
+
+	t := cellTimer{
+		Name: name,
+		Spec: spec,
+		Next: s.next(time.Now()),
+		Msg:  *b.newMsg(msgData, 0, 0),
+		App:  b.app.Name(),
+		Cell: cell,
+	}
+	if t.Next.IsZero() {
+		return fmt.Errorf("cron expression %q never fires", spec)
+	}
+
+	if err := b.Dict(timerDict).PutGob(name, t); err != nil {
+		return err
+	}
+	glog.V(2).Infof("%v sets timer %v (%v) for %v", b, name, spec, cell)
+	b.armScheduler(t.Next)
+	return nil
+}
+
+func (b *bee) DelTimer(name string) error {
+	d := b.Dict(timerDict)
+	if _, err := d.Get(name); err != nil {
+		return ErrNoSuchTimer
+	}
+	return d.Del(name)
+}
+
+// dueTimers returns the timers that are due at now with their next activation
+// time updated, and the earliest activation time of the other timers.
+func (b *bee) dueTimers(now time.Time) (due []cellTimer, next time.Time) {
+	b.Dict(timerDict).ForEach(func(k string, v []byte) {
+		var t cellTimer
+		if err := bhgob.Decode(&t, v); err != nil {
+			glog.Errorf("%v cannot decode timer %v: %v", b, k, err)
+			return
+		}
+		if t.Next.After(now) {
+			if next.IsZero() || t.Next.Before(next) {
+				next = t.Next
+			}
+			return
+		}
+
+		s, err := parseCron(t.Spec)
+		if err != nil {
+			glog.Errorf("%v has an invalid timer %v: %v", b, k, err)
+			return
+		}
+		t.Fired = t.Next
+		t.Next = s.next(now)
+		due = append(due, t)
+	})
+	return
+}
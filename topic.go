@@ -0,0 +1,95 @@
+package beehive
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Topics are dot-separated strings (e.g., "sensors.kitchen.temp") attached to
+// messages using Publish. Handlers subscribe to topics using HandleTopic with
+// topic patterns, in which "*" matches exactly one segment and "#", which can
+// only be the last segment, matches zero or more segments. For example,
+// "sensors.*.temp" matches "sensors.kitchen.temp" and "sensors.#" matches all
+// topics under "sensors".
+const (
+	topicSep       = "."
+	topicWildOne   = "*"
+	topicWildMulti = "#"
+)
+
+// validTopicPattern returns an error if p is not a valid topic pattern.
+func validTopicPattern(p string) error {
+	if p == "" {
+		return fmt.Errorf("empty topic pattern")
+	}
+	segs := strings.Split(p, topicSep)
+	for i, s := range segs {
+		switch {
+		case s == "":
+			return fmt.Errorf("topic pattern %q has an empty segment", p)
+		case s == topicWildMulti && i != len(segs)-1:
+			return fmt.Errorf("%q must be the last segment in %q", topicWildMulti,
+				p)
+		}
+	}
+	return nil
+}
+
+// matchTopic returns whether topic matches the topic pattern p.
+func matchTopic(p, topic string) bool {
+	if topic == "" {
+		return false
+	}
+
+	ps := strings.Split(p, topicSep)
+	ts := strings.Split(topic, topicSep)
+	for i, s := range ps {
+		if s == topicWildMulti {
+			return true
+		}
+		if i >= len(ts) || (s != topicWildOne && s != ts[i]) {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
+
+// matches returns whether the handler subscribes to the topic. Handlers with
+// no topic pattern receive all the messages of their type.
+func (qh qeeAndHandler) matches(topic string) bool {
+	if len(qh.topics) == 0 {
+		return true
+	}
+	for _, p := range qh.topics {
+		if matchTopic(p, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *app) HandleTopic(pattern string, msg interface{}, h Handler) error {
+	if err := validTopicPattern(pattern); err != nil {
+		return err
+	}
+
+	t := MsgType(msg)
+	a.hive.RegisterMsg(msg)
+	return a.registerHandler(t, h, pattern)
+}
+
+func (a *app) HandleTopicFunc(pattern string, msg interface{}, m MapFunc,
+	r RcvFunc) error {
+
+	return a.HandleTopic(pattern, msg, &funcHandler{m, r})
+}
+
+func (b *bee) Publish(topic string, msgData interface{}) {
+	m := b.newMsg(msgData, b.ID(), 0)
+	m.MsgTopic = topic
+	b.bufferOrEmit(m)
+}
+
+func (h *hive) Publish(topic string, msgData interface{}) error {
+	return h.enqueMsg(&msg{MsgData: msgData, MsgTopic: topic})
+}
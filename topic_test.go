@@ -0,0 +1,143 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"sensors.kitchen.temp", "sensors.kitchen.temp", true},
+		{"sensors.kitchen.temp", "sensors.bedroom.temp", false},
+		{"sensors.*.temp", "sensors.kitchen.temp", true},
+		{"sensors.*.temp", "sensors.kitchen.humidity", false},
+		{"sensors.*.temp", "sensors.temp", false},
+		{"sensors.*", "sensors.kitchen.temp", false},
+		{"sensors.#", "sensors.kitchen.temp", true},
+		{"sensors.#", "sensors", true},
+		{"#", "sensors.kitchen.temp", true},
+		{"*.*.temp", "sensors.kitchen.temp", true},
+		{"sensors.#", "", false},
+	}
+	for _, c := range cases {
+		if m := matchTopic(c.pattern, c.topic); m != c.match {
+			t.Errorf("invalid match for pattern %q and topic %q: actual=%v want=%v",
+				c.pattern, c.topic, m, c.match)
+		}
+	}
+}
+
+func TestValidTopicPattern(t *testing.T) {
+	for _, p := range []string{"", "sensors..temp", "sensors.#.temp", "."} {
+		if err := validTopicPattern(p); err == nil {
+			t.Errorf("invalid topic pattern %q is accepted", p)
+		}
+	}
+	for _, p := range []string{"sensors", "sensors.*.temp", "sensors.#"} {
+		if err := validTopicPattern(p); err != nil {
+			t.Errorf("valid topic pattern %q is rejected: %v", p, err)
+		}
+	}
+}
+
+type topicTestMsg int
+
+func TestPublish(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_topic"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	type rcvd struct {
+		app   string
+		topic string
+	}
+	ch := make(chan rcvd, 16)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		ch <- rcvd{app: ctx.App(), topic: msg.Topic()}
+		return nil
+	}
+
+	h.NewApp("temp").HandleTopicFunc("sensors.*.temp", topicTestMsg(0), mf, rf)
+	h.NewApp("sensors").HandleTopicFunc("sensors.#", topicTestMsg(0), mf, rf)
+	h.NewApp("all").HandleFunc(topicTestMsg(0), mf, rf)
+	go h.Start()
+	defer h.Stop()
+
+	h.Publish("sensors.kitchen.temp", topicTestMsg(1))
+	h.Publish("sensors.kitchen.humidity", topicTestMsg(2))
+	h.Emit(topicTestMsg(3))
+
+	want := map[rcvd]int{
+		{"temp", "sensors.kitchen.temp"}:        1,
+		{"sensors", "sensors.kitchen.temp"}:     1,
+		{"sensors", "sensors.kitchen.humidity"}: 1,
+		{"all", "sensors.kitchen.temp"}:         1,
+		{"all", "sensors.kitchen.humidity"}:     1,
+		{"all", ""}:                             1,
+	}
+	for i := 0; i < 6; i++ {
+		select {
+		case r := <-ch:
+			if want[r] == 0 {
+				t.Errorf("unexpected message: %+v", r)
+			}
+			want[r]--
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d messages are received", i)
+		}
+	}
+	select {
+	case r := <-ch:
+		t.Errorf("unexpected message: %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHandleTopicConflicts(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_topic_conflicts"
+	cfg.Addr = newHiveAddrForTest()
+	cfg.InMemory = true
+	h := NewHiveWithConfig(cfg)
+
+	mf := func(msg Msg, ctx MapContext) MappedCells { return nil }
+	rf := func(msg Msg, ctx RcvContext) error { return nil }
+
+	all := h.NewApp("all")
+	if err := all.HandleFunc(topicTestMsg(0), mf, rf); err != nil {
+		t.Fatalf("cannot handle message: %v", err)
+	}
+	if err := all.HandleTopicFunc("a", topicTestMsg(0), mf, rf); err == nil {
+		t.Error("no error for a topic handler replacing a handler")
+	}
+
+	topic := h.NewApp("topic")
+	for _, p := range []string{"a", "b"} {
+		if err := topic.HandleTopicFunc(p, topicTestMsg(0), mf, rf); err != nil {
+			t.Fatalf("cannot handle topic %v: %v", p, err)
+		}
+	}
+	if err := topic.HandleTopicFunc("a", topicTestMsg(0), mf, rf); err == nil {
+		t.Error("no error for a duplicate topic handler")
+	}
+	if err := topic.HandleFunc(topicTestMsg(0), mf, rf); err == nil {
+		t.Error("no error for a handler replacing a topic handler")
+	}
+
+	want := map[string]int{"all": 0, "topic": 2}
+	for _, qh := range h.(*hive).qees[MsgType(topicTestMsg(0))] {
+		if n := len(qh.topics); n != want[qh.q.app.Name()] {
+			t.Errorf("invalid topics for %v: actual=%v want=%v", qh.q.app.Name(),
+				qh.topics, want[qh.q.app.Name()])
+		}
+	}
+}
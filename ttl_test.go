@@ -0,0 +1,52 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type ttlTestPut string
+type ttlTestGet string
+
+func TestPutWithTTL(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_ttl"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	ch := make(chan bool)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	app := h.NewApp("ttl", Persistent(1))
+	app.HandleFunc(ttlTestPut(""), mf, func(msg Msg, ctx RcvContext) error {
+		k := string(msg.Data().(ttlTestPut))
+		return ctx.Dict("D").PutWithTTL(k, []byte(k), 100*time.Millisecond)
+	})
+	app.HandleFunc(ttlTestGet(""), mf, func(msg Msg, ctx RcvContext) error {
+		_, err := ctx.Dict("D").Get(string(msg.Data().(ttlTestGet)))
+		ch <- err == nil
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(ttlTestPut("k"))
+	h.Emit(ttlTestGet("k"))
+	if !<-ch {
+		t.Fatal("key is not stored")
+	}
+
+	for i := 0; ; i++ {
+		time.Sleep(200 * time.Millisecond)
+		h.Emit(ttlTestGet("k"))
+		if !<-ch {
+			break
+		}
+		if i == 25 {
+			t.Fatal("key is not expired")
+		}
+	}
+}
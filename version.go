@@ -0,0 +1,196 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sync"
+
+	bhgob "github.com/kandoo/beehive/gob"
+	"github.com/kandoo/beehive/state"
+)
+
+// Upcaster converts the data of a message from one version to the next
+// version of its type.
+type Upcaster func(msgData interface{}) (interface{}, error)
+
+type msgVersion struct {
+	name    string
+	version int
+}
+
+var msgVersions = struct {
+	sync.RWMutex
+	byType    map[reflect.Type]msgVersion
+	byVersion map[msgVersion]reflect.Type
+	latest    map[string]int
+	upcasters map[msgVersion]Upcaster // upcasters by their source version.
+}{
+	byType:    make(map[reflect.Type]msgVersion),
+	byVersion: make(map[msgVersion]reflect.Type),
+	latest:    make(map[string]int),
+	upcasters: make(map[msgVersion]Upcaster),
+}
+
+// RegisterMsgVersion registers msgData as the given version of the message
+// type named name. All versions of a message type share the same name, which
+// is used as the message type instead of the Go type name. Hence, handlers
+// registered for any version of the type receive messages of all versions.
+//
+// Messages are upcasted to the latest version when they are decoded from
+// other hives, when they are emitted by replicated transactions, and when
+// scheduled messages and timers stored in the state of a bee (including its
+// snapshots) are emitted. Messages emitted locally are delivered as they are.
+// Other values stored in dictionaries are not upcasted, unless they are
+// stored using PutVersioned and read using GetVersioned.
+//
+// Versioned messages are registered in gob as name@version, and are decoded
+// regardless of how their Go types are named. RegisterMsgVersion must be
+// called before any handler is registered for the message type, preferably in
+// an init function.
+func RegisterMsgVersion(name string, version int, msgData interface{}) {
+	v := msgVersion{name: name, version: version}
+	t := reflect.TypeOf(msgData)
+
+	msgVersions.Lock()
+	if ov, ok := msgVersions.byType[t]; ok && ov != v {
+		msgVersions.Unlock()
+		panic(fmt.Sprintf("%v is already registered as %v@%d", t, ov.name,
+			ov.version))
+	}
+	msgVersions.byType[t] = v
+	msgVersions.byVersion[v] = t
+	if msgVersions.latest[name] < version {
+		msgVersions.latest[name] = version
+	}
+	msgVersions.Unlock()
+
+	gob.RegisterName(fmt.Sprintf("%v@%d", name, version), msgData)
+}
+
+// RegisterUpcaster registers the upcaster that converts the data of messages
+// named name from version from to a later version.
+func RegisterUpcaster(name string, from int, u Upcaster) {
+	msgVersions.Lock()
+	defer msgVersions.Unlock()
+	msgVersions.upcasters[msgVersion{name: name, version: from}] = u
+}
+
+// versionOf returns the registered name and version of msgData.
+func versionOf(msgData interface{}) (v msgVersion, ok bool) {
+	if msgData == nil {
+		return
+	}
+	msgVersions.RLock()
+	defer msgVersions.RUnlock()
+	v, ok = msgVersions.byType[reflect.TypeOf(msgData)]
+	return
+}
+
+// latestVersion returns the latest version of the message type named name.
+func latestVersion(name string) (int, bool) {
+	msgVersions.RLock()
+	defer msgVersions.RUnlock()
+	v, ok := msgVersions.latest[name]
+	return v, ok
+}
+
+// versionedType returns the Go type of the given version of a message type.
+func versionedType(name string, version int) (reflect.Type, bool) {
+	msgVersions.RLock()
+	defer msgVersions.RUnlock()
+	t, ok := msgVersions.byVersion[msgVersion{name: name, version: version}]
+	return t, ok
+}
+
+// Upcast converts msgData to the latest registered version of its type using
+// the registered upcasters. If msgData is not versioned or is already the
+// latest version, it is returned as is.
+func Upcast(msgData interface{}) (interface{}, error) {
+	for {
+		v, ok := versionOf(msgData)
+		if !ok {
+			return msgData, nil
+		}
+
+		msgVersions.RLock()
+		latest := msgVersions.latest[v.name]
+		u := msgVersions.upcasters[v]
+		msgVersions.RUnlock()
+
+		if v.version >= latest {
+			return msgData, nil
+		}
+		if u == nil {
+			return nil, fmt.Errorf("no upcaster for %v@%d", v.name, v.version)
+		}
+
+		d, err := u(msgData)
+		if err != nil {
+			return nil, err
+		}
+		if nv, ok := versionOf(d); !ok || nv.name != v.name ||
+			nv.version <= v.version {
+
+			return nil, fmt.Errorf("upcaster of %v@%d returns %T", v.name,
+				v.version, d)
+		}
+		msgData = d
+	}
+}
+
+// upcastMsg upcasts the data of m.
+func upcastMsg(m *msg) error {
+	d, err := Upcast(m.MsgData)
+	if err != nil {
+		return err
+	}
+	m.MsgData = d
+	return nil
+}
+
+// versionedValue is how versioned values are stored in dictionaries.
+type versionedValue struct {
+	Name    string
+	Version int
+	Data    []byte
+}
+
+// PutVersioned stores the versioned value v for key k in dictionary d. v must
+// be registered using RegisterMsgVersion.
+func PutVersioned(d state.Dict, k string, v interface{}) error {
+	mv, ok := versionOf(v)
+	if !ok {
+		return fmt.Errorf("%T is not versioned", v)
+	}
+	b, err := bhgob.Encode(v)
+	if err != nil {
+		return err
+	}
+	return d.PutGob(k, versionedValue{
+		Name:    mv.name,
+		Version: mv.version,
+		Data:    b,
+	})
+}
+
+// GetVersioned returns the value stored for key k in dictionary d using
+// PutVersioned. The value is upcasted to the latest version of its type. This
+// is useful to evolve the types stored in persistent states, whose snapshots
+// and transactions can contain older versions.
+func GetVersioned(d state.Dict, k string) (interface{}, error) {
+	var vv versionedValue
+	if err := d.GetGob(k, &vv); err != nil {
+		return nil, err
+	}
+	t, ok := versionedType(vv.Name, vv.Version)
+	if !ok {
+		return nil, fmt.Errorf("%v: %v@%d", ErrUnknownMsgType, vv.Name,
+			vv.Version)
+	}
+	p := reflect.New(t)
+	if err := bhgob.Decode(p.Interface(), vv.Data); err != nil {
+		return nil, err
+	}
+	return Upcast(p.Elem().Interface())
+}
@@ -0,0 +1,131 @@
+package beehive
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+const versionTestMsgType = "beehive.test.Order"
+
+type orderV1 struct {
+	Qty int
+}
+
+type orderV2 struct {
+	Quantity int
+	Unit     string
+}
+
+type itemV1 struct{}
+type itemV2 struct{}
+
+func init() {
+	RegisterMsgVersion(versionTestMsgType, 1, orderV1{})
+	RegisterMsgVersion(versionTestMsgType, 2, orderV2{})
+	RegisterUpcaster(versionTestMsgType, 1, func(d interface{}) (interface{},
+		error) {
+
+		return orderV2{Quantity: d.(orderV1).Qty, Unit: "pcs"}, nil
+	})
+
+	RegisterMsgVersion("beehive.test.Item", 1, itemV1{})
+	RegisterMsgVersion("beehive.test.Item", 2, itemV2{})
+}
+
+func TestMsgVersionType(t *testing.T) {
+	for _, d := range []interface{}{orderV1{}, orderV2{}} {
+		if typ := MsgType(d); typ != versionTestMsgType {
+			t.Errorf("invalid type for %T: actual=%v want=%v", d, typ,
+				versionTestMsgType)
+		}
+	}
+}
+
+func TestUpcast(t *testing.T) {
+	d, err := Upcast(orderV1{Qty: 2})
+	if err != nil {
+		t.Fatalf("cannot upcast: %v", err)
+	}
+	if d != (orderV2{Quantity: 2, Unit: "pcs"}) {
+		t.Errorf("invalid upcasted data: %#v", d)
+	}
+
+	if d, err = Upcast(orderV2{Quantity: 3}); err != nil || d != (orderV2{3, ""}) {
+		t.Errorf("latest version is changed: %#v (%v)", d, err)
+	}
+
+	if _, err = Upcast(itemV1{}); err == nil {
+		t.Error("data is upcasted without any upcaster")
+	}
+}
+
+func TestUpcastOnDecode(t *testing.T) {
+	for _, c := range []Codec{GobCodec, JSONCodec, ProtoCodec} {
+		var buf bytes.Buffer
+		m := msg{MsgData: orderV1{Qty: 1}}
+		if err := newMsgEncoder(c, &buf).Encode(m); err != nil {
+			t.Fatalf("%v cannot encode message: %v", c.Name(), err)
+		}
+		if err := newMsgDecoder(c, &buf).Decode(&m); err != nil {
+			t.Fatalf("%v cannot decode message: %v", c.Name(), err)
+		}
+		if m.Data() != (orderV2{Quantity: 1, Unit: "pcs"}) {
+			t.Errorf("%v does not upcast message: %#v", c.Name(), m.Data())
+		}
+	}
+}
+
+func TestGetVersioned(t *testing.T) {
+	d := state.NewInMem().Dict("orders")
+	if err := PutVersioned(d, "o", orderV1{Qty: 4}); err != nil {
+		t.Fatalf("cannot put versioned value: %v", err)
+	}
+	v, err := GetVersioned(d, "o")
+	if err != nil {
+		t.Fatalf("cannot get versioned value: %v", err)
+	}
+	if v != (orderV2{Quantity: 4, Unit: "pcs"}) {
+		t.Errorf("invalid versioned value: %#v", v)
+	}
+
+	if err := PutVersioned(d, "x", MyMsg(1)); err == nil {
+		t.Error("unversioned value is stored")
+	}
+}
+
+func TestUpcastScheduled(t *testing.T) {
+	cfg := DefaultCfg
+	cfg.StatePath = "/tmp/bhtest_version_schedule"
+	cfg.Addr = newHiveAddrForTest()
+	removeState(cfg)
+	h := NewHiveWithConfig(cfg)
+
+	ch := make(chan interface{}, 1)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	app := h.NewApp("version")
+	app.HandleFunc(MyMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+		ctx.EmitAfter(10*time.Millisecond, orderV1{Qty: 2})
+		return nil
+	})
+	app.HandleFunc(orderV2{}, mf, func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data()
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(MyMsg(1))
+	select {
+	case d := <-ch:
+		if d != (orderV2{Quantity: 2, Unit: "pcs"}) {
+			t.Errorf("scheduled message is not upcasted: %#v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled message is not emitted")
+	}
+}